@@ -1,13 +1,19 @@
 package backup
 
 import (
+	"context"
 	"encoding/gob"
+	"github.com/mateusbraga/saveit/progress"
 	"github.com/mateusbraga/saveit/rsync"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 )
 
+// opsBuffer is the number of decoded ops of the last incremental backup buffered while it is restored.
+const opsBuffer = 512
+
 func FullBackupReader(src io.Reader, dstSig io.Writer, dstFull io.Writer) error {
 	sigWriter := rsync.NewSignatureWriter()
 	multiwriter := io.MultiWriter(sigWriter, dstFull)
@@ -26,20 +32,28 @@ func FullBackupReader(src io.Reader, dstSig io.Writer, dstFull io.Writer) error
 	return nil
 }
 
+// IncrBackupReader makes an incremental backup of src against the previous backup, whose signature is oldDataSignature. Read the signatures written to dstSig with rsync.ReadGobSignature, which also reads the ones of older versions. It writes the signature of src to dstSig and the delta from the previous backup to dstIncr.
 func IncrBackupReader(oldDataSignature rsync.Signature, src io.Reader, dstSig io.Writer, dstIncr io.Writer) error {
 	sigWriter := rsync.NewSignatureWriter()
 	teeReader := io.TeeReader(src, sigWriter)
 
-	opc, errc := rsync.Delta(oldDataSignature, teeReader)
-	encIncr := gob.NewEncoder(dstIncr)
-	for op := range opc {
-		err := encIncr.Encode(op)
+	deltaReader := rsync.NewDeltaReader(oldDataSignature, teeReader)
+	encIncr := rsync.NewEncoder(dstIncr)
+	for {
+		op, err := deltaReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = encIncr.Encode(op)
 		if err != nil {
 			return err
 		}
 	}
-	if err := <-errc; err != nil {
-		return nil
+	if err := encIncr.Flush(); err != nil {
+		return err
 	}
 
 	sig := sigWriter.Signature()
@@ -51,56 +65,161 @@ func IncrBackupReader(oldDataSignature rsync.Signature, src io.Reader, dstSig io
 	return nil
 }
 
-func RestoreBackup(dst io.Writer, fullReader io.ReaderAt, diffReaders ...io.Reader) error {
-	tempFile, err := ioutil.TempFile("", "restore-backup")
+// ReverseBackupReader makes a reverse incremental backup: the newest version is always the full backup, and older versions are kept as deltas that create them from the next one. It writes the new full backup of src to dstFull and its signature to dstSig, and to dstReverse the delta that creates the previous full backup, the first oldSize bytes of oldFull with signature oldDataSignature, from the new one. The delta is inverted as it is created, so that memory use does not grow with the size of the changes. See RestoreReverseBackup.
+func ReverseBackupReader(oldFull io.ReaderAt, oldSize int64, oldDataSignature rsync.Signature, src io.Reader, dstSig io.Writer, dstFull io.Writer, dstReverse io.Writer) error {
+	sigWriter := rsync.NewSignatureWriter()
+	teeReader := io.TeeReader(src, io.MultiWriter(sigWriter, dstFull))
+
+	// stop the inversion if the delta or the encoding fails
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the delta is inverted as it is created, keeping only the ranges of the old data it copies, not its literal data. It is created here, so that src is read and dstFull written before returning.
+	forward := make(chan rsync.Op, opsBuffer)
+	forwardErrc := make(chan error, 1)
+	opc, errc := rsync.InvertDeltaContext(ctx, oldFull, oldSize, forward, forwardErrc)
+	deltaReader := rsync.NewDeltaReader(oldDataSignature, teeReader)
+	for {
+		op, err := deltaReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case forward <- op:
+		case <-opc:
+			// the inversion only ends before the delta if it fails
+			return <-errc
+		}
+	}
+	close(forward)
+	forwardErrc <- nil
+
+	encReverse := rsync.NewEncoder(dstReverse)
+	for op := range opc {
+		if err := encReverse.Encode(op); err != nil {
+			return err
+		}
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if err := encReverse.Flush(); err != nil {
+		return err
+	}
+
+	sig := sigWriter.Signature()
+	encSig := gob.NewEncoder(dstSig)
+	err := encSig.Encode(sig)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tempFile.Name())
+	return nil
+}
+
+// RestoreReverseBackup writes to dst an older version of a reverse incremental backup, made by ReverseBackupReader. fullReader is the newest full backup and reverseReaders the deltas from the newest to the version to restore. With no deltas, it copies the full backup.
+func RestoreReverseBackup(dst io.Writer, fullReader io.ReaderAt, reverseReaders ...io.Reader) error {
+	return RestoreReverseBackupContext(context.Background(), dst, fullReader, reverseReaders...)
+}
+
+// RestoreReverseBackupContext is like RestoreReverseBackup, but stops when ctx is done. See RestoreBackupContext.
+func RestoreReverseBackupContext(ctx context.Context, dst io.Writer, fullReader io.ReaderAt, reverseReaders ...io.Reader) error {
+	if len(reverseReaders) == 0 {
+		_, err := io.Copy(progress.FromContext(ctx).Writer(dst), io.NewSectionReader(fullReader, 0, math.MaxInt64))
+		return err
+	}
+	// each delta is against the data the previous one creates, as with forward incremental backups
+	return RestoreBackupContext(ctx, dst, fullReader, reverseReaders...)
+}
 
-	lastFullReader := fullReader
-	for i, diffReader := range diffReaders {
-		opc, errc := readRsyncOps(diffReader)
+// RestoreBackup writes to dst the data of the last of the incremental backups in diffReaders, each against the data of the previous one and the first against the full backup in fullReader. The incremental backups are composed into a single delta, so fullReader is patched only once. Only the extents of the incremental backups are kept in memory: the literal data of all but the last is written to a temporary file, in os.TempDir, and the last one is decoded as it is applied. If dst is an *os.File, the runs of zeros of the deltas are left as holes, so that sparse files are restored sparse. See rsync.Patch and rsync.Composer.
+func RestoreBackup(dst io.Writer, fullReader io.ReaderAt, diffReaders ...io.Reader) error {
+	return RestoreBackupContext(context.Background(), dst, fullReader, diffReaders...)
+}
 
-		isLastReader := i == len(diffReaders)-1
-		if isLastReader {
-			err := rsync.Patch(lastFullReader, opc, errc, dst)
-			if err != nil {
-				return err
-			}
-		} else {
-			err := rsync.Patch(lastFullReader, opc, errc, tempFile)
-			if err != nil {
-				return err
-			}
+// RestoreBackupContext is like RestoreBackup, but stops when ctx is done. If ctx carries a progress.Meter, the bytes written to dst, the blocks matched and the literal bytes are counted in it. See rsync.PatchContext.
+func RestoreBackupContext(ctx context.Context, dst io.Writer, fullReader io.ReaderAt, diffReaders ...io.Reader) error {
+	if len(diffReaders) == 0 {
+		return nil
+	}
+
+	// the literal data of all incremental backups but the last is kept in a temporary file, so that only their extents are in memory
+	last := len(diffReaders) - 1
+	composer := rsync.NewComposer(nil)
+	if last > 0 {
+		spool, err := ioutil.TempFile("", "saveit-restore-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+		composer = rsync.NewComposer(spool)
+	}
+	for _, diffReader := range diffReaders[:last] {
+		if err := addRsyncOps(composer, diffReader); err != nil {
+			return err
 		}
-		lastFullReader = tempFile
 	}
 
-	return nil
+	// stop decoding and composing if the patch returns early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opc, errc := decodeRsyncOps(ctx, diffReaders[last])
+	opc, errc = composer.ComposeContext(ctx, opc, errc)
+	return rsync.PatchContext(ctx, fullReader, opc, errc, dst)
 }
 
-func readRsyncOps(opReader io.Reader) (<-chan rsync.Op, <-chan error) {
-	opc := make(chan rsync.Op, 20)
-	errc := make(chan error, 1)
+// addRsyncOps decodes the ops of opReader, adds them to composer, and ends the delta.
+func addRsyncOps(composer *rsync.Composer, opReader io.Reader) error {
+	dec := rsync.NewDecoder(opReader)
+	for {
+		var op rsync.Op
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			composer.EndDelta()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := composer.Add(op); err != nil {
+			return err
+		}
+	}
+}
 
+// decodeRsyncOps decodes the ops of opReader as they are read, and sends them through the returned channels like rsync.DeltaContext.
+func decodeRsyncOps(ctx context.Context, opReader io.Reader) (<-chan rsync.Op, <-chan error) {
+	opc := make(chan rsync.Op, opsBuffer)
+	errc := make(chan error, 1)
 	go func() {
 		defer close(opc)
 
-		var op rsync.Op
-		dec := gob.NewDecoder(opReader)
+		dec := rsync.NewDecoder(opReader)
 		for {
+			var op rsync.Op
 			err := dec.Decode(&op)
 			if err == io.EOF {
-				break
+				errc <- nil
+				return
 			}
 			if err != nil {
 				errc <- err
+				return
+			}
+
+			select {
+			case opc <- op:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
 			}
-			opc <- op
 		}
-		errc <- nil
 	}()
-
 	return opc, errc
 }
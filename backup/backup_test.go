@@ -0,0 +1,283 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mateusbraga/saveit/rsync"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// createFakeData returns size pseudo-random bytes.
+func createFakeData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// modify returns a copy of data with some bytes changed, inserted and removed.
+func modify(data []byte, seed int64) []byte {
+	result := append([]byte(nil), data[:len(data)/4]...)
+	result = append(result, createFakeData(1000, seed)...)
+	result = append(result, data[len(data)/4:len(data)/2]...)
+	result = append(result, data[len(data)/2+5000:]...)
+	copy(result[len(result)/3:], createFakeData(300, seed+1))
+	return result
+}
+
+// makeBackups returns the full backup of the first version and the incremental backups of the others, each against the previous one.
+func makeBackups(t *testing.T, versions [][]byte) ([]byte, [][]byte) {
+	full := new(bytes.Buffer)
+	sig := new(bytes.Buffer)
+	if err := FullBackupReader(bytes.NewReader(versions[0]), sig, full); err != nil {
+		t.Fatal(err)
+	}
+
+	var incrs [][]byte
+	for _, version := range versions[1:] {
+		oldSig, err := rsync.ReadGobSignature(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = new(bytes.Buffer)
+		incr := new(bytes.Buffer)
+		if err := IncrBackupReader(oldSig, bytes.NewReader(version), sig, incr); err != nil {
+			t.Fatal(err)
+		}
+		incrs = append(incrs, incr.Bytes())
+	}
+	return full.Bytes(), incrs
+}
+
+func TestRestoreBackup(t *testing.T) {
+	versions := [][]byte{createFakeData(200*1024, 0)}
+	for i := 1; i < 4; i++ {
+		versions = append(versions, modify(versions[i-1], int64(i)))
+	}
+	full, incrs := makeBackups(t, versions)
+
+	for n := 1; n <= len(incrs); n++ {
+		var diffReaders []io.Reader
+		for _, incr := range incrs[:n] {
+			diffReaders = append(diffReaders, bytes.NewReader(incr))
+		}
+		restored := new(bytes.Buffer)
+		if err := RestoreBackup(restored, bytes.NewReader(full), diffReaders...); err != nil {
+			t.Fatalf("%v incremental backups: %v", n, err)
+		}
+		if !bytes.Equal(restored.Bytes(), versions[n]) {
+			t.Errorf("%v incremental backups: restored data is not equal to version %v", n, n)
+		}
+	}
+}
+
+func TestRestoreBackupCorrupt(t *testing.T) {
+	versions := [][]byte{createFakeData(200*1024, 0)}
+	for i := 1; i < 3; i++ {
+		versions = append(versions, modify(versions[i-1], int64(i)))
+	}
+	full, incrs := makeBackups(t, versions)
+
+	// ends with an op the decoder does not know
+	invalidOpCode := func(incr []byte) []byte {
+		return append(append([]byte(nil), incr...), 0x7f)
+	}
+	// decodes, but is against a basis other than the previous version
+	otherBasis := new(bytes.Buffer)
+	enc := rsync.NewEncoder(otherBasis)
+	enc.Encode(rsync.Op{OpCode: rsync.COPY, Offset: 0, Length: 10, Basis: 1})
+	enc.Flush()
+
+	for _, test := range []struct {
+		name  string
+		incrs [][]byte
+	}{
+		{"invalid op of the last incremental", [][]byte{incrs[0], invalidOpCode(incrs[1])}},
+		{"invalid op of an incremental before the last", [][]byte{invalidOpCode(incrs[0]), incrs[1]}},
+		{"incremental against another basis", [][]byte{otherBasis.Bytes(), incrs[1]}},
+	} {
+		var diffReaders []io.Reader
+		for _, incr := range test.incrs {
+			diffReaders = append(diffReaders, bytes.NewReader(incr))
+		}
+		err := RestoreBackup(ioutil.Discard, bytes.NewReader(full), diffReaders...)
+		if !errors.Is(err, rsync.ErrCorruptDelta) {
+			t.Errorf("%v: expected an error wrapping rsync.ErrCorruptDelta, got %v", test.name, err)
+		}
+	}
+}
+
+func TestRestoreBackupZero(t *testing.T) {
+	data := createFakeData(200*1024, 0)
+	// runs of zeros the full backup does not have, in the middle, as long as a few blocks, and at the end
+	withZeros := append([]byte(nil), data[:50*1024]...)
+	withZeros = append(withZeros, make([]byte, 3*rsync.DefaultBlockSize)...)
+	withZeros = append(withZeros, data[50*1024:]...)
+	withZeros = append(withZeros, make([]byte, 20*1024)...)
+	// the second incremental copies the blocks of zeros from the first
+	modified := append([]byte(nil), withZeros...)
+	copy(modified, createFakeData(100, 1))
+	modified = append(modified, createFakeData(1000, 2)...)
+	versions := [][]byte{data, withZeros, modified}
+	full, incrs := makeBackups(t, versions)
+
+	// the zeros of the first incremental are still ZERO ops once composed with the second
+	var deltas [][]rsync.Op
+	for _, incr := range incrs {
+		ops, err := readRsyncOps(bytes.NewReader(incr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, ops)
+	}
+	composed, err := rsync.ComposeDeltas(deltas...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats rsync.DeltaStats
+	for _, op := range composed {
+		stats.Add(op)
+	}
+	if stats.ZeroBytes < 2*rsync.DefaultBlockSize {
+		t.Errorf("expected at least %v bytes of ZERO ops in the composed delta, got %v", 2*rsync.DefaultBlockSize, stats.ZeroBytes)
+	}
+
+	f, err := ioutil.TempFile("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := RestoreBackup(f, bytes.NewReader(full), bytes.NewReader(incrs[0]), bytes.NewReader(incrs[1])); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, versions[2]) {
+		t.Errorf("expected %v restored bytes, got %v bytes or different data", len(versions[2]), len(restored))
+	}
+}
+
+func TestReverseBackup(t *testing.T) {
+	versions := [][]byte{createFakeData(200*1024, 0)}
+	for i := 1; i < 4; i++ {
+		versions = append(versions, modify(versions[i-1], int64(i)))
+	}
+
+	// the full backup of each version, and the reverse delta that creates the previous one from it
+	full := versions[0]
+	sig := new(bytes.Buffer)
+	if err := FullBackupReader(bytes.NewReader(full), sig, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var reverses [][]byte
+	for _, version := range versions[1:] {
+		oldSig, err := rsync.ReadGobSignature(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = new(bytes.Buffer)
+		newFull := new(bytes.Buffer)
+		reverse := new(bytes.Buffer)
+		if err := ReverseBackupReader(bytes.NewReader(full), int64(len(full)), oldSig, bytes.NewReader(version), sig, newFull, reverse); err != nil {
+			t.Fatal(err)
+		}
+		full = newFull.Bytes()
+		reverses = append([][]byte{reverse.Bytes()}, reverses...)
+	}
+
+	for n := 0; n <= len(reverses); n++ {
+		var reverseReaders []io.Reader
+		for _, reverse := range reverses[:n] {
+			reverseReaders = append(reverseReaders, bytes.NewReader(reverse))
+		}
+		restored := new(bytes.Buffer)
+		if err := RestoreReverseBackup(restored, bytes.NewReader(full), reverseReaders...); err != nil {
+			t.Fatalf("%v reverse deltas: %v", n, err)
+		}
+		if version := len(versions) - 1 - n; !bytes.Equal(restored.Bytes(), versions[version]) {
+			t.Errorf("%v reverse deltas: restored data is not equal to version %v", n, version)
+		}
+	}
+}
+
+// heapWriter counts and discards what is written to it, and records the largest heap in use, after a garbage collection, every interval bytes.
+type heapWriter struct {
+	interval int64
+	written  int64
+	maxHeap  uint64
+}
+
+func (w *heapWriter) Write(p []byte) (int, error) {
+	if (w.written+int64(len(p)))/w.interval > w.written/w.interval {
+		w.sample()
+	}
+	w.written += int64(len(p))
+	return len(p), nil
+}
+
+func (w *heapWriter) sample() {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > w.maxHeap {
+		w.maxHeap = stats.HeapAlloc
+	}
+}
+
+func TestReverseBackupMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	const size = 64 * 1024 * 1024
+	oldData := createFakeData(size, 0)
+	oldSig, err := rsync.NewSignature(bytes.NewReader(oldData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new data has nothing in common with the old data, so the delta is all literal data, and so is the reverse delta
+	newData := io.LimitReader(rand.New(rand.NewSource(1)), size)
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	full := &heapWriter{interval: 4 * 1024 * 1024}
+	reverse := &heapWriter{interval: 4 * 1024 * 1024}
+	if err := ReverseBackupReader(bytes.NewReader(oldData), size, oldSig, newData, ioutil.Discard, full, reverse); err != nil {
+		t.Fatal(err)
+	}
+
+	if full.written != size || reverse.written < size {
+		t.Errorf("expected a full backup of %v bytes and a reverse delta of at least as many, got %v and %v", size, full.written, reverse.written)
+	}
+	maxHeap := full.maxHeap
+	if reverse.maxHeap > maxHeap {
+		maxHeap = reverse.maxHeap
+	}
+	if maxHeap > stats.HeapAlloc+size/4 {
+		t.Errorf("expected the heap to grow by less than %v bytes for %v bytes of changes, got %v", size/4, size, maxHeap-stats.HeapAlloc)
+	}
+}
+
+// readRsyncOps decodes all the ops of opReader.
+func readRsyncOps(opReader io.Reader) ([]rsync.Op, error) {
+	var ops []rsync.Op
+	dec := rsync.NewDecoder(opReader)
+	for {
+		var op rsync.Op
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			return ops, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+}
@@ -0,0 +1,110 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// barWidth is the number of characters of the bar printed by NewBar.
+const barWidth = 30
+
+// NewPrinter returns the Func that prints progress to w in format: "bar" for NewBar, "json" for NewJSONLines, or "" for none, a nil Func.
+func NewPrinter(format string, w io.Writer) (Func, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case "bar":
+		return NewBar(w), nil
+	case "json":
+		return NewJSONLines(w), nil
+	}
+	return nil, fmt.Errorf("progress: unknown format %q, use 'bar' or 'json'", format)
+}
+
+// NewBar returns a Func that prints progress to w as a bar, rewritten in place on a terminal, with the bytes processed, the blocks matched, the literal bytes and the ETA. The bar is only drawn when the total is known.
+func NewBar(w io.Writer) Func {
+	return func(p Progress) {
+		var b strings.Builder
+		b.WriteString("\r")
+		b.WriteString(p.Op)
+		if p.Total > 0 {
+			done := p.Bytes
+			if done > p.Total {
+				done = p.Total
+			}
+			filled := int(done * barWidth / p.Total)
+			fmt.Fprintf(&b, " [%v%v] %3d%% %v/%v", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), done*100/p.Total, formatBytes(p.Bytes), formatBytes(p.Total))
+		} else {
+			fmt.Fprintf(&b, " %v", formatBytes(p.Bytes))
+		}
+		if p.MatchedBlocks > 0 || p.LiteralBytes > 0 {
+			fmt.Fprintf(&b, ", %v blocks matched, %v literal", p.MatchedBlocks, formatBytes(p.LiteralBytes))
+		}
+		if p.Done {
+			fmt.Fprintf(&b, ", done in %v", p.Elapsed.Round(time.Second))
+		} else if eta := p.ETA(); eta >= 0 {
+			fmt.Fprintf(&b, ", ETA %v", eta.Round(time.Second))
+		}
+		// clear what is left of a longer previous line
+		b.WriteString("\033[K")
+		if p.Done {
+			b.WriteString("\n")
+		}
+		io.WriteString(w, b.String())
+	}
+}
+
+// jsonProgress is a line printed by NewJSONLines.
+type jsonProgress struct {
+	Op            string
+	Bytes         int64
+	Total         int64 `json:",omitempty"`
+	MatchedBlocks int64
+	MatchedBytes  int64
+	LiteralBytes  int64
+	// ElapsedSeconds and ETASeconds are in seconds, ETASeconds is -1 if unknown.
+	ElapsedSeconds float64
+	ETASeconds     float64
+	Done           bool
+}
+
+// NewJSONLines returns a Func that prints each report of progress to w as a line of JSON, for other programs to read.
+func NewJSONLines(w io.Writer) Func {
+	enc := json.NewEncoder(w)
+	return func(p Progress) {
+		eta := -1.0
+		if d := p.ETA(); d >= 0 {
+			eta = d.Seconds()
+		}
+		enc.Encode(jsonProgress{
+			Op:             p.Op,
+			Bytes:          p.Bytes,
+			Total:          p.Total,
+			MatchedBlocks:  p.MatchedBlocks,
+			MatchedBytes:   p.MatchedBytes,
+			LiteralBytes:   p.LiteralBytes,
+			ElapsedSeconds: p.Elapsed.Seconds(),
+			ETASeconds:     eta,
+			Done:           p.Done,
+		})
+	}
+}
+
+// formatBytes returns n in B, KiB, MiB, GiB or TiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	value := float64(n) / unit
+	for _, suffix := range []string{"KiB", "MiB", "GiB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %v", value, suffix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f TiB", value)
+}
@@ -0,0 +1,218 @@
+// Package progress reports the progress of long operations, like signatures, deltas, patches and copies, to an observer.
+//
+// The operation counts what it processes in a Meter, that calls a Func with a Progress at most every Interval. Functions that take a context.Context find the Meter with FromContext, others take it in their options.
+//
+// A Meter is for a single operation. Both sides of a delta count the blocks matched and the literal bytes, so a delta patched as it is created, with the same Meter in the contexts of both, counts them twice; give each side its own context.
+package progress
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Interval is the minimum time between two reports of a Meter, except for the one of Done.
+const Interval = 500 * time.Millisecond
+
+// Progress is a snapshot of the progress of an operation.
+type Progress struct {
+	// Op is the name of the operation, like "signature" or "delta".
+	Op string
+	// Bytes is the number of bytes processed: hashed by signatures, read from the new data by deltas, written by patches and copies.
+	Bytes int64
+	// Total is the number of bytes the operation processes, or 0 if unknown.
+	Total int64
+	// MatchedBlocks and MatchedBytes are the blocks and bytes of deltas and patches copied from the old data.
+	MatchedBlocks int64
+	MatchedBytes  int64
+	// LiteralBytes is the number of bytes of deltas and patches not found in the old data.
+	LiteralBytes int64
+	// Elapsed is the time since the Meter was created.
+	Elapsed time.Duration
+	// Done is whether the operation ended.
+	Done bool
+}
+
+// ETA returns the estimated time until the operation ends, from its rate so far. It returns -1 if Total is unknown or nothing was processed yet.
+func (p Progress) ETA() time.Duration {
+	if p.Total <= 0 || p.Bytes <= 0 {
+		return -1
+	}
+	if p.Bytes >= p.Total {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * float64(p.Total-p.Bytes) / float64(p.Bytes))
+}
+
+// Func observes the progress of an operation. It is called by the goroutine that adds to the Meter, outside of its lock, so it may call the methods of the Meter, but the operation waits for it. The calls of a Meter do not overlap, and each one has newer progress than the one before.
+type Func func(p Progress)
+
+// Meter counts the progress of an operation and reports it to a Func. Its methods may be called from several goroutines. A nil *Meter counts nothing, so that it can be passed when there is no observer.
+type Meter struct {
+	report Func
+	start  time.Time
+
+	mu   sync.Mutex
+	p    Progress
+	last time.Time
+	// seq counts the snapshots of p taken for reports, so that reportMu lets only newer ones than reported through.
+	seq uint64
+
+	reportMu sync.Mutex
+	reported uint64
+}
+
+// NewMeter returns a Meter of the operation op, that processes total bytes, or 0 if unknown, reporting to report. If report is nil, it returns nil.
+func NewMeter(op string, total int64, report Func) *Meter {
+	if report == nil {
+		return nil
+	}
+	now := time.Now()
+	return &Meter{
+		report: report,
+		start:  now,
+		p:      Progress{Op: op, Total: total},
+		last:   now,
+	}
+}
+
+// Add adds n processed bytes.
+func (m *Meter) Add(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.update(func(p *Progress) { p.Bytes += n })
+}
+
+// AddMatched adds blocks blocks of n bytes copied from the old data.
+func (m *Meter) AddMatched(blocks int64, n int64) {
+	if m == nil {
+		return
+	}
+	m.update(func(p *Progress) {
+		p.MatchedBlocks += blocks
+		p.MatchedBytes += n
+	})
+}
+
+// AddLiteral adds n bytes not found in the old data.
+func (m *Meter) AddLiteral(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.update(func(p *Progress) { p.LiteralBytes += n })
+}
+
+// update applies f to the progress, and reports it if Interval passed since the last report.
+func (m *Meter) update(f func(p *Progress)) {
+	m.mu.Lock()
+	f(&m.p)
+	now := time.Now()
+	if now.Sub(m.last) < Interval {
+		m.mu.Unlock()
+		return
+	}
+	m.last = now
+	m.p.Elapsed = now.Sub(m.start)
+	p, seq := m.snapshot()
+	m.mu.Unlock()
+
+	m.send(p, seq)
+}
+
+// snapshot returns a copy of the progress to report and its sequence number. m.mu must be held.
+func (m *Meter) snapshot() (Progress, uint64) {
+	m.seq++
+	return m.p, m.seq
+}
+
+// send reports p, unless a newer snapshot than seq was already reported.
+func (m *Meter) send(p Progress, seq uint64) {
+	m.reportMu.Lock()
+	defer m.reportMu.Unlock()
+
+	if seq <= m.reported {
+		return
+	}
+	m.reported = seq
+	m.report(p)
+}
+
+// Progress returns the progress so far.
+func (m *Meter) Progress() Progress {
+	if m == nil {
+		return Progress{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.p
+	p.Elapsed = time.Since(m.start)
+	return p
+}
+
+// Done reports the progress a last time, with Done set. The operation must not add to m after it.
+func (m *Meter) Done() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.p.Done = true
+	m.p.Elapsed = time.Since(m.start)
+	p, seq := m.snapshot()
+	m.mu.Unlock()
+
+	m.send(p, seq)
+}
+
+// Reader returns a Reader that adds the bytes read from r to m. If m is nil, it returns r.
+func (m *Meter) Reader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &meterReader{r: r, m: m}
+}
+
+// Writer returns a Writer that adds the bytes written to w to m. If m is nil, it returns w.
+func (m *Meter) Writer(w io.Writer) io.Writer {
+	if m == nil {
+		return w
+	}
+	return &meterWriter{w: w, m: m}
+}
+
+type meterReader struct {
+	r io.Reader
+	m *Meter
+}
+
+func (r *meterReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.m.Add(int64(n))
+	return n, err
+}
+
+type meterWriter struct {
+	w io.Writer
+	m *Meter
+}
+
+func (w *meterWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	w.m.Add(int64(n))
+	return n, err
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries m.
+func NewContext(ctx context.Context, m *Meter) context.Context {
+	return context.WithValue(ctx, contextKey{}, m)
+}
+
+// FromContext returns the Meter ctx carries, or nil.
+func FromContext(ctx context.Context) *Meter {
+	m, _ := ctx.Value(contextKey{}).(*Meter)
+	return m
+}
@@ -0,0 +1,122 @@
+package progress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	var reports []Progress
+	m := NewMeter("copy", 100, func(p Progress) { reports = append(reports, p) })
+
+	if _, err := io.Copy(ioutil.Discard, m.Reader(strings.NewReader(strings.Repeat("x", 60)))); err != nil {
+		t.Fatal(err)
+	}
+	m.AddMatched(2, 30)
+	m.AddLiteral(10)
+	m.Done()
+
+	if len(reports) == 0 {
+		t.Fatal("expected a report from Done")
+	}
+	p := reports[len(reports)-1]
+	expected := Progress{Op: "copy", Bytes: 60, Total: 100, MatchedBlocks: 2, MatchedBytes: 30, LiteralBytes: 10, Elapsed: p.Elapsed, Done: true}
+	if p != expected {
+		t.Errorf("expected %+v, got %+v", expected, p)
+	}
+}
+
+func TestMeterReportCallsMeter(t *testing.T) {
+	var m *Meter
+	var reports []Progress
+	m = NewMeter("copy", 0, func(p Progress) {
+		// reports are made outside of the lock of m
+		reports = append(reports, m.Progress())
+	})
+	m.last = time.Now().Add(-Interval)
+
+	done := make(chan struct{})
+	go func() {
+		m.Add(10)
+		m.Done()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("report calling the Meter deadlocked")
+	}
+	if len(reports) != 2 || reports[1].Bytes != 10 || !reports[1].Done {
+		t.Errorf("expected 2 reports, the last one done with 10 bytes, got %+v", reports)
+	}
+}
+
+func TestNilMeter(t *testing.T) {
+	m := NewMeter("copy", 100, nil)
+	if m != nil {
+		t.Fatal("expected a nil Meter without a Func")
+	}
+	m.Add(10)
+	m.AddMatched(1, 10)
+	m.AddLiteral(10)
+	m.Done()
+	if p := m.Progress(); p != (Progress{}) {
+		t.Errorf("expected no progress, got %+v", p)
+	}
+
+	r := strings.NewReader("data")
+	if m.Reader(r) != io.Reader(r) {
+		t.Error("expected the Reader of a nil Meter to be r")
+	}
+	if FromContext(context.Background()) != nil {
+		t.Error("expected no Meter in the background context")
+	}
+}
+
+func TestContext(t *testing.T) {
+	m := NewMeter("delta", 0, func(Progress) {})
+	if FromContext(NewContext(context.Background(), m)) != m {
+		t.Error("expected FromContext to return the Meter of NewContext")
+	}
+}
+
+func TestETA(t *testing.T) {
+	p := Progress{Bytes: 25, Total: 100, Elapsed: time.Minute}
+	if eta := p.ETA(); eta != 3*time.Minute {
+		t.Errorf("expected an ETA of 3m, got %v", eta)
+	}
+	p.Total = 0
+	if eta := p.ETA(); eta != -1 {
+		t.Errorf("expected an unknown ETA, got %v", eta)
+	}
+}
+
+func TestPrinters(t *testing.T) {
+	p := Progress{Op: "patch", Bytes: 512 * 1024, Total: 1024 * 1024, MatchedBlocks: 3, LiteralBytes: 100, Elapsed: time.Second, Done: true}
+
+	buf := new(bytes.Buffer)
+	NewBar(buf)(p)
+	if line := buf.String(); !strings.Contains(line, " 50% 512.0 KiB/1.0 MiB, 3 blocks matched, 100 B literal") || !strings.HasSuffix(line, "\n") {
+		t.Errorf("unexpected bar %q", line)
+	}
+
+	buf.Reset()
+	NewJSONLines(buf)(p)
+	var decoded jsonProgress
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bytes != p.Bytes || decoded.ETASeconds != 1 || !decoded.Done {
+		t.Errorf("unexpected JSON line %q", buf.String())
+	}
+
+	if _, err := NewPrinter("xml", buf); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,93 @@
+package rsync
+
+// buzhashPoly is the polynomial x^64 + x^4 + x^3 + x + 1, without its x^64 term. It is primitive, so the powers of x modulo it only repeat after 2^64-1 of them.
+const buzhashPoly = 0x1b
+
+// buzhashTable maps each byte to the pseudo-random value buzhash mixes in for it. Like gearTable, it is generated from a fixed seed with splitmix64, so it must never change.
+var buzhashTable = func() (table [256]uint64) {
+	seed := uint64(0x62757a68617368) // "buzhash"
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// buzhashMulX returns h times x, modulo buzhashPoly.
+func buzhashMulX(h uint64) uint64 {
+	return h<<1 ^ buzhashPoly&-(h>>63)
+}
+
+// buzhashMul returns a times b, modulo buzhashPoly.
+func buzhashMul(a uint64, b uint64) uint64 {
+	var product uint64
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			product ^= a
+		}
+		a = buzhashMulX(a)
+	}
+	return product
+}
+
+func newBuzhash(blockSize int) *buzhash {
+	d := &buzhash{window: window{data: make([]byte, blockSize)}}
+	// x^blockSize, by squaring
+	xn, power := uint64(1), uint64(2)
+	for n := blockSize; n > 0; n >>= 1 {
+		if n&1 != 0 {
+			xn = buzhashMul(xn, power)
+		}
+		power = buzhashMul(power, power)
+	}
+	for i := range d.outTable {
+		d.outTable[i] = buzhashMul(buzhashTable[i], xn)
+	}
+	d.Reset()
+	return d
+}
+
+// buzhash is a cyclic polynomial rolling hash: the checksum of a window is the XOR of the buzhashTable values of its bytes, each multiplied by x once for every byte after it in the window, and folded to 32 bits. Classic buzhash multiplies by x with a rotation, that is, modulo x^w+1 for a w-bit word, so equal bytes w bytes apart cancel each other, and windows of zeros or of a repeated byte whose length is a multiple of 2*w all hash to 0. Multiplying modulo the primitive buzhashPoly instead, they never cancel. It rolls over windows of len(data) bytes.
+type buzhash struct {
+	digest uint64
+	// outTable is buzhashTable times x^len(data): the value of a byte leaving the window once the others are multiplied by x.
+	outTable [256]uint64
+	window
+}
+
+func (d *buzhash) Reset() {
+	d.digest = 0
+	d.reset()
+}
+
+func (d *buzhash) Write(p []byte) (int, error) {
+	d.write(p, d.addData, d.Roll)
+	return len(p), nil
+}
+
+func (d *buzhash) Roll(out []byte, in []byte, sums []uint32) {
+	digest := d.digest
+	for i, x := range in {
+		digest = buzhashMulX(digest) ^ d.outTable[out[i]] ^ buzhashTable[x]
+		sums[i] = uint32(digest) ^ uint32(digest>>32)
+	}
+	d.digest = digest
+}
+
+func (d *buzhash) Sum32() uint32 { return uint32(d.digest) ^ uint32(d.digest>>32) }
+
+// getBuzhash returns the buzhash of data.
+func getBuzhash(data []byte) uint32 {
+	d := newBuzhash(0)
+	d.addData(data)
+	return d.Sum32()
+}
+
+func (d *buzhash) addData(p []byte) {
+	for _, x := range p {
+		d.digest = buzhashMulX(d.digest) ^ buzhashTable[x]
+	}
+}
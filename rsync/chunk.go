@@ -0,0 +1,336 @@
+package rsync
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/mateusbraga/saveit/progress"
+	"hash"
+	"io"
+)
+
+// Content-defined chunking.
+//
+// Instead of cutting the data at multiples of a block size, the data is cut into chunks where the gear hash of the last bytes matches a mask, as FastCDC does. An insertion only changes the chunks around it, so the chunks of the new data can be looked up in a ChunkSignature by their strong checksum alone, without the byte by byte search of Delta. The ops created are the same kind Delta creates, so Patch applies them.
+
+const (
+	// DefaultChunkSize is the average chunk size used when none is given.
+	DefaultChunkSize = 1024 * 16
+
+	// MinChunkSize is the smallest average chunk size accepted. Chunks can be at most MaxBlockSize long.
+	MinChunkSize = 64
+)
+
+// gearTable maps each byte to a pseudo-random value for the gear hash. It is generated from a fixed seed with splitmix64, so it must never change.
+var gearTable = func() (table [256]uint64) {
+	seed := uint64(0x73617665697420) // "saveit "
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// ChunkOptions configures how data is cut into chunks. The zero value uses chunks of DefaultChunkSize bytes on average and full length MD5 strong checksums.
+type ChunkOptions struct {
+	// AvgSize is the average chunk size. It must be a power of 2. If 0, DefaultChunkSize is used.
+	AvgSize int
+	// MinSize and MaxSize bound the chunk sizes. If 0, AvgSize / 4 and AvgSize * 8 are used.
+	MinSize int
+	MaxSize int
+	// StrongHash is the hash used for the strong checksum of each chunk.
+	StrongHash StrongHash
+	// StrongLen truncates the strong checksums to StrongLen bytes. If 0, the full hash is used.
+	StrongLen int
+}
+
+// withDefaults returns opts with the zero values replaced by the defaults, or an error if opts is invalid.
+func (opts ChunkOptions) withDefaults() (ChunkOptions, error) {
+	if opts.AvgSize == 0 {
+		opts.AvgSize = DefaultChunkSize
+	}
+	if opts.MinSize == 0 {
+		opts.MinSize = opts.AvgSize / 4
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = opts.AvgSize * 8
+	}
+	if opts.AvgSize < MinChunkSize || opts.AvgSize&(opts.AvgSize-1) != 0 {
+		return opts, fmt.Errorf("rsync: invalid average chunk size %v", opts.AvgSize)
+	}
+	if opts.MinSize <= 0 || opts.MinSize > opts.AvgSize || opts.MaxSize < opts.AvgSize || opts.MaxSize > MaxBlockSize {
+		return opts, fmt.Errorf("rsync: invalid chunk size bounds %v and %v for average %v", opts.MinSize, opts.MaxSize, opts.AvgSize)
+	}
+	strongHash, err := opts.StrongHash.New()
+	if err != nil {
+		return opts, err
+	}
+	if opts.StrongLen == 0 {
+		opts.StrongLen = strongHash.Size()
+	}
+	if opts.StrongLen < 0 || opts.StrongLen > strongHash.Size() {
+		return opts, fmt.Errorf("rsync: invalid strong checksum length %v for %v", opts.StrongLen, opts.StrongHash)
+	}
+	return opts, nil
+}
+
+// Chunk is a chunk of the old data.
+type Chunk struct {
+	Offset int64
+	Length int
+}
+
+// ChunkSignature contains the chunk checksums used to find differences between two files with ChunkDelta.
+type ChunkSignature struct {
+	// Options are the options the chunks were cut with, without zero values.
+	Options ChunkOptions
+	// Chunks maps the strong checksum of a chunk to the first chunk with that checksum.
+	Chunks map[string]Chunk
+}
+
+// NewChunkSignature creates the ChunkSignature of the data as configured by opts.
+func NewChunkSignature(data io.Reader, opts ChunkOptions) (ChunkSignature, error) {
+	chunker, err := NewChunker(data, opts)
+	if err != nil {
+		return ChunkSignature{}, err
+	}
+	opts = chunker.opts
+	strongHash, _ := opts.StrongHash.New()
+
+	sig := ChunkSignature{
+		Options: opts,
+		Chunks:  make(map[string]Chunk),
+	}
+	var offset int64
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return sig, nil
+		}
+		if err != nil {
+			return ChunkSignature{}, err
+		}
+
+		strongHash.Reset()
+		strongHash.Write(chunk)
+		strong := string(strongHash.Sum(nil)[:opts.StrongLen])
+		if _, ok := sig.Chunks[strong]; !ok {
+			sig.Chunks[strong] = Chunk{Offset: offset, Length: len(chunk)}
+		}
+		offset += int64(len(chunk))
+	}
+}
+
+// A Chunker cuts data into content-defined chunks.
+type Chunker struct {
+	r     io.Reader
+	opts  ChunkOptions
+	maskS uint64
+	maskL uint64
+
+	buf   []byte
+	start int
+	end   int
+	err   error
+}
+
+// NewChunker returns a Chunker that cuts r as configured by opts. Only the sizes of opts are used.
+func NewChunker(r io.Reader, opts ChunkOptions) (*Chunker, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	bits := uint(0)
+	for 1<<bits < opts.AvgSize {
+		bits++
+	}
+	// normalized chunking: harder to cut before AvgSize, easier after it
+	return &Chunker{
+		r:     r,
+		opts:  opts,
+		maskS: ^uint64(0) << (64 - (bits + 1)),
+		maskL: ^uint64(0) << (64 - (bits - 1)),
+		buf:   make([]byte, 2*opts.MaxSize),
+	}, nil
+}
+
+// Next returns the next chunk. It is only valid until the next call to Next. At the end of the data, it returns io.EOF.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.opts.MaxSize && c.err == nil {
+		c.fill()
+	}
+	if c.start == c.end {
+		if c.err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, c.err
+	}
+
+	n := c.cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill moves the buffered data to the start of buf and reads until buf is full or r returns an error.
+func (c *Chunker) fill() {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+}
+
+// cutPoint returns the length of the chunk at the start of data, that has all the data left or at least MaxSize bytes.
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.opts.MinSize {
+		return n
+	}
+	if n > c.opts.MaxSize {
+		n = c.opts.MaxSize
+	}
+	normal := c.opts.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var h uint64
+	i := c.opts.MinSize
+	for ; i < normal; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// ChunkDelta is like Delta, but finds the chunks of newData in the old data oldDataSignature was created from. Chunks that follow each other in both the old and the new data are sent as a single COPY op, the others as RAW_DATA ops. See ChunkDeltaReader.
+func ChunkDelta(oldDataSignature ChunkSignature, newData io.Reader) (<-chan Op, <-chan error) {
+	return ChunkDeltaContext(context.Background(), oldDataSignature, newData)
+}
+
+// ChunkDeltaContext is like ChunkDelta, but stops when ctx is done. See DeltaContext.
+func ChunkDeltaContext(ctx context.Context, oldDataSignature ChunkSignature, newData io.Reader) (<-chan Op, <-chan error) {
+	return sendOps(ctx, NewChunkDeltaReader(oldDataSignature, progress.FromContext(ctx).Reader(newData)).Next)
+}
+
+// ChunkDeltaReader creates the ops of ChunkDelta one at a time, like DeltaReader does for Delta.
+type ChunkDeltaReader struct {
+	oldDataSignature ChunkSignature
+	newData          io.Reader
+
+	chunker    *Chunker
+	strongHash hash.Hash
+	strongBuf  []byte
+	sha1Writer hash.Hash
+
+	// matched chunks not sent yet
+	copyOffset int64
+	copyLength int64
+
+	pending []Op
+	err     error
+}
+
+// NewChunkDeltaReader returns a ChunkDeltaReader of newData against the old data oldDataSignature was created from.
+func NewChunkDeltaReader(oldDataSignature ChunkSignature, newData io.Reader) *ChunkDeltaReader {
+	return &ChunkDeltaReader{
+		oldDataSignature: oldDataSignature,
+		newData:          newData,
+	}
+}
+
+// Next returns the next operation. After the EOF op, it returns io.EOF. If the newData Reader returns an error, or the signature is invalid, Next returns that error.
+func (d *ChunkDeltaReader) Next() (Op, error) {
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return Op{}, d.err
+		}
+		d.err = d.step()
+	}
+
+	op := d.pending[0]
+	d.pending[0] = Op{}
+	d.pending = d.pending[1:]
+	return op, nil
+}
+
+// step looks up the next chunk of newData, queueing the operations it creates on d.pending. It returns io.EOF after queueing the EOF op.
+func (d *ChunkDeltaReader) step() error {
+	if d.chunker == nil {
+		chunker, err := NewChunker(d.newData, d.oldDataSignature.Options)
+		if err != nil {
+			return err
+		}
+		if chunker.opts != d.oldDataSignature.Options {
+			return fmt.Errorf("rsync: invalid chunk signature options %+v", d.oldDataSignature.Options)
+		}
+		d.chunker = chunker
+		d.strongHash, _ = chunker.opts.StrongHash.New()
+		d.strongBuf = make([]byte, 0, d.strongHash.Size())
+		d.sha1Writer = sha1.New()
+	}
+
+	chunk, err := d.chunker.Next()
+	if err == io.EOF {
+		d.sendCopy()
+		d.pending = append(d.pending, Op{
+			OpCode: EOF,
+			Data:   d.sha1Writer.Sum(nil),
+		})
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	d.sha1Writer.Write(chunk)
+
+	d.strongHash.Reset()
+	d.strongHash.Write(chunk)
+	strong := d.strongHash.Sum(d.strongBuf[:0])[:d.chunker.opts.StrongLen]
+	match, found := d.oldDataSignature.Chunks[string(strong)]
+	if !found || match.Length != len(chunk) {
+		d.sendCopy()
+		dataToSend := make([]byte, len(chunk))
+		copy(dataToSend, chunk)
+		d.pending = append(d.pending, Op{
+			OpCode: RAW_DATA,
+			Data:   dataToSend,
+		})
+		return nil
+	}
+
+	if d.copyLength > 0 && d.copyOffset+d.copyLength == match.Offset {
+		d.copyLength += int64(match.Length)
+	} else {
+		d.sendCopy()
+		d.copyOffset, d.copyLength = match.Offset, int64(match.Length)
+	}
+	return nil
+}
+
+// sendCopy queues the range of matched chunks, if any.
+func (d *ChunkDeltaReader) sendCopy() {
+	if d.copyLength > 0 {
+		d.pending = append(d.pending, Op{
+			OpCode: COPY,
+			Offset: d.copyOffset,
+			Length: d.copyLength,
+		})
+		d.copyLength = 0
+	}
+}
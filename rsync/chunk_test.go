@@ -0,0 +1,132 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChunker(t *testing.T) {
+	data := createFakeData(1024*1024 + 100)
+	opts := ChunkOptions{AvgSize: 4096}
+
+	chunker, err := NewChunker(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+
+	var joined []byte
+	for i, chunk := range chunks {
+		if len(chunk) > 4096*8 || (len(chunk) < 1024 && i != len(chunks)-1) {
+			t.Errorf("chunk %v has %v bytes", i, len(chunk))
+		}
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Error("chunks do not make up the data")
+	}
+	// it is random data, so the average should be close
+	if avg := len(data) / len(chunks); avg < 2048 || avg > 8192 {
+		t.Errorf("expected an average chunk size close to 4096, got %v", avg)
+	}
+}
+
+func TestChunkDelta(t *testing.T) {
+	originalData := createFakeData(1024 * 1024)
+	inserted := createFakeData(1000)
+	modifiedData := append(append(append([]byte(nil), originalData[:300000]...), inserted...), originalData[300000:]...)
+	opts := ChunkOptions{AvgSize: 4096}
+
+	sig, err := NewChunkSignature(bytes.NewReader(originalData), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := chanToOps(ChunkDelta(sig, bytes.NewReader(modifiedData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawDataLength := 0
+	copies := 0
+	for _, op := range ops {
+		switch op.OpCode {
+		case RAW_DATA:
+			rawDataLength += len(op.Data)
+		case COPY:
+			copies++
+		}
+	}
+	// only the chunks around the insertion should differ
+	if rawDataLength > len(inserted)+2*8*4096 || copies != 2 {
+		t.Errorf("expected 2 COPY ops around the insertion, got %v and %v bytes of RAW_DATA", copies, rawDataLength)
+	}
+
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	err = Patch(bytes.NewReader(originalData), opsChan, cerr, patchedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), modifiedData) {
+		t.Error("patched data is not equal to the modified data")
+	}
+}
+
+func TestChunkDeltaFiles(t *testing.T) {
+	originalData, err := ioutil.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modifiedData, err := ioutil.ReadFile(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := NewChunkSignature(bytes.NewReader(originalData), ChunkOptions{StrongHash: BLAKE2b, StrongLen: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opsChan, cerr := ChunkDelta(sig, bytes.NewReader(modifiedData))
+	patchedData := new(bytes.Buffer)
+	err = Patch(bytes.NewReader(originalData), opsChan, cerr, patchedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), modifiedData) {
+		t.Error("patched data is not equal to the modified data")
+	}
+}
+
+func TestChunkOptions(t *testing.T) {
+	for _, opts := range []ChunkOptions{
+		{AvgSize: 1000},
+		{AvgSize: 32},
+		{AvgSize: 4096, MinSize: 8192},
+		{AvgSize: 4096, MaxSize: 2048},
+		{AvgSize: 4096, MaxSize: MaxBlockSize + 1},
+		{StrongLen: 17},
+	} {
+		if _, err := NewChunker(bytes.NewReader(nil), opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+
+	// a signature without options
+	_, err := chanToOps(ChunkDelta(ChunkSignature{}, bytes.NewReader([]byte("data"))))
+	if err == nil {
+		t.Error("expected an error for an invalid signature")
+	}
+}
@@ -0,0 +1,491 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Compact signature format.
+//
+// A compact signature starts with a header: CompactSignatureMagic (big-endian uint32), the format version (a byte, CompactSignatureVersion), the weak hash, the strong hash and the strong checksum length (a byte each), the block size (big-endian uint32), the number of blocks of the data and the number of entries (big-endian uint64 each), the fanout bits (a byte), the size of the bloom filter in bytes (big-endian uint32), and the length (big-endian uint64) and the SHA-1 digest of the data.
+//
+// The fanout table follows: for each value of the top fanout bits of the weak checksum, the number of entries whose weak checksum has those top bits or lower ones (big-endian uint64). Then the bloom filter of the weak checksums, and the entries: the weak checksum (big-endian uint32), the truncated strong checksum and the block index (big-endian uint64) of each distinct block, sorted by weak checksum, then strong checksum. Of equal blocks, only the first one has an entry, like in a Signature.
+//
+// The entries are fixed size and sorted, so they are looked up with a binary search, reading only the pages it needs. As the format is read through an io.ReaderAt, a memory-mapped file can be used through bytes.NewReader.
+//
+// Version 2 added the length and the digest of the data.
+const (
+	// CompactSignatureMagic starts compact signatures. It is "SVCS" in ASCII.
+	CompactSignatureMagic = 0x53564353
+	// CompactSignatureVersion is the version of the format written by WriteCompactSignature.
+	CompactSignatureVersion = 2
+
+	compactHeaderSize = 61
+	// compactHeaderSizeV1 is the size of the header of version 1, without the length and the digest.
+	compactHeaderSizeV1 = 33
+	// compactMaxFanoutBits bounds the fanout table to 8MiB.
+	compactMaxFanoutBits = 20
+	// compactMaxBloomSize bounds the bloom filter. Larger signatures get more false positives instead of more memory.
+	compactMaxBloomSize = 64 * 1024 * 1024
+	// compactBloomHashes is the number of bits set in the bloom filter for each weak checksum.
+	compactBloomHashes = 4
+	// compactPageSize is about how many bytes of entries are read at once.
+	compactPageSize = 64 * 1024
+	// compactCachePages is the number of pages of entries kept in memory.
+	compactCachePages = 64
+)
+
+// compactEntry is a block while a compact signature is written. Its strong checksum is in a separate slice, at index*StrongLen.
+type compactEntry struct {
+	weak  uint32
+	index uint64
+}
+
+// WriteCompactSignature writes the compact signature of data, as configured by opts, to w. It keeps 16+StrongLen bytes per block in memory, several times less than a Signature does, but it keeps them all, to sort them, so memory still grows with the size of data: about 512KiB per GiB of data with blocks of DefaultBlockSize and strong checksums of 16 bytes, but 128MiB per GiB with blocks of MinBlockSize. Use larger blocks for larger data. See OpenCompactSignature.
+func WriteCompactSignature(w io.Writer, data io.Reader, opts SignatureOptions) error {
+	// validates opts
+	sigWriter, err := NewSignatureWriterOptions(opts)
+	if err != nil {
+		return err
+	}
+	blockSize := sigWriter.sig.BlockSize
+	strongLen := sigWriter.sig.StrongLen
+
+	var entries []compactEntry
+	var strongs []byte
+	block := make([]byte, blockSize)
+	digest := sha1.New()
+	var length int64
+	for {
+		n, err := io.ReadFull(data, block)
+		if n > 0 {
+			digest.Write(block[:n])
+			length += int64(n)
+			opts.Progress.Add(int64(n))
+			sigWriter.multiwriter.Write(block[:n])
+			weak, strong := sigWriter.sum()
+			sigWriter.rollingWeakHash.Reset()
+			sigWriter.strongHash.Reset()
+			entries = append(entries, compactEntry{weak: weak, index: uint64(len(entries))})
+			strongs = append(strongs, strong...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	blockCount := uint64(len(entries))
+
+	strongOf := func(e compactEntry) []byte {
+		return strongs[e.index*uint64(strongLen) : (e.index+1)*uint64(strongLen)]
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].weak != entries[j].weak {
+			return entries[i].weak < entries[j].weak
+		}
+		if c := bytes.Compare(strongOf(entries[i]), strongOf(entries[j])); c != 0 {
+			return c < 0
+		}
+		return entries[i].index < entries[j].index
+	})
+	// keep the first of equal blocks
+	distinct := entries[:0]
+	for i, e := range entries {
+		if i > 0 && e.weak == entries[i-1].weak && bytes.Equal(strongOf(e), strongOf(entries[i-1])) {
+			continue
+		}
+		distinct = append(distinct, e)
+	}
+	entries = distinct
+
+	fanoutBits := compactFanoutBits(len(entries))
+	fanout := make([]uint64, 1<<fanoutBits)
+	bloom := make([]byte, compactBloomSize(len(entries)))
+	for _, e := range entries {
+		fanout[compactBucket(e.weak, fanoutBits)]++
+		bloomAdd(bloom, e.weak)
+	}
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, compactHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], CompactSignatureMagic)
+	header[4] = CompactSignatureVersion
+	header[5] = byte(sigWriter.sig.WeakHash)
+	header[6] = byte(sigWriter.sig.StrongHash)
+	header[7] = byte(strongLen)
+	binary.BigEndian.PutUint32(header[8:12], uint32(blockSize))
+	binary.BigEndian.PutUint64(header[12:20], blockCount)
+	binary.BigEndian.PutUint64(header[20:28], uint64(len(entries)))
+	header[28] = byte(fanoutBits)
+	binary.BigEndian.PutUint32(header[29:33], uint32(len(bloom)))
+	binary.BigEndian.PutUint64(header[33:41], uint64(length))
+	copy(header[41:61], digest.Sum(nil))
+	bw.Write(header)
+
+	var buf [8]byte
+	var total uint64
+	for _, n := range fanout {
+		total += n
+		binary.BigEndian.PutUint64(buf[:], total)
+		bw.Write(buf[:])
+	}
+	bw.Write(bloom)
+
+	for _, e := range entries {
+		binary.BigEndian.PutUint32(buf[:4], e.weak)
+		bw.Write(buf[:4])
+		bw.Write(strongOf(e))
+		binary.BigEndian.PutUint64(buf[:], e.index)
+		if _, err := bw.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// compactFanoutBits returns the fanout bits for a signature of n entries, so that there are about 16 entries for each value.
+func compactFanoutBits(n int) uint {
+	var bits uint
+	for bits < compactMaxFanoutBits && n>>(bits+4) > 0 {
+		bits++
+	}
+	return bits
+}
+
+// compactBucket returns the value of the top fanoutBits bits of weak.
+func compactBucket(weak uint32, fanoutBits uint) int {
+	if fanoutBits == 0 {
+		return 0
+	}
+	return int(weak >> (32 - fanoutBits))
+}
+
+// compactBloomSize returns the size of the bloom filter for a signature of n entries: a byte per entry, for about 2% of false positives.
+func compactBloomSize(n int) int {
+	if n < 8 {
+		return 8
+	}
+	if n > compactMaxBloomSize {
+		return compactMaxBloomSize
+	}
+	return n
+}
+
+// bloomBits returns the bits of the bloom filter of m bits set for weak.
+func bloomBits(weak uint32, m uint64) [compactBloomHashes]uint64 {
+	h := uint64(weak) * 0x9e3779b97f4a7c15
+	h1, h2 := h>>32, h&0xffffffff|1
+	var bits [compactBloomHashes]uint64
+	for i := range bits {
+		bits[i] = (h1 + uint64(i)*h2) % m
+	}
+	return bits
+}
+
+func bloomAdd(bloom []byte, weak uint32) {
+	for _, bit := range bloomBits(weak, uint64(len(bloom))*8) {
+		bloom[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func bloomHas(bloom []byte, weak uint32) bool {
+	for _, bit := range bloomBits(weak, uint64(len(bloom))*8) {
+		if bloom[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CompactSignature is a signature written by WriteCompactSignature, read as needed. Only its header, fanout table and bloom filter, at most about 72MiB, and a few pages of entries are kept in memory. It can be used by several goroutines at the same time.
+type CompactSignature struct {
+	r          io.ReaderAt
+	opts       SignatureOptions
+	blockCount int64
+	// length and digest are nil for version 1.
+	length     int64
+	digest     []byte
+	entries    int64
+	fanoutBits uint
+	fanout     []uint64
+	bloom      []byte
+	// entriesOffset is where the entries start in r.
+	entriesOffset int64
+	entrySize     int
+	pageEntries   int64
+
+	mu sync.Mutex
+	// pages caches pages of entries, by page number. pageOrder is the order they were read in, to evict the oldest one.
+	pages     map[int64][]byte
+	pageOrder []int64
+}
+
+// readSignatureError returns the error of reading part of a signature, what, that wraps ErrCorruptSignature if the signature ends before it.
+func readSignatureError(what string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w, truncated %v", ErrCorruptSignature, what)
+	}
+	return fmt.Errorf("rsync: could not read %v: %v", what, err)
+}
+
+// readFullAt reads len(p) bytes from r at off into p. Unlike a plain ReadAt, it accepts io.EOF with all the bytes read, which ReaderAts may return when p ends at the end of their data.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		return nil
+	}
+	return err
+}
+
+// OpenCompactSignature reads the header of the compact signature in r. The entries are read from r as Delta needs them, so r must be kept open while the CompactSignature is used. Errors of invalid or truncated signatures wrap ErrCorruptSignature.
+func OpenCompactSignature(r io.ReaderAt) (*CompactSignature, error) {
+	header := make([]byte, compactHeaderSize)
+	if err := readFullAt(r, header[:compactHeaderSizeV1], 0); err != nil {
+		return nil, readSignatureError("compact signature header", err)
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != CompactSignatureMagic {
+		return nil, fmt.Errorf("%w, not a compact signature", ErrCorruptSignature)
+	}
+	var headerSize int64
+	switch header[4] {
+	case 1:
+		headerSize = compactHeaderSizeV1
+	case CompactSignatureVersion:
+		headerSize = compactHeaderSize
+		if err := readFullAt(r, header[compactHeaderSizeV1:], compactHeaderSizeV1); err != nil {
+			return nil, readSignatureError("compact signature header", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w, unsupported compact signature version %v", ErrCorruptSignature, header[4])
+	}
+
+	s := &CompactSignature{
+		r: r,
+		opts: SignatureOptions{
+			WeakHash:   WeakHash(header[5]),
+			StrongHash: StrongHash(header[6]),
+			StrongLen:  int(header[7]),
+			BlockSize:  int(binary.BigEndian.Uint32(header[8:12])),
+		},
+		blockCount: int64(binary.BigEndian.Uint64(header[12:20])),
+		entries:    int64(binary.BigEndian.Uint64(header[20:28])),
+		fanoutBits: uint(header[28]),
+		pages:      make(map[int64][]byte),
+	}
+	if s.opts.BlockSize <= 0 || s.opts.BlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("%w, invalid block size %v", ErrCorruptSignature, s.opts.BlockSize)
+	}
+	strongHash, err := s.opts.StrongHash.New()
+	if err != nil {
+		return nil, fmt.Errorf("%w, %v", ErrCorruptSignature, err)
+	}
+	if s.opts.StrongLen <= 0 || s.opts.StrongLen > strongHash.Size() {
+		return nil, fmt.Errorf("%w, invalid strong checksum length %v", ErrCorruptSignature, s.opts.StrongLen)
+	}
+	if s.blockCount < 0 || s.entries < 0 || s.entries > s.blockCount {
+		return nil, fmt.Errorf("%w, invalid compact signature entry count %v of %v blocks", ErrCorruptSignature, s.entries, s.blockCount)
+	}
+	if headerSize == compactHeaderSize {
+		s.length = int64(binary.BigEndian.Uint64(header[33:41]))
+		s.digest = header[41:61]
+		if s.length < 0 || s.blockCount != (s.length+int64(s.opts.BlockSize)-1)/int64(s.opts.BlockSize) {
+			return nil, fmt.Errorf("%w, compact signature of %v bytes has %v blocks", ErrCorruptSignature, s.length, s.blockCount)
+		}
+	}
+	if s.fanoutBits > compactMaxFanoutBits {
+		return nil, fmt.Errorf("%w, invalid compact signature fanout bits %v", ErrCorruptSignature, s.fanoutBits)
+	}
+	bloomSize := binary.BigEndian.Uint32(header[29:33])
+	if bloomSize == 0 || bloomSize > compactMaxBloomSize {
+		return nil, fmt.Errorf("%w, invalid compact signature bloom filter size %v", ErrCorruptSignature, bloomSize)
+	}
+
+	fanoutBytes := make([]byte, 8<<s.fanoutBits)
+	if err := readFullAt(r, fanoutBytes, headerSize); err != nil {
+		return nil, readSignatureError("compact signature fanout table", err)
+	}
+	s.fanout = make([]uint64, 1<<s.fanoutBits)
+	var prev uint64
+	for i := range s.fanout {
+		s.fanout[i] = binary.BigEndian.Uint64(fanoutBytes[i*8:])
+		if s.fanout[i] < prev {
+			return nil, fmt.Errorf("%w, invalid compact signature fanout table", ErrCorruptSignature)
+		}
+		prev = s.fanout[i]
+	}
+	if prev != uint64(s.entries) {
+		return nil, fmt.Errorf("%w, compact signature fanout table has %v entries, header %v", ErrCorruptSignature, prev, s.entries)
+	}
+
+	s.bloom = make([]byte, bloomSize)
+	if err := readFullAt(r, s.bloom, headerSize+int64(len(fanoutBytes))); err != nil {
+		return nil, readSignatureError("compact signature bloom filter", err)
+	}
+
+	s.entriesOffset = headerSize + int64(len(fanoutBytes)) + int64(bloomSize)
+	s.entrySize = 4 + s.opts.StrongLen + 8
+	s.pageEntries = int64(compactPageSize / s.entrySize)
+	return s, nil
+}
+
+// Options returns the options the signature was created with.
+func (s *CompactSignature) Options() SignatureOptions {
+	return s.opts
+}
+
+// BlockCount returns the number of blocks of the data the signature was created from.
+func (s *CompactSignature) BlockCount() int64 {
+	return s.blockCount
+}
+
+// BasisDigest returns the length of the data the signature was created from, and its SHA-1 digest. The digest is nil for signatures of version 1, which do not record them.
+func (s *CompactSignature) BasisDigest() (int64, []byte) {
+	return s.length, s.digest
+}
+
+// Tail returns the index and the length of the last block, if it is shorter than BlockSize.
+func (s *CompactSignature) Tail() (int, int) {
+	tailLength := int(s.length % int64(s.opts.BlockSize))
+	if s.digest == nil || tailLength == 0 {
+		return 0, 0
+	}
+	return int(s.blockCount - 1), tailLength
+}
+
+// Candidates returns the blocks with the weak checksum weak, read with a binary search among the entries with the same top bits. The bloom filter saves reading the entries of most weak checksums no block has.
+func (s *CompactSignature) Candidates(weak uint32) ([]BlockRef, error) {
+	if !bloomHas(s.bloom, weak) {
+		return nil, nil
+	}
+	i, err := s.search(weak, nil)
+	if err != nil {
+		return nil, err
+	}
+	var refs []BlockRef
+	for ; i < s.entries; i++ {
+		entry, err := s.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(entry[0:4]) != weak {
+			break
+		}
+		refs = append(refs, BlockRef{Index: int(binary.BigEndian.Uint64(entry[4+s.opts.StrongLen:]))})
+	}
+	return refs, nil
+}
+
+// Verify returns whether the block ref has the given checksums.
+func (s *CompactSignature) Verify(weak uint32, strong []byte, ref BlockRef) (bool, error) {
+	if len(strong) != s.opts.StrongLen || ref.Basis != 0 {
+		return false, nil
+	}
+	i, err := s.search(weak, strong)
+	if err != nil || i == s.entries {
+		return false, err
+	}
+	entry, err := s.entry(i)
+	if err != nil {
+		return false, err
+	}
+	return compareEntry(entry, weak, strong) == 0 && binary.BigEndian.Uint64(entry[4+len(strong):]) == uint64(ref.Index), nil
+}
+
+// search returns the first entry with checksums greater than or equal to weak and strong, with a binary search among the entries with the top bits of weak.
+func (s *CompactSignature) search(weak uint32, strong []byte) (int64, error) {
+	bucket := compactBucket(weak, s.fanoutBits)
+	var lo int64
+	if bucket > 0 {
+		lo = int64(s.fanout[bucket-1])
+	}
+	hi := int64(s.fanout[bucket])
+
+	var err error
+	i := lo + int64(sort.Search(int(hi-lo), func(k int) bool {
+		if err != nil {
+			return true
+		}
+		var entry []byte
+		entry, err = s.entry(lo + int64(k))
+		if err != nil {
+			return true
+		}
+		return compareEntry(entry, weak, strong) >= 0
+	}))
+	return i, err
+}
+
+// compareEntry compares the checksums of entry to weak and strong. Only the first len(strong) bytes of its strong checksum are compared.
+func compareEntry(entry []byte, weak uint32, strong []byte) int {
+	entryWeak := binary.BigEndian.Uint32(entry[0:4])
+	switch {
+	case entryWeak < weak:
+		return -1
+	case entryWeak > weak:
+		return 1
+	}
+	return bytes.Compare(entry[4:4+len(strong)], strong)
+}
+
+// entry returns the entry i, reading its page if it is not cached.
+func (s *CompactSignature) entry(i int64) ([]byte, error) {
+	page := i / s.pageEntries
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.pages[page]
+	if !ok {
+		first := page * s.pageEntries
+		n := s.entries - first
+		if n > s.pageEntries {
+			n = s.pageEntries
+		}
+		data = make([]byte, n*int64(s.entrySize))
+		if err := readFullAt(s.r, data, s.entriesOffset+first*int64(s.entrySize)); err != nil {
+			return nil, readSignatureError("compact signature entries", err)
+		}
+
+		if len(s.pageOrder) == compactCachePages {
+			delete(s.pages, s.pageOrder[0])
+			s.pageOrder = s.pageOrder[1:]
+		}
+		s.pages[page] = data
+		s.pageOrder = append(s.pageOrder, page)
+	}
+	offset := (i - page*s.pageEntries) * int64(s.entrySize)
+	return data[offset : offset+int64(s.entrySize)], nil
+}
+
+// Signature reads all the entries into a Signature, for the functions that need one. It takes as much memory as the Signature the compact signature was created from would.
+func (s *CompactSignature) Signature() (Signature, error) {
+	sig := Signature{
+		BlockSize:  s.opts.BlockSize,
+		WeakHash:   s.opts.WeakHash,
+		StrongHash: s.opts.StrongHash,
+		StrongLen:  s.opts.StrongLen,
+		Blocks:     make(map[uint32]map[string]int),
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.r, s.entriesOffset, s.entries*int64(s.entrySize)))
+	entry := make([]byte, s.entrySize)
+	for i := int64(0); i < s.entries; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return Signature{}, readSignatureError("compact signature entries", err)
+		}
+		weak := binary.BigEndian.Uint32(entry[0:4])
+		strong := string(entry[4 : 4+s.opts.StrongLen])
+		sig.addBlock(weak, strong, int(binary.BigEndian.Uint64(entry[4+s.opts.StrongLen:])))
+	}
+	if s.digest != nil {
+		sig.setLength(s.length, append([]byte(nil), s.digest...))
+	}
+	return sig, nil
+}
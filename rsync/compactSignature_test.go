@@ -0,0 +1,203 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestCompactSignatureDelta(t *testing.T) {
+	oldData := createFakeData(300*1024 + 10)
+	// equal blocks, only the first one is kept
+	copy(oldData[64*1024:], oldData[:4*1024])
+	newData := modify(oldData, 0)
+	opts := SignatureOptions{BlockSize: 64, StrongHash: BLAKE2b, StrongLen: 16}
+
+	sig, err := NewSignatureOptions(bytes.NewReader(oldData), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactData := new(bytes.Buffer)
+	if err := WriteCompactSignature(compactData, bytes.NewReader(oldData), opts); err != nil {
+		t.Fatal(err)
+	}
+	compactSig, err := OpenCompactSignature(bytes.NewReader(compactData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compactSig.Options() != sig.Options() {
+		t.Errorf("expected options %+v, got %+v", sig.Options(), compactSig.Options())
+	}
+	if compactSig.BlockCount() != sig.BlockCount() {
+		t.Errorf("expected %v blocks, got %v", sig.BlockCount(), compactSig.BlockCount())
+	}
+	index, length := compactSig.Tail()
+	if expectedIndex, expectedLength := sig.Tail(); index != expectedIndex || length != expectedLength || length != 10 {
+		t.Errorf("expected tail %v of %v bytes, got %v of %v bytes", expectedIndex, expectedLength, index, length)
+	}
+	if length, digest := compactSig.BasisDigest(); length != sig.Length || !bytes.Equal(digest, sig.Digest) {
+		t.Errorf("expected length %v and digest %x, got %v and %x", sig.Length, sig.Digest, length, digest)
+	}
+
+	expected, err := chanToOps(Delta(sig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := chanToOps(Delta(compactSig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Error("delta against the compact signature differs from the delta against the signature")
+	}
+
+	loadedSig, err := compactSig.Signature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loadedSig, sig) {
+		t.Error("signature read from the compact signature differs from the signature")
+	}
+}
+
+func TestCompactSignatureCandidates(t *testing.T) {
+	oldData := createFakeData(100 * 1024)
+	opts := SignatureOptions{BlockSize: 128, StrongLen: 8}
+	sig, err := NewSignatureOptions(bytes.NewReader(oldData), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactData := new(bytes.Buffer)
+	if err := WriteCompactSignature(compactData, bytes.NewReader(oldData), opts); err != nil {
+		t.Fatal(err)
+	}
+	compactSig, err := OpenCompactSignature(bytes.NewReader(compactData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for weak, strongs := range sig.Blocks {
+		candidates, err := compactSig.Candidates(weak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(candidates) != len(strongs) {
+			t.Fatalf("expected %v candidates for weak checksum %v, got %v", len(strongs), weak, candidates)
+		}
+		for strong, index := range strongs {
+			ok, err := compactSig.Verify(weak, []byte(strong), BlockRef{Index: index})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("block %v not verified", index)
+			}
+			if ok, _ := compactSig.Verify(weak, []byte(strong), BlockRef{Index: index + 1}); ok {
+				t.Fatalf("block %v verified with the checksums of block %v", index+1, index)
+			}
+			other := []byte(strong)
+			other[0]++
+			if ok, _ := compactSig.Verify(weak, other, BlockRef{Index: index}); ok {
+				t.Fatalf("block %v verified with a different strong checksum", index)
+			}
+		}
+	}
+}
+
+func TestCompactSignatureEmpty(t *testing.T) {
+	compactData := new(bytes.Buffer)
+	if err := WriteCompactSignature(compactData, bytes.NewReader(nil), SignatureOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	compactSig, err := OpenCompactSignature(bytes.NewReader(compactData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newData := createFakeData(10 * 1024)
+	ops, err := chanToOps(Delta(compactSig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	if err := Patch(bytes.NewReader(nil), opsChan, cerr, patchedData); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), newData) {
+		t.Error("patched data is not equal to the new data")
+	}
+}
+
+func TestCompactSignatureErrors(t *testing.T) {
+	oldData := createFakeData(50 * 1024)
+	compactData := new(bytes.Buffer)
+	if err := WriteCompactSignature(compactData, bytes.NewReader(oldData), SignatureOptions{BlockSize: 256}); err != nil {
+		t.Fatal(err)
+	}
+	data := compactData.Bytes()
+
+	if _, err := OpenCompactSignature(bytes.NewReader(data[:10])); !errors.Is(err, ErrCorruptSignature) {
+		t.Errorf("expected an error wrapping ErrCorruptSignature for a truncated header, got %v", err)
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[0]++
+	if _, err := OpenCompactSignature(bytes.NewReader(corrupted)); !errors.Is(err, ErrCorruptSignature) {
+		t.Errorf("expected an error wrapping ErrCorruptSignature for a bad magic, got %v", err)
+	}
+
+	// entries are only read by Delta
+	compactSig, err := OpenCompactSignature(bytes.NewReader(data[:len(data)-100]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = chanToOps(Delta(compactSig, bytes.NewReader(oldData)))
+	if !errors.Is(err, ErrCorruptSignature) {
+		t.Errorf("expected an error wrapping ErrCorruptSignature for truncated entries, got %v", err)
+	}
+}
+
+// eofReaderAt is a ReaderAt that returns io.EOF with the reads that end at the end of its data, as io.ReaderAt allows.
+type eofReaderAt struct {
+	data []byte
+}
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := bytes.NewReader(r.data).ReadAt(p, off)
+	if err == nil && off+int64(n) == int64(len(r.data)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestCompactSignatureReadAtEOF(t *testing.T) {
+	oldData := createFakeData(50 * 1024)
+	compactData := new(bytes.Buffer)
+	if err := WriteCompactSignature(compactData, bytes.NewReader(oldData), SignatureOptions{BlockSize: 256}); err != nil {
+		t.Fatal(err)
+	}
+	compactSig, err := OpenCompactSignature(eofReaderAt{compactData.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last page of entries ends at the end of the signature
+	ops, err := chanToOps(Delta(compactSig, bytes.NewReader(oldData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if op.OpCode == RAW_DATA {
+			t.Fatalf("expected only blocks of the old data, got %v literal bytes", len(op.Data))
+		}
+	}
+
+	// and so does the bloom filter of a signature without entries
+	compactData.Reset()
+	if err := WriteCompactSignature(compactData, bytes.NewReader(nil), SignatureOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCompactSignature(eofReaderAt{compactData.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+}
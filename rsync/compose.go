@@ -0,0 +1,377 @@
+package rsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// extent is a range of the data a delta creates, either copied from the base data, literal or zeros.
+type extent struct {
+	// offset is the offset of the extent in the data the delta creates.
+	offset int64
+	length int64
+	kind   extentKind
+	// data is the data of literal extents, if it is kept in memory. Otherwise, the data of literal extents is in a spool, at baseOffset, or is not kept at all.
+	data []byte
+	// baseOffset is the offset in the base data of extents copied from it, and in the spool of literal extents whose data is spooled.
+	baseOffset int64
+}
+
+// extentKind tells where the data of an extent comes from.
+type extentKind int
+
+const (
+	baseExtent extentKind = iota
+	literalExtent
+	zeroExtent
+)
+
+// extentMap describes the data a delta creates as a list of extents, in order.
+type extentMap struct {
+	extents []extent
+	size    int64
+}
+
+// appendBase appends length bytes of the base data at baseOffset, merging them with the last extent if it ends where they start.
+func (m *extentMap) appendBase(baseOffset int64, length int64) {
+	m.appendExtent(extent{length: length, kind: baseExtent, baseOffset: baseOffset})
+}
+
+// appendLiteral appends data.
+func (m *extentMap) appendLiteral(data []byte) {
+	m.appendExtent(extent{length: int64(len(data)), kind: literalExtent, data: data})
+}
+
+// appendSpooled appends length literal bytes whose data is at spoolOffset in a spool, merging them with the last extent if it ends where they start. The offset does not matter if the data is not kept.
+func (m *extentMap) appendSpooled(spoolOffset int64, length int64) {
+	m.appendExtent(extent{length: length, kind: literalExtent, baseOffset: spoolOffset})
+}
+
+// appendZero appends length zeros, merging them with the last extent if it is zeros too.
+func (m *extentMap) appendZero(length int64) {
+	m.appendExtent(extent{length: length, kind: zeroExtent})
+}
+
+// appendExtent appends e at the end of the data, merging it with the last extent if it continues it. Literal extents with their data in memory are not merged, so that they keep sharing memory with the ops they come from.
+func (m *extentMap) appendExtent(e extent) {
+	if e.length <= 0 {
+		return
+	}
+	if n := len(m.extents); n > 0 {
+		last := &m.extents[n-1]
+		if last.kind == e.kind && last.data == nil && e.data == nil && (e.kind == zeroExtent || last.baseOffset+last.length == e.baseOffset) {
+			last.length += e.length
+			m.size += e.length
+			return
+		}
+	}
+	e.offset = m.size
+	m.extents = append(m.extents, e)
+	m.size += e.length
+}
+
+// appendRange appends length bytes of the data src describes, starting at offset. Like Patch, it stops at the end of that data.
+func (m *extentMap) appendRange(src *extentMap, offset int64, length int64) {
+	end := offset + length
+	if end > src.size {
+		end = src.size
+	}
+
+	// first extent that ends after offset
+	i := sort.Search(len(src.extents), func(i int) bool {
+		e := src.extents[i]
+		return e.offset+e.length > offset
+	})
+	for ; i < len(src.extents) && offset < end; i++ {
+		e := src.extents[i]
+		from := offset - e.offset
+		to := e.length
+		if e.offset+to > end {
+			to = end - e.offset
+		}
+		if e.data != nil {
+			m.appendLiteral(e.data[from:to])
+		} else {
+			m.appendExtent(extent{length: to - from, kind: e.kind, baseOffset: e.baseOffset + from})
+		}
+		offset = e.offset + to
+	}
+}
+
+// ops returns the ops that create the data m describes from the base data: COPY ops for the extents of the base data, RAW_DATA ops for the literal ones and ZERO ops for zeros. The data of literal extents must be in memory.
+func (m *extentMap) ops() []Op {
+	ops := make([]Op, 0, len(m.extents))
+	for _, e := range m.extents {
+		ops = append(ops, e.op())
+	}
+	return ops
+}
+
+// op returns the op that creates e. The data of literal extents must be in memory.
+func (e extent) op() Op {
+	switch e.kind {
+	case zeroExtent:
+		return Op{OpCode: ZERO, Length: e.length}
+	case literalExtent:
+		return Op{OpCode: RAW_DATA, Data: e.data}
+	default:
+		return Op{OpCode: COPY, Offset: e.baseOffset, Length: e.length}
+	}
+}
+
+// maxLiteralOp is the largest RAW_DATA op Composer and InvertDeltaContext send of the literal data they read, so that the ops buffered in their channels stay small.
+const maxLiteralOp = 16 * 1024
+
+// ComposeDeltas folds a chain of deltas into a single delta. Each delta must be against the data the previous one creates, and the first one against the base data. Patching the base data with the result creates the same data as patching it with each delta in turn. The result is made of COPY ops against the base data, RAW_DATA and ZERO ops, that may share memory with the ops of deltas, and ends with the EOF op of the last delta, if it has one. It starts with the BASIS_DIGEST op of the first delta, if it has one.
+func ComposeDeltas(deltas ...[]Op) ([]Op, error) {
+	if len(deltas) == 0 {
+		return nil, nil
+	}
+	c := NewComposer(nil)
+	for _, delta := range deltas {
+		if err := c.AddDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+
+	ops := c.basisDigest
+	ops = append(ops, c.prev.ops()...)
+	return append(ops, c.eof...), nil
+}
+
+// ComposeDeltasContext is like ComposeDeltas, but the last delta of the chain is read from opsChan and errc, as returned by DeltaContext, and the composed ops are sent through the returned channels as they are read, so that only the extents of deltas, not those of the last delta, are kept in memory. Matched ranges of the last delta that span several extents of deltas are sent as several ops. It stops when ctx is done, sending ctx.Err() through the error channel; cancel ctx to stop reading the ops before the rsync.Op channel is closed. See PatchContext and Composer.
+func ComposeDeltasContext(ctx context.Context, deltas [][]Op, opsChan <-chan Op, errc <-chan error) (<-chan Op, <-chan error) {
+	c := NewComposer(nil)
+	for _, delta := range deltas {
+		if err := c.AddDelta(delta); err != nil {
+			resultErrc := make(chan error, 1)
+			resultErrc <- err
+			resultChan := make(chan Op)
+			close(resultChan)
+			return resultChan, resultErrc
+		}
+	}
+	return c.ComposeContext(ctx, opsChan, errc)
+}
+
+// Spool keeps the literal data of the deltas a Composer folds: it is written in order, and read back at the offsets it was written at. A temporary *os.File is one.
+type Spool interface {
+	io.Writer
+	io.ReaderAt
+}
+
+// Composer folds a chain of deltas, added one op at a time, into a single delta against the base data of the first one, like ComposeDeltas. Only the extents of the data the deltas create are kept in memory: if spool is not nil, the literal data of the deltas is written to it, and read back as the composed ops are sent, so that memory use does not grow with the size of the deltas. Add the ops of each delta but the last with Add, ending each delta with EndDelta, and read the last one with ComposeContext.
+type Composer struct {
+	spool     Spool
+	spoolSize int64
+	// prev describes the data the deltas ended so far create, or is nil if no delta was ended.
+	prev *extentMap
+	// c composes the delta being added.
+	c *composer
+	// deltas is the number of deltas ended.
+	deltas int
+	// basisDigest are the BASIS_DIGEST ops of the first delta.
+	basisDigest []Op
+	// eof is the EOF op of the last delta ended, if it has one.
+	eof []Op
+}
+
+// NewComposer returns a new Composer that writes the literal data of deltas to spool, or keeps it in memory if spool is nil.
+func NewComposer(spool Spool) *Composer {
+	return &Composer{spool: spool, c: newComposer(nil)}
+}
+
+// Add adds op, the next op of the delta being added. Errors of invalid ops wrap ErrCorruptDelta.
+func (c *Composer) Add(op Op) error {
+	if c.deltas == 0 && op.OpCode == BASIS_DIGEST {
+		c.basisDigest = append(c.basisDigest, op)
+	}
+	if op.OpCode == RAW_DATA && c.spool != nil {
+		if _, err := c.spool.Write(op.Data); err != nil {
+			return err
+		}
+		c.c.m.appendSpooled(c.spoolSize, int64(len(op.Data)))
+		c.spoolSize += int64(len(op.Data))
+		return nil
+	}
+	if err := c.c.add(op); err != nil {
+		return fmt.Errorf("%w %v, %v", ErrCorruptDelta, c.deltas, err)
+	}
+	return nil
+}
+
+// EndDelta ends the delta being added: the ops added next are of a delta against the data it creates.
+func (c *Composer) EndDelta() {
+	c.prev, c.eof = c.c.m, c.c.eof
+	c.deltas++
+	c.c = newComposer(c.prev)
+}
+
+// AddDelta adds all the ops of delta and ends it.
+func (c *Composer) AddDelta(delta []Op) error {
+	for _, op := range delta {
+		if err := c.Add(op); err != nil {
+			return err
+		}
+	}
+	c.EndDelta()
+	return nil
+}
+
+// ComposeContext reads the last delta of the chain from opsChan and errc, as returned by DeltaContext, and sends the composed ops through the returned channels, as ComposeDeltasContext does. No ops must be added to c after it. Literal data read back from the spool is sent in RAW_DATA ops of at most maxLiteralOp bytes, and errors reading it are sent through the error channel.
+func (c *Composer) ComposeContext(ctx context.Context, opsChan <-chan Op, errc <-chan error) (<-chan Op, <-chan error) {
+	resultErrc := make(chan error, 1)
+	resultChan := make(chan Op, deltaFuncBuffer)
+
+	go func() {
+		defer close(resultChan)
+
+		send := func(op Op) bool {
+			select {
+			case resultChan <- op:
+				return true
+			case <-ctx.Done():
+				resultErrc <- ctx.Err()
+				return false
+			}
+		}
+		sendExtents := func(m *extentMap) bool {
+			for _, e := range m.extents {
+				if e.kind != literalExtent || e.data != nil {
+					if !send(e.op()) {
+						return false
+					}
+					continue
+				}
+				for pos := int64(0); pos < e.length; pos += maxLiteralOp {
+					n := e.length - pos
+					if n > maxLiteralOp {
+						n = maxLiteralOp
+					}
+					data := make([]byte, n)
+					// a ReaderAt may return io.EOF with all the data at the end of the spool
+					if read, err := c.spool.ReadAt(data, e.baseOffset+pos); read < len(data) {
+						resultErrc <- fmt.Errorf("rsync: could not read the spooled literal data: %v", err)
+						return false
+					}
+					if !send(Op{OpCode: RAW_DATA, Data: data}) {
+						return false
+					}
+				}
+			}
+			return true
+		}
+
+		for _, op := range c.basisDigest {
+			if !send(op) {
+				return
+			}
+		}
+
+		// the last delta is not spooled, its ops are sent as they are read
+		last := newComposer(c.prev)
+		for {
+			var op Op
+			var ok bool
+			select {
+			case op, ok = <-opsChan:
+			case <-ctx.Done():
+				resultErrc <- ctx.Err()
+				return
+			}
+			if !ok {
+				break
+			}
+
+			if op.OpCode == BASIS_DIGEST && c.deltas == 0 {
+				if !send(op) {
+					return
+				}
+				continue
+			}
+			last.m = new(extentMap)
+			if err := last.add(op); err != nil {
+				resultErrc <- fmt.Errorf("%w %v, %v", ErrCorruptDelta, c.deltas, err)
+				return
+			}
+			if !sendExtents(last.m) {
+				return
+			}
+			if op.OpCode == EOF && !send(op) {
+				return
+			}
+		}
+
+		select {
+		case err := <-errc:
+			resultErrc <- err
+		case <-ctx.Done():
+			resultErrc <- ctx.Err()
+		}
+	}()
+
+	return resultChan, resultErrc
+}
+
+// composer appends the extents of the data the ops of a delta create to m.
+type composer struct {
+	// prev describes the data the delta is against, or is nil if it is against the base data.
+	prev *extentMap
+	m    *extentMap
+	// eof is the EOF op of the delta, if there was one.
+	eof       []Op
+	blockSize int
+}
+
+func newComposer(prev *extentMap) *composer {
+	return &composer{prev: prev, m: new(extentMap), blockSize: DefaultBlockSize}
+}
+
+// appendCopy appends length bytes at offset of the data the delta is against.
+func (c *composer) appendCopy(offset int64, length int64) {
+	if c.prev == nil {
+		c.m.appendBase(offset, length)
+	} else {
+		c.m.appendRange(c.prev, offset, length)
+	}
+}
+
+// add appends the extents op creates. Its errors are wrapped in ErrCorruptDelta by the callers.
+func (c *composer) add(op Op) error {
+	if op.Basis != 0 && (op.OpCode == BLOCK || op.OpCode == COPY) {
+		return fmt.Errorf("cannot compose %v, deltas must have a single basis", op)
+	}
+	switch op.OpCode {
+	case BLOCK_SIZE:
+		if op.Index <= 0 || op.Index > MaxBlockSize {
+			return fmt.Errorf("invalid block size %v", op.Index)
+		}
+		c.blockSize = op.Index
+	case BLOCK:
+		if op.Index < 0 {
+			return fmt.Errorf("invalid BLOCK %v", op.Index)
+		}
+		c.appendCopy(int64(op.Index)*int64(c.blockSize), int64(c.blockSize))
+	case COPY:
+		if op.Offset < 0 || op.Length < 0 {
+			return fmt.Errorf("invalid COPY of %v bytes at %v", op.Length, op.Offset)
+		}
+		c.appendCopy(op.Offset, op.Length)
+	case RAW_DATA:
+		c.m.appendLiteral(op.Data)
+	case ZERO:
+		if op.Length < 0 {
+			return fmt.Errorf("invalid ZERO of %v bytes", op.Length)
+		}
+		c.m.appendZero(op.Length)
+	case EOF:
+		c.eof = []Op{op}
+	case BASIS_DIGEST:
+		// only the one of the first delta matters, see ComposeDeltas
+	default:
+		return fmt.Errorf("invalid OpCode %v", op.OpCode)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// modify returns a copy of data with some bytes changed, inserted and removed.
+func modify(data []byte, seed int) []byte {
+	result := append([]byte(nil), data[:len(data)/4]...)
+	result = append(result, createFakeData(1000+seed)...)
+	result = append(result, data[len(data)/4:len(data)/2]...)
+	result = append(result, data[len(data)/2+5000:]...)
+	copy(result[len(result)/3:], createFakeData(300))
+	return result
+}
+
+// createDelta returns the ops of the delta between oldData and newData, made by ChunkDelta or Delta.
+func createDelta(oldData []byte, newData []byte, chunks bool) ([]Op, error) {
+	if chunks {
+		sig, err := NewChunkSignature(bytes.NewReader(oldData), ChunkOptions{AvgSize: 1024})
+		if err != nil {
+			return nil, err
+		}
+		return chanToOps(ChunkDelta(sig, bytes.NewReader(newData)))
+	}
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 512)
+	if err != nil {
+		return nil, err
+	}
+	return chanToOps(Delta(sig, bytes.NewReader(newData)))
+}
+
+func TestComposeDeltas(t *testing.T) {
+	versions := [][]byte{createFakeData(200 * 1024)}
+	for i := 1; i < 5; i++ {
+		versions = append(versions, modify(versions[i-1], i))
+	}
+
+	var deltas [][]Op
+	for i := 1; i < len(versions); i++ {
+		ops, err := createDelta(versions[i-1], versions[i], i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, ops)
+	}
+
+	for n := 1; n <= len(deltas); n++ {
+		composed, err := ComposeDeltas(deltas[:n]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		patchedData := new(bytes.Buffer)
+		opsChan, cerr := opsToChan(composed)
+		err = Patch(bytes.NewReader(versions[0]), opsChan, cerr, patchedData)
+		if err != nil {
+			t.Fatalf("%v deltas: %v", n, err)
+		}
+		if !bytes.Equal(patchedData.Bytes(), versions[n]) {
+			t.Errorf("%v deltas: patched data is not equal to version %v", n, n)
+		}
+	}
+}
+
+func TestComposeDeltasContext(t *testing.T) {
+	versions := [][]byte{createFakeData(200 * 1024)}
+	for i := 1; i < 4; i++ {
+		versions = append(versions, modify(versions[i-1], i))
+	}
+
+	var deltas [][]Op
+	for i := 1; i < len(versions); i++ {
+		ops, err := createDelta(versions[i-1], versions[i], i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, ops)
+	}
+
+	for n := 1; n <= len(deltas); n++ {
+		opsChan, cerr := opsToChan(deltas[n-1])
+		opsChan, cerr = ComposeDeltasContext(context.Background(), deltas[:n-1], opsChan, cerr)
+
+		patchedData := new(bytes.Buffer)
+		err := Patch(bytes.NewReader(versions[0]), opsChan, cerr, patchedData)
+		if err != nil {
+			t.Fatalf("%v deltas: %v", n, err)
+		}
+		if !bytes.Equal(patchedData.Bytes(), versions[n]) {
+			t.Errorf("%v deltas: patched data is not equal to version %v", n, n)
+		}
+	}
+
+	// errors of the last delta are sent through the error channel
+	opsChan, _ := opsToChan(deltas[1])
+	cerr := make(chan error, 1)
+	cerr <- io.ErrUnexpectedEOF
+	opsChan, composedErr := ComposeDeltasContext(context.Background(), deltas[:1], opsChan, cerr)
+	err := Patch(bytes.NewReader(versions[0]), opsChan, composedErr, ioutil.Discard)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// an invalid op of the last delta
+	opsChan, cerr2 := opsToChan([]Op{{OpCode: COPY, Offset: -1, Length: 1}})
+	_, composedErr = ComposeDeltasContext(context.Background(), deltas[:1], opsChan, cerr2)
+	if err := <-composedErr; !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for an invalid COPY, got %v", err)
+	}
+}
+
+func TestComposerSpool(t *testing.T) {
+	versions := [][]byte{createFakeData(200 * 1024)}
+	for i := 1; i < 5; i++ {
+		versions = append(versions, modify(versions[i-1], i))
+	}
+
+	var deltas [][]Op
+	for i := 1; i < len(versions); i++ {
+		ops, err := createDelta(versions[i-1], versions[i], i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, ops)
+	}
+
+	spool, err := ioutil.TempFile("", "rsync-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	c := NewComposer(spool)
+	last := len(deltas) - 1
+	for _, delta := range deltas[:last] {
+		if err := c.AddDelta(delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the literal data is in the spool only
+	for _, e := range c.prev.extents {
+		if e.data != nil {
+			t.Fatalf("expected no literal data in memory, got %v bytes at %v", len(e.data), e.offset)
+		}
+	}
+
+	opsChan, cerr := opsToChan(deltas[last])
+	opsChan, cerr = c.ComposeContext(context.Background(), opsChan, cerr)
+	patchedData := new(bytes.Buffer)
+	if err := Patch(bytes.NewReader(versions[0]), opsChan, cerr, patchedData); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), versions[len(versions)-1]) {
+		t.Error("patched data is not equal to the last version")
+	}
+
+	// errors reading the spool are sent through the error channel
+	spool.Close()
+	opsChan, cerr = opsToChan(deltas[last])
+	opsChan, cerr = c.ComposeContext(context.Background(), opsChan, cerr)
+	if err := Patch(bytes.NewReader(versions[0]), opsChan, cerr, ioutil.Discard); err == nil {
+		t.Error("expected an error reading the closed spool")
+	}
+}
+
+func TestComposeDeltasRanges(t *testing.T) {
+	// base "0123456789"
+	d1 := []Op{
+		{OpCode: COPY, Offset: 5, Length: 5},
+		{OpCode: RAW_DATA, Data: []byte("ab")},
+		{OpCode: BLOCK_SIZE, Index: 2},
+		{OpCode: BLOCK, Index: 0},
+	}
+	// d1 creates "56789ab01"
+	d2 := []Op{
+		{OpCode: COPY, Offset: 3, Length: 5},
+		{OpCode: COPY, Offset: 0, Length: 2},
+		// reaches the end of the data of d1
+		{OpCode: COPY, Offset: 7, Length: 10},
+	}
+	// d2 creates "89ab056" + "01"
+
+	composed, err := ComposeDeltas(d1, d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Op{
+		{OpCode: COPY, Offset: 8, Length: 2},
+		{OpCode: RAW_DATA, Data: []byte("ab")},
+		{OpCode: COPY, Offset: 0, Length: 1},
+		{OpCode: COPY, Offset: 5, Length: 2},
+		{OpCode: COPY, Offset: 0, Length: 2},
+	}
+	if !reflect.DeepEqual(composed, expected) {
+		t.Errorf("expected %v, got %v", expected, composed)
+	}
+
+	// zeros are kept as zeros, merged when they follow each other
+	d3 := []Op{
+		{OpCode: ZERO, Length: 3},
+		{OpCode: COPY, Offset: 2, Length: 2},
+	}
+	// d3 creates 3 zeros + "23"
+	d4 := []Op{
+		{OpCode: COPY, Offset: 1, Length: 3},
+		{OpCode: ZERO, Length: 2},
+		{OpCode: COPY, Offset: 4, Length: 1},
+	}
+	// d4 creates 2 zeros + "2" + 2 zeros + "3"
+	composed, err = ComposeDeltas(d3, d4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Op{
+		{OpCode: ZERO, Length: 2},
+		{OpCode: COPY, Offset: 2, Length: 1},
+		{OpCode: ZERO, Length: 2},
+		{OpCode: COPY, Offset: 3, Length: 1},
+	}
+	if !reflect.DeepEqual(composed, expected) {
+		t.Errorf("expected %v, got %v", expected, composed)
+	}
+
+	if _, err := ComposeDeltas(d1, []Op{{OpCode: COPY, Offset: -1}}); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for an invalid COPY, got %v", err)
+	}
+	if _, err := ComposeDeltas(d1, []Op{{OpCode: 100}}); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for an invalid OpCode, got %v", err)
+	}
+}
@@ -0,0 +1,383 @@
+package rsync
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	// deltaReadAhead is how many bytes past the window DeltaReader reads at least, so that misses are searched in batches.
+	deltaReadAhead = 256 * 1024
+	// deltaRollBatch is the most bytes DeltaReader rolls the window over at once. After a match, the checksums of the rest are dropped.
+	deltaRollBatch = 4096
+)
+
+// DeltaReader creates the operations required to update the old data to be equal the new data, one at a time. It is the pull-style alternative to Delta, and creates the same operations. Blocks of zeros are sent as ZERO ops, whether the old data has them or not.
+type DeltaReader struct {
+	// InPlace makes the delta safe for PatchInPlace: blocks of the old data are only copied to where they are or before, so that no block is read after it has been overwritten. Blocks that do not satisfy it are sent as RAW_DATA, even when an equal block later in the old data would, as signatures only keep the first of equal blocks. Set it before the first call to Next.
+	InPlace bool
+
+	oldDataSignature SignatureIndex
+	newData          io.Reader
+
+	blockSize       int
+	rollingWeakHash RollingHash
+	strongHash      hash.Hash
+	strongLen       int
+	strongBuf       []byte
+	sha1Writer      hash.Hash
+
+	// buf holds the data read from newData: buf[lit:win] did not match and is not sent yet, buf[win:win+blockSize] is the window searched for and buf[win+blockSize:n] is read ahead. bufStart is the offset of buf[0] in the new data.
+	buf      []byte
+	lit      int
+	win      int
+	n        int
+	bufStart int64
+	// sums receives the weak checksums of the windows rolled over at once.
+	sums []uint32
+	// zeros is the number of zero bytes at the end of the window, up to blockSize.
+	zeros int
+
+	// started is set once the signature is checked and the BLOCK_SIZE op is created.
+	started bool
+	// rolling is set while searching for a match byte by byte, rollingWeakHash being the checksum of the window. Otherwise, the window starts after the last match.
+	rolling bool
+	// read is the number of bytes read from newData, eof is set once it returned io.EOF.
+	read int64
+	eof  bool
+	// tailIndex and tailLength are the last block of the old data, if it is shorter than blockSize, and tailWeakHash computes its weak checksum.
+	tailIndex    int
+	tailLength   int
+	tailWeakHash RollingHash
+	// matched blocks and blocks of zeros not sent yet, only one of copyLength and zeroLength is set
+	copyBasis  int
+	copyOffset int64
+	copyLength int64
+	zeroLength int64
+
+	pending []Op
+	err     error
+}
+
+// NewDeltaReader returns a DeltaReader of newData against the old data oldDataSignature was created from.
+func NewDeltaReader(oldDataSignature SignatureIndex, newData io.Reader) *DeltaReader {
+	return &DeltaReader{
+		oldDataSignature: oldDataSignature,
+		newData:          newData,
+	}
+}
+
+// Next returns the next operation. After the EOF op, it returns io.EOF. If the newData Reader returns an error, or the signature is invalid or cannot be read, Next returns that error.
+func (d *DeltaReader) Next() (Op, error) {
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return Op{}, d.err
+		}
+		d.err = d.step()
+	}
+
+	op := d.pending[0]
+	d.pending[0] = Op{}
+	d.pending = d.pending[1:]
+	return op, nil
+}
+
+// step advances the search for matches, queueing the operations it finds on d.pending. It returns io.EOF after queueing the EOF op.
+func (d *DeltaReader) step() error {
+	if !d.started {
+		return d.start()
+	}
+
+	if !d.rolling {
+		// try to find a block match after reading a block at once, instead of byte by byte, as later
+		if err := d.fill(d.blockSize); err != nil {
+			return d.finishOn(err)
+		}
+		window := d.buf[d.win : d.win+d.blockSize]
+		d.zeros = zeroSuffix(window)
+		if d.zeros == d.blockSize {
+			d.matchZero()
+			return nil
+		}
+		d.rollingWeakHash.Reset()
+		d.rollingWeakHash.Write(window)
+		d.rolling = true
+		return d.search(d.rollingWeakHash.Sum32())
+	}
+
+	// incremental search for match, rolling the window over the bytes read ahead
+	if err := d.fill(d.blockSize + 1); err != nil {
+		return d.finishOn(err)
+	}
+	count := d.n - d.win - d.blockSize
+	if count > deltaRollBatch {
+		count = deltaRollBatch
+	}
+	sums := d.sums[:count]
+	d.rollingWeakHash.Roll(d.buf[d.win:d.win+count], d.buf[d.win+d.blockSize:d.win+d.blockSize+count], sums)
+	for _, weak := range sums {
+		d.win++
+		if d.buf[d.win+d.blockSize-1] != 0 {
+			d.zeros = 0
+		} else if d.zeros++; d.zeros == d.blockSize {
+			d.matchZero()
+			return nil
+		}
+		if err := d.search(weak); err != nil {
+			return err
+		}
+		if !d.rolling {
+			return nil
+		}
+		// send partial data if a block of data did not match
+		if d.win-d.lit >= d.blockSize {
+			d.sendRawData(d.lit + d.blockSize)
+		}
+	}
+	return nil
+}
+
+// fill reads from newData until buf has need bytes from the window on, moving the data not sent yet to the start of buf first. It reads ahead as much as buf holds, so that SHA-1 is fed and misses are searched in bulk. It returns io.EOF if newData ends before.
+func (d *DeltaReader) fill(need int) error {
+	if d.n-d.win >= need {
+		return nil
+	}
+	if d.eof {
+		return io.EOF
+	}
+	if d.lit > 0 {
+		copy(d.buf, d.buf[d.lit:d.n])
+		d.win -= d.lit
+		d.n -= d.lit
+		d.bufStart += int64(d.lit)
+		d.lit = 0
+	}
+	n, err := io.ReadAtLeast(d.newData, d.buf[d.n:], d.win+need-d.n)
+	d.sha1Writer.Write(d.buf[d.n : d.n+n])
+	d.n += n
+	d.read += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.eof = true
+		return io.EOF
+	}
+	return err
+}
+
+// finishOn queues the last operations if err is io.EOF, and returns err.
+func (d *DeltaReader) finishOn(err error) error {
+	if err != io.EOF {
+		return err
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// sendRawData queues buf[lit:end] as a RAW_DATA op, after the matched blocks, and marks it as sent.
+func (d *DeltaReader) sendRawData(end int) {
+	d.sendCopy()
+	dataToSend := make([]byte, end-d.lit)
+	copy(dataToSend, d.buf[d.lit:end])
+	d.pending = append(d.pending, Op{
+		OpCode: RAW_DATA,
+		Data:   dataToSend,
+	})
+	d.lit = end
+}
+
+// start checks the signature, sets up the search and queues the BLOCK_SIZE op, and the BASIS_DIGEST op if the signature records the digest of the old data.
+func (d *DeltaReader) start() error {
+	d.started = true
+
+	header := d.oldDataSignature.Options()
+	d.blockSize = header.BlockSize
+	if d.blockSize <= 0 || d.blockSize > MaxBlockSize {
+		return fmt.Errorf("%w, invalid block size %v", ErrCorruptSignature, d.blockSize)
+	}
+	var err error
+	d.rollingWeakHash, err = header.WeakHash.New(d.blockSize)
+	if err != nil {
+		return err
+	}
+	d.tailIndex, d.tailLength = d.oldDataSignature.Tail()
+	if d.tailLength < 0 || d.tailLength >= d.blockSize {
+		return fmt.Errorf("%w, invalid tail length %v", ErrCorruptSignature, d.tailLength)
+	}
+	d.tailWeakHash, _ = header.WeakHash.New(d.blockSize)
+	d.strongHash, err = header.StrongHash.New()
+	if err != nil {
+		return err
+	}
+	d.strongLen = header.StrongLen
+	if d.strongLen <= 0 || d.strongLen > d.strongHash.Size() {
+		return fmt.Errorf("%w, invalid strong checksum length %v", ErrCorruptSignature, d.strongLen)
+	}
+	d.strongBuf = make([]byte, 0, d.strongHash.Size())
+
+	d.sha1Writer = sha1.New()
+	d.buf = make([]byte, 2*d.blockSize+deltaReadAhead)
+	d.sums = make([]uint32, deltaRollBatch)
+
+	d.pending = append(d.pending, Op{
+		OpCode: BLOCK_SIZE,
+		Index:  d.blockSize,
+	})
+	if length, digest := d.oldDataSignature.BasisDigest(); digest != nil {
+		d.pending = append(d.pending, Op{
+			OpCode: BASIS_DIGEST,
+			Length: length,
+			Data:   digest,
+		})
+	}
+	return nil
+}
+
+// search checks if the window, whose weak checksum is weak, matches a block of the old data. If it does, it queues the unmatched data before it, adds the block to the matched range and moves the window after it. It only fails if the signature cannot be read.
+func (d *DeltaReader) search(weak uint32) error {
+	candidates, err := d.oldDataSignature.Candidates(weak)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// found weakChecksum match, check strongChecksum
+	block := d.buf[d.win : d.win+d.blockSize]
+	d.strongHash.Reset()
+	d.strongHash.Write(block)
+	strong := d.strongHash.Sum(d.strongBuf[:0])[:d.strongLen]
+	var match BlockRef
+	found := false
+	for _, ref := range candidates {
+		if d.InPlace && ref.Basis == 0 && int64(ref.Index)*int64(d.blockSize) < d.bufStart+int64(d.win) {
+			// the block would be overwritten before it is copied
+			continue
+		}
+		found, err = d.oldDataSignature.Verify(weak, strong, ref)
+		if err != nil {
+			return err
+		}
+		if found {
+			match = ref
+			break
+		}
+	}
+	if !found {
+		// false positive of the weak checksum, continue trying to find a match byte by byte
+		return nil
+	}
+	basis, offset := match.Basis, int64(match.Index)*int64(d.blockSize)
+
+	// found strongChecksum match, send unmatched data then extend or start the range of matched blocks
+	if d.win > d.lit {
+		d.sendRawData(d.win)
+	}
+	if d.copyLength > 0 && d.copyBasis == basis && d.copyOffset+d.copyLength == offset {
+		d.copyLength += int64(d.blockSize)
+	} else {
+		d.sendCopy()
+		d.copyBasis, d.copyOffset, d.copyLength = basis, offset, int64(d.blockSize)
+	}
+
+	// continue trying to find matches for the following blocks
+	d.win += d.blockSize
+	d.lit = d.win
+	d.rolling = false
+	return nil
+}
+
+// matchZero queues the unmatched data before the window, that is all zeros, adds it to the zeros not sent yet and moves the window after it.
+func (d *DeltaReader) matchZero() {
+	if d.win > d.lit {
+		d.sendRawData(d.win)
+	}
+	if d.zeroLength > 0 {
+		d.zeroLength += int64(d.blockSize)
+	} else {
+		d.sendCopy()
+		d.zeroLength = int64(d.blockSize)
+	}
+	d.win += d.blockSize
+	d.lit = d.win
+	d.rolling = false
+}
+
+// sendCopy queues the range of matched blocks or the zeros, if any.
+func (d *DeltaReader) sendCopy() {
+	if d.copyLength > 0 {
+		d.pending = append(d.pending, Op{
+			OpCode: COPY,
+			Offset: d.copyOffset,
+			Length: d.copyLength,
+			Basis:  d.copyBasis,
+		})
+		d.copyLength = 0
+	}
+	if d.zeroLength > 0 {
+		d.pending = append(d.pending, Op{
+			OpCode: ZERO,
+			Length: d.zeroLength,
+		})
+		d.zeroLength = 0
+	}
+}
+
+// finish queues the matched blocks and the data not sent yet, and the EOF op. The data not sent yet may end with the last block of the old data, if it is shorter than a block.
+func (d *DeltaReader) finish() error {
+	buf := d.buf[d.lit:d.n]
+	tailMatched, err := d.matchTail(buf)
+	if err != nil {
+		return err
+	}
+	unmatched := buf
+	if tailMatched {
+		unmatched = buf[:len(buf)-d.tailLength]
+	}
+	if len(unmatched) > 0 {
+		d.sendCopy()
+		dataToSend := make([]byte, len(unmatched))
+		copy(dataToSend, unmatched)
+		d.pending = append(d.pending, Op{
+			OpCode: RAW_DATA,
+			Data:   dataToSend,
+		})
+	}
+	if tailMatched {
+		offset := int64(d.tailIndex) * int64(d.blockSize)
+		if d.copyLength > 0 && d.copyBasis == 0 && d.copyOffset+d.copyLength == offset {
+			d.copyLength += int64(d.tailLength)
+		} else {
+			d.sendCopy()
+			d.copyBasis, d.copyOffset, d.copyLength = 0, offset, int64(d.tailLength)
+		}
+	}
+	d.sendCopy()
+	d.pending = append(d.pending, Op{
+		OpCode: EOF,
+		Data:   d.sha1Writer.Sum(nil),
+	})
+	return nil
+}
+
+// matchTail returns whether buf ends with the last block of the old data, when it is shorter than a block. Its checksums are verified like the ones of full blocks, so the COPY of the tail has its exact length.
+func (d *DeltaReader) matchTail(buf []byte) (bool, error) {
+	if d.tailLength == 0 || len(buf) < d.tailLength {
+		return false, nil
+	}
+	offset := int64(d.tailIndex) * int64(d.blockSize)
+	if d.InPlace && offset < d.read-int64(d.tailLength) {
+		// the block would be overwritten before it is copied
+		return false, nil
+	}
+	tail := buf[len(buf)-d.tailLength:]
+	d.tailWeakHash.Reset()
+	d.tailWeakHash.Write(tail)
+	d.strongHash.Reset()
+	d.strongHash.Write(tail)
+	strong := d.strongHash.Sum(d.strongBuf[:0])[:d.strongLen]
+	return d.oldDataSignature.Verify(d.tailWeakHash.Sum32(), strong, BlockRef{Index: d.tailIndex})
+}
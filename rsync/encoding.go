@@ -0,0 +1,473 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Delta encoding.
+//
+// An encoded delta starts with a header: DeltaMagic (big-endian uint32), the format version (a byte: 4 for uncompressed streams, DeltaFormatVersion otherwise) and, from version 5, the Compression of the literal data (a byte). Each op follows as its opcode (uvarint) and its parameters:
+//
+//	BLOCK         uvarint index
+//	RAW_DATA      uvarint length, data
+//	EOF           uvarint length, sha1 hash
+//	BLOCK_SIZE    uvarint block size
+//	COPY          uvarint offset, uvarint length
+//	BASIS_DIGEST  uvarint length, uvarint digest length, digest
+//	ZERO          uvarint length
+//	BLOCK_RUN     uvarint first index, uvarint count
+//	BASIS         uvarint basis
+//	DEFLATED      uvarint length, uvarint compressed length, compressed data
+//
+// BLOCK_RUN, BASIS and DEFLATED only exist in the encoding: the Encoder writes consecutive BLOCK ops as one BLOCK_RUN, and the Decoder expands it back into BLOCK ops. BASIS sets the Basis of the BLOCK, COPY and BASIS_DIGEST ops that follow it, 0 until the first BASIS. In Deflate streams, RAW_DATA ops are written as DEFLATED, and the Decoder inflates them back into RAW_DATA ops. The delta ends with the underlying data.
+//
+// Version 2 added BASIS. Version 3 added BASIS_DIGEST. Version 4 added ZERO. Version 5 added the Compression and DEFLATED. Uncompressed streams are still written as version 4, so that older versions read them.
+const (
+	// DeltaMagic starts encoded deltas. It is "SVDL" in ASCII.
+	DeltaMagic = 0x5356444c
+	// DeltaFormatVersion is the highest version of the encoding, the one Encoder writes for compressed streams and the highest Decoder reads. Uncompressed streams are written as uncompressedFormatVersion, so that older Decoders still read them.
+	DeltaFormatVersion = 5
+	// uncompressedFormatVersion is the version of the encoding written by Encoder for uncompressed streams, which have no Compression byte.
+	uncompressedFormatVersion = 4
+
+	// opBlockRun is the opcode of BLOCK_RUN.
+	opBlockRun = 16
+	// opBasis is the opcode of BASIS.
+	opBasis = 17
+	// opDeflated is the opcode of DEFLATED.
+	opDeflated = 18
+
+	// deflateWindow is the size of the history DEFLATE compresses against.
+	deflateWindow = 32 * 1024
+
+	// maxEncodedDataLen bounds the length of the data of decoded ops, so that corrupted deltas do not cause huge allocations.
+	maxEncodedDataLen = 4 * MaxBlockSize
+)
+
+// Compression identifies how the literal data of an encoded delta is compressed.
+type Compression int
+
+// Compressions. NoCompression is the zero value, so streams that do not say otherwise use it.
+const (
+	NoCompression Compression = iota
+	// Deflate compresses the data of RAW_DATA ops as a single DEFLATE stream, flushed after each op, so that literals are compressed against the ones before them. Unlike rsync -z, which also feeds the data of matched blocks to the compressor, the dictionary is not primed from matched blocks, as the Encoder does not have their data, so literals that resemble them compress less.
+	Deflate
+)
+
+var compressionNames = map[Compression]string{
+	NoCompression: "none",
+	Deflate:       "deflate",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ParseCompression returns the Compression with the given name, as returned by Compression.String.
+func ParseCompression(name string) (Compression, error) {
+	for c, cName := range compressionNames {
+		if strings.EqualFold(name, cName) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("rsync: unknown compression %q", name)
+}
+
+// EncoderOptions configures how an Encoder writes a delta. The zero value writes literal data uncompressed.
+type EncoderOptions struct {
+	// Compression is how the data of RAW_DATA ops is compressed. The Decoder reads it from the header of the stream.
+	Compression Compression
+	// Level is the compression level, from flate.BestSpeed to flate.BestCompression. If 0, flate.DefaultCompression is used.
+	Level int
+}
+
+// An Encoder writes ops to a stream in the delta encoding. Consecutive BLOCK ops are held back to be written as a single run, so Flush must be called after the last op.
+type Encoder struct {
+	w           io.Writer
+	wroteHeader bool
+	basis       int
+	runStart    int
+	runCount    int
+	buf         []byte
+
+	compression Compression
+	// deflater compresses the data of RAW_DATA ops into compressed, in Deflate streams.
+	deflater   *flate.Writer
+	compressed bytes.Buffer
+}
+
+// NewEncoder returns a new Encoder that writes to w, without compression.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, buf: make([]byte, 0, 3*binary.MaxVarintLen64)}
+}
+
+// NewEncoderOptions returns a new Encoder that writes to w, as configured by opts. It returns an error if opts.Compression or opts.Level are invalid.
+func NewEncoderOptions(w io.Writer, opts EncoderOptions) (*Encoder, error) {
+	enc := NewEncoder(w)
+	enc.compression = opts.Compression
+	switch opts.Compression {
+	case NoCompression:
+	case Deflate:
+		level := opts.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		var err error
+		enc.deflater, err = flate.NewWriter(&enc.compressed, level)
+		if err != nil {
+			return nil, fmt.Errorf("rsync: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("rsync: unknown compression %v", opts.Compression)
+	}
+	return enc, nil
+}
+
+// Encode writes op to the stream, writing the header first if needed.
+func (enc *Encoder) Encode(op Op) error {
+	if op.OpCode == BLOCK && enc.runCount > 0 && enc.basis == op.Basis && enc.runStart+enc.runCount == op.Index {
+		enc.runCount++
+		return nil
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+
+	if (op.OpCode == BLOCK || op.OpCode == COPY || op.OpCode == BASIS_DIGEST) && op.Basis != enc.basis {
+		if op.Basis < 0 {
+			return fmt.Errorf("rsync: cannot encode op with invalid Basis %v", op.Basis)
+		}
+		buf := binary.AppendUvarint(enc.buf[:0], opBasis)
+		buf = binary.AppendUvarint(buf, uint64(op.Basis))
+		if _, err := enc.w.Write(buf); err != nil {
+			return err
+		}
+		enc.basis = op.Basis
+	}
+
+	buf := binary.AppendUvarint(enc.buf[:0], uint64(op.OpCode))
+	switch op.OpCode {
+	case BLOCK:
+		enc.runStart, enc.runCount = op.Index, 1
+		return nil
+	case RAW_DATA, EOF:
+		if op.OpCode == RAW_DATA && enc.deflater != nil && len(op.Data) > 0 {
+			return enc.encodeDeflated(op.Data)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(op.Data)))
+		if _, err := enc.w.Write(buf); err != nil {
+			return err
+		}
+		_, err := enc.w.Write(op.Data)
+		return err
+	case BLOCK_SIZE:
+		buf = binary.AppendUvarint(buf, uint64(op.Index))
+	case COPY:
+		if op.Offset < 0 || op.Length < 0 {
+			return fmt.Errorf("rsync: cannot encode COPY of %v bytes at %v", op.Length, op.Offset)
+		}
+		buf = binary.AppendUvarint(buf, uint64(op.Offset))
+		buf = binary.AppendUvarint(buf, uint64(op.Length))
+	case ZERO:
+		if op.Length < 0 {
+			return fmt.Errorf("rsync: cannot encode ZERO of %v bytes", op.Length)
+		}
+		buf = binary.AppendUvarint(buf, uint64(op.Length))
+	case BASIS_DIGEST:
+		if op.Length < 0 {
+			return fmt.Errorf("rsync: cannot encode BASIS_DIGEST of %v bytes", op.Length)
+		}
+		buf = binary.AppendUvarint(buf, uint64(op.Length))
+		buf = binary.AppendUvarint(buf, uint64(len(op.Data)))
+		if _, err := enc.w.Write(buf); err != nil {
+			return err
+		}
+		_, err := enc.w.Write(op.Data)
+		return err
+	default:
+		return fmt.Errorf("rsync: cannot encode op with invalid OpCode %v", op.OpCode)
+	}
+	_, err := enc.w.Write(buf)
+	return err
+}
+
+// encodeDeflated writes data as a DEFLATED op. The deflater is flushed, so that the Decoder inflates data without reading the next op, but keeps its history, so that the next literals are compressed against data.
+func (enc *Encoder) encodeDeflated(data []byte) error {
+	enc.compressed.Reset()
+	if _, err := enc.deflater.Write(data); err != nil {
+		return err
+	}
+	if err := enc.deflater.Flush(); err != nil {
+		return err
+	}
+
+	buf := binary.AppendUvarint(enc.buf[:0], opDeflated)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	buf = binary.AppendUvarint(buf, uint64(enc.compressed.Len()))
+	if _, err := enc.w.Write(buf); err != nil {
+		return err
+	}
+	_, err := enc.w.Write(enc.compressed.Bytes())
+	return err
+}
+
+// Flush writes the header and the BLOCK ops held back, if they were not written yet. It does not flush w.
+func (enc *Encoder) Flush() error {
+	if !enc.wroteHeader {
+		header := make([]byte, 5, 6)
+		binary.BigEndian.PutUint32(header[0:4], DeltaMagic)
+		header[4] = uncompressedFormatVersion
+		if enc.compression != NoCompression {
+			header[4] = DeltaFormatVersion
+			header = append(header, byte(enc.compression))
+		}
+		if _, err := enc.w.Write(header); err != nil {
+			return err
+		}
+		enc.wroteHeader = true
+	}
+	if enc.runCount == 0 {
+		return nil
+	}
+
+	var buf []byte
+	if enc.runCount == 1 {
+		buf = binary.AppendUvarint(enc.buf[:0], BLOCK)
+		buf = binary.AppendUvarint(buf, uint64(enc.runStart))
+	} else {
+		buf = binary.AppendUvarint(enc.buf[:0], opBlockRun)
+		buf = binary.AppendUvarint(buf, uint64(enc.runStart))
+		buf = binary.AppendUvarint(buf, uint64(enc.runCount))
+	}
+	enc.runCount = 0
+	_, err := enc.w.Write(buf)
+	return err
+}
+
+// A Decoder reads ops written by an Encoder, inflating compressed literal data. For compatibility, streams that do not start with DeltaMagic are read as a stream of gob encoded Op values, as older versions wrote them.
+type Decoder struct {
+	r          *bufio.Reader
+	readHeader bool
+	gobDec     *gob.Decoder
+	basis      int
+	runNext    int
+	runLeft    int
+
+	compression Compression
+	// inflater inflates the data of DEFLATED ops, with history, the end of the data of the ones before, as dictionary.
+	inflater io.ReadCloser
+	history  []byte
+}
+
+// NewDecoder returns a new Decoder that reads from r. It may read past the end of the delta.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next op of the stream into op. It returns io.EOF at the end of the stream.
+func (dec *Decoder) Decode(op *Op) error {
+	if !dec.readHeader {
+		if err := dec.decodeHeader(); err != nil {
+			return err
+		}
+	}
+	if dec.gobDec != nil {
+		*op = Op{}
+		err := dec.gobDec.Decode(op)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w, %v", ErrCorruptDelta, err)
+		}
+		return err
+	}
+
+	if dec.runLeft > 0 {
+		*op = Op{OpCode: BLOCK, Index: dec.runNext, Basis: dec.basis}
+		dec.runNext++
+		dec.runLeft--
+		return nil
+	}
+
+	opCode, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		// io.EOF here is the clean end of the stream.
+		return err
+	}
+
+	*op = Op{OpCode: int(opCode)}
+	switch opCode {
+	case BLOCK:
+		op.Index, err = dec.readInt()
+		op.Basis = dec.basis
+	case BLOCK_SIZE:
+		op.Index, err = dec.readInt()
+	case RAW_DATA, EOF:
+		var n int
+		n, err = dec.readInt()
+		if err == nil && n > maxEncodedDataLen {
+			err = fmt.Errorf("%w, op data of %v bytes", ErrCorruptDelta, n)
+		}
+		if err == nil {
+			op.Data = make([]byte, n)
+			_, err = io.ReadFull(dec.r, op.Data)
+		}
+	case COPY:
+		op.Offset, err = dec.readInt64()
+		if err == nil {
+			op.Length, err = dec.readInt64()
+		}
+		op.Basis = dec.basis
+	case BASIS_DIGEST:
+		op.Length, err = dec.readInt64()
+		var n int
+		if err == nil {
+			n, err = dec.readInt()
+		}
+		if err == nil && n > sha1.Size {
+			err = fmt.Errorf("%w, BASIS_DIGEST of %v bytes", ErrCorruptDelta, n)
+		}
+		if err == nil {
+			op.Data = make([]byte, n)
+			_, err = io.ReadFull(dec.r, op.Data)
+		}
+		op.Basis = dec.basis
+	case ZERO:
+		op.Length, err = dec.readInt64()
+	case opBasis:
+		dec.basis, err = dec.readInt()
+		if err == nil {
+			return dec.Decode(op)
+		}
+	case opDeflated:
+		if dec.compression != Deflate {
+			err = fmt.Errorf("%w, DEFLATED op in a %v stream", ErrCorruptDelta, dec.compression)
+			break
+		}
+		op.OpCode = RAW_DATA
+		op.Data, err = dec.readDeflated()
+	case opBlockRun:
+		dec.runNext, err = dec.readInt()
+		if err == nil {
+			dec.runLeft, err = dec.readInt()
+		}
+		if err == nil && dec.runLeft == 0 {
+			err = fmt.Errorf("%w, empty BLOCK_RUN", ErrCorruptDelta)
+		}
+		if err == nil {
+			return dec.Decode(op)
+		}
+	default:
+		err = fmt.Errorf("%w, invalid OpCode %v", ErrCorruptDelta, opCode)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (dec *Decoder) decodeHeader() error {
+	dec.readHeader = true
+
+	header, err := dec.r.Peek(5)
+	if err == io.EOF && len(header) == 0 {
+		return io.EOF
+	}
+	if len(header) < 4 || binary.BigEndian.Uint32(header[0:4]) != DeltaMagic {
+		dec.gobDec = gob.NewDecoder(dec.r)
+		return nil
+	}
+	if len(header) < 5 {
+		return io.ErrUnexpectedEOF
+	}
+	version := header[4]
+	if version > DeltaFormatVersion {
+		return fmt.Errorf("%w, unsupported delta format version %v", ErrCorruptDelta, version)
+	}
+	if version < 5 {
+		_, err = dec.r.Discard(5)
+		return err
+	}
+
+	header, _ = dec.r.Peek(6)
+	if len(header) < 6 {
+		return io.ErrUnexpectedEOF
+	}
+	dec.compression = Compression(header[5])
+	if _, ok := compressionNames[dec.compression]; !ok {
+		return fmt.Errorf("%w, unsupported delta compression %v", ErrCorruptDelta, dec.compression)
+	}
+	_, err = dec.r.Discard(6)
+	return err
+}
+
+// readDeflated reads the parameters of a DEFLATED op and returns its data, inflated with the history of the ones before it.
+func (dec *Decoder) readDeflated() ([]byte, error) {
+	n, err := dec.readInt()
+	if err != nil {
+		return nil, err
+	}
+	compressedLen, err := dec.readInt()
+	if err != nil {
+		return nil, err
+	}
+	// incompressible data grows by a few bytes per 64KiB
+	if n > maxEncodedDataLen || compressedLen > maxEncodedDataLen+maxEncodedDataLen/1024 {
+		return nil, fmt.Errorf("%w, DEFLATED op of %v bytes, %v compressed", ErrCorruptDelta, n, compressedLen)
+	}
+	compressed := make([]byte, compressedLen)
+	if _, err := io.ReadFull(dec.r, compressed); err != nil {
+		return nil, err
+	}
+
+	// each op starts a new block, so it is inflated on its own, with the history the Encoder compressed it against
+	if dec.inflater == nil {
+		dec.inflater = flate.NewReaderDict(bytes.NewReader(compressed), dec.history)
+	} else if err := dec.inflater.(flate.Resetter).Reset(bytes.NewReader(compressed), dec.history); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(dec.inflater, data); err != nil {
+		return nil, fmt.Errorf("%w, cannot inflate DEFLATED op: %v", ErrCorruptDelta, err)
+	}
+
+	dec.history = append(dec.history, data...)
+	if len(dec.history) > deflateWindow {
+		dec.history = append(dec.history[:0], dec.history[len(dec.history)-deflateWindow:]...)
+	}
+	return data, nil
+}
+
+// readInt reads an uvarint that must fit in an int.
+func (dec *Decoder) readInt() (int, error) {
+	v, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("%w, integer %v overflows int", ErrCorruptDelta, v)
+	}
+	return int(v), nil
+}
+
+// readInt64 reads an uvarint that must fit in an int64.
+func (dec *Decoder) readInt64() (int64, error) {
+	v, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxInt64 {
+		return 0, fmt.Errorf("%w, integer %v overflows int64", ErrCorruptDelta, v)
+	}
+	return int64(v), nil
+}
@@ -0,0 +1,229 @@
+package rsync
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+var encodingTestOps = []Op{
+	{OpCode: BLOCK_SIZE, Index: 1024},
+	{OpCode: BASIS_DIGEST, Length: 10240, Data: []byte("0123456789abcdefghij")},
+	{OpCode: BLOCK, Index: 3},
+	{OpCode: BLOCK, Index: 4},
+	{OpCode: BLOCK, Index: 5},
+	{OpCode: RAW_DATA, Data: []byte("some new data")},
+	{OpCode: BLOCK, Index: 9},
+	{OpCode: BLOCK, Index: 0},
+	{OpCode: BLOCK, Index: 1},
+	{OpCode: COPY, Offset: 4096, Length: 3 << 32},
+	{OpCode: ZERO, Length: 1 << 40},
+	{OpCode: EOF, Data: []byte("0123456789abcdefghij")},
+}
+
+func decodeAll(t *testing.T, r io.Reader) []Op {
+	var ops []Op
+	dec := NewDecoder(r)
+	for {
+		var op Op
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			return ops
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	for _, op := range encodingTestOps {
+		if err := enc.Encode(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := decodeAll(t, buf)
+	if !reflect.DeepEqual(ops, encodingTestOps) {
+		t.Errorf("expected %v, got %v", encodingTestOps, ops)
+	}
+}
+
+func TestEncodingDelta(t *testing.T) {
+	originalData, err := ioutil.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modifiedData, err := ioutil.ReadFile(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := NewSignatureSize(bytes.NewReader(originalData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []Op
+	encoded := new(bytes.Buffer)
+	enc := NewEncoder(encoded)
+	gobEncoded := new(bytes.Buffer)
+	gobEnc := gob.NewEncoder(gobEncoded)
+	opsChan, cerr := Delta(sig, bytes.NewReader(modifiedData))
+	for op := range opsChan {
+		ops = append(ops, op)
+		if err := enc.Encode(op); err != nil {
+			t.Fatal(err)
+		}
+		if err := gobEnc.Encode(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-cerr; err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if encoded.Len() >= gobEncoded.Len() {
+		t.Errorf("expected encoding to be smaller than gob, got %v bytes and gob %v bytes", encoded.Len(), gobEncoded.Len())
+	}
+
+	for _, r := range []io.Reader{encoded, gobEncoded} {
+		decoded := decodeAll(t, r)
+		if !reflect.DeepEqual(decoded, ops) {
+			t.Fatalf("decoded ops do not match encoded ops")
+		}
+	}
+}
+
+func TestEncodingCompressed(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog, "), 4000)
+	ops := []Op{
+		{OpCode: BLOCK_SIZE, Index: 1024},
+		{OpCode: RAW_DATA, Data: text[:100]},
+		{OpCode: COPY, Offset: 0, Length: 4096},
+		// longer than the DEFLATE window
+		{OpCode: RAW_DATA, Data: text},
+		{OpCode: RAW_DATA, Data: []byte{}},
+		{OpCode: RAW_DATA, Data: createFakeData(70 * 1024)},
+		{OpCode: RAW_DATA, Data: text[7:5000]},
+		{OpCode: EOF, Data: []byte("0123456789abcdefghij")},
+	}
+	// many literals, compressed against the ones before them
+	for i := 0; i < 200; i++ {
+		ops = append(ops[:len(ops)-1], Op{OpCode: RAW_DATA, Data: text[i : i+300]}, ops[len(ops)-1])
+	}
+
+	for _, level := range []int{0, flate.BestSpeed, flate.BestCompression} {
+		uncompressed := new(bytes.Buffer)
+		compressed := new(bytes.Buffer)
+		plainEnc := NewEncoder(uncompressed)
+		enc, err := NewEncoderOptions(compressed, EncoderOptions{Compression: Deflate, Level: level})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			if err := enc.Encode(op); err != nil {
+				t.Fatal(err)
+			}
+			plainEnc.Encode(op)
+		}
+		if err := enc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		plainEnc.Flush()
+
+		if compressed.Len()*4 > uncompressed.Len() {
+			t.Errorf("level %v: expected the compressed delta to be at least 4 times smaller, got %v bytes and %v uncompressed", level, compressed.Len(), uncompressed.Len())
+		}
+		if decoded := decodeAll(t, compressed); !reflect.DeepEqual(decoded, ops) {
+			t.Errorf("level %v: decoded ops do not match encoded ops", level)
+		}
+	}
+
+	if _, err := NewEncoderOptions(new(bytes.Buffer), EncoderOptions{Compression: 100}); err == nil {
+		t.Error("expected an error for an unknown compression")
+	}
+	if _, err := NewEncoderOptions(new(bytes.Buffer), EncoderOptions{Compression: Deflate, Level: 100}); err == nil {
+		t.Error("expected an error for an invalid compression level")
+	}
+	if c, err := ParseCompression("Deflate"); err != nil || c != Deflate {
+		t.Errorf("expected ParseCompression to return Deflate, got %v, %v", c, err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	for _, op := range encodingTestOps {
+		enc.Encode(op)
+	}
+	enc.Flush()
+	encoded := buf.Bytes()
+
+	truncated := encoded[:len(encoded)-3]
+	dec := NewDecoder(bytes.NewReader(truncated))
+	var err error
+	for err == nil {
+		var op Op
+		err = dec.Decode(&op)
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated delta, got %v", err)
+	}
+
+	newerVersion := append([]byte(nil), encoded...)
+	newerVersion[4] = DeltaFormatVersion + 1
+	var op Op
+	if err := NewDecoder(bytes.NewReader(newerVersion)).Decode(&op); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for a newer format version, got %v", err)
+	}
+
+	invalidOpCode := append(append([]byte(nil), encoded[:5]...), 0x7f)
+	if err := NewDecoder(bytes.NewReader(invalidOpCode)).Decode(&op); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for an invalid OpCode, got %v", err)
+	}
+
+	deflatedOp := append(append([]byte(nil), encoded[:5]...), opDeflated, 1, 1, 0)
+	if err := NewDecoder(bytes.NewReader(deflatedOp)).Decode(&op); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for a DEFLATED op in an uncompressed delta, got %v", err)
+	}
+
+	compressed := new(bytes.Buffer)
+	compressedEnc, _ := NewEncoderOptions(compressed, EncoderOptions{Compression: Deflate})
+	compressedEnc.Encode(Op{OpCode: RAW_DATA, Data: []byte("some new data")})
+	compressedEnc.Flush()
+	unknownCompression := append([]byte(nil), compressed.Bytes()...)
+	unknownCompression[5] = 100
+	if err := NewDecoder(bytes.NewReader(unknownCompression)).Decode(&op); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for an unknown compression, got %v", err)
+	}
+	// an empty stored block instead of 100 bytes
+	corruptDeflated := append(append([]byte(nil), compressed.Bytes()[:6]...), opDeflated, 100, 5, 0, 0, 0, 0xff, 0xff)
+	if err := NewDecoder(bytes.NewReader(corruptDeflated)).Decode(&op); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for corrupt compressed data, got %v", err)
+	}
+
+	// gob, but not of ops
+	notOps := new(bytes.Buffer)
+	gob.NewEncoder(notOps).Encode("not an op")
+	if err := NewDecoder(notOps).Decode(&op); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for gob data that is not ops, got %v", err)
+	}
+
+	if err := NewDecoder(new(bytes.Buffer)).Decode(&op); err != io.EOF {
+		t.Errorf("expected io.EOF for an empty delta, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package rsync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// legacySignature is the gob form of the signatures of older versions, before Signature recorded how it was created: the weak checksum of each block mapped to its MD5 checksum, mapped to the block index. Their blocks are DefaultBlockSize bytes long and their weak checksums Adler32.
+type legacySignature map[uint32]map[[md5.Size]byte]int
+
+// ReadGobSignature reads a gob encoded Signature from r, as written by gob.Encoder. Signatures written by older versions, before Signature was a struct, are read too, as signatures of blocks of DefaultBlockSize bytes with Adler32 weak checksums and MD5 strong checksums. Errors of corrupt signatures wrap ErrCorruptSignature.
+func ReadGobSignature(r io.Reader) (Signature, error) {
+	// the bytes read are kept to decode them again as a legacySignature, as gob only tells the type of the value once it decodes it
+	read := new(bytes.Buffer)
+	var sig Signature
+	err := gob.NewDecoder(io.TeeReader(r, read)).Decode(&sig)
+	if err == nil {
+		return sig, nil
+	}
+
+	var legacy legacySignature
+	if gob.NewDecoder(io.MultiReader(read, r)).Decode(&legacy) != nil {
+		return Signature{}, fmt.Errorf("%w, %v", ErrCorruptSignature, err)
+	}
+	sig = Signature{
+		BlockSize:  DefaultBlockSize,
+		WeakHash:   Adler32,
+		StrongHash: MD5,
+		StrongLen:  md5.Size,
+		Blocks:     make(map[uint32]map[string]int),
+	}
+	for weak, strongs := range legacy {
+		for strong, index := range strongs {
+			sig.addBlock(weak, string(strong[:]), index)
+		}
+	}
+	return sig, nil
+}
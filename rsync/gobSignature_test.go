@@ -0,0 +1,84 @@
+package rsync
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// legacyGobSignature is the signature of original, gob encoded by the first version of this package, when Signature was a map.
+const legacyGobSignature = "test-data/a.gob.sig"
+
+func TestReadGobSignatureLegacy(t *testing.T) {
+	originalData, err := ioutil.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modifiedData, err := ioutil.ReadFile(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(legacyGobSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sig, err := ReadGobSignature(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := NewSignature(bytes.NewReader(originalData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.BlockSize != expected.BlockSize || sig.WeakHash != expected.WeakHash || sig.StrongHash != expected.StrongHash || sig.StrongLen != expected.StrongLen {
+		t.Errorf("expected the options of %v, got %v", expected, sig)
+	}
+	if !reflect.DeepEqual(sig.Blocks, expected.Blocks) {
+		t.Error("expected the blocks of the signature created now")
+	}
+
+	ops, err := chanToOps(Delta(sig, bytes.NewReader(modifiedData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	if err := Patch(bytes.NewReader(originalData), opsChan, cerr, patchedData); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), modifiedData) {
+		t.Error("patched data is not equal to the modified data")
+	}
+}
+
+func TestReadGobSignature(t *testing.T) {
+	sig, err := NewSignatureSize(bytes.NewReader(createFakeData(10*1024+1)), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(sig); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	decoded, err := ReadGobSignature(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Blocks, sig.Blocks) || decoded.BlockSize != sig.BlockSize || decoded.Length != sig.Length || !bytes.Equal(decoded.Digest, sig.Digest) {
+		t.Error("expected the signature that was encoded")
+	}
+
+	for _, data := range [][]byte{nil, encoded[:len(encoded)/2], []byte("not a signature")} {
+		if _, err := ReadGobSignature(bytes.NewReader(data)); !errors.Is(err, ErrCorruptSignature) {
+			t.Errorf("expected an error wrapping ErrCorruptSignature for %v bytes, got %v", len(data), err)
+		}
+	}
+}
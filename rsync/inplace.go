@@ -0,0 +1,156 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/mateusbraga/saveit/progress"
+	"hash"
+	"io"
+	"os"
+)
+
+// DeltaInPlace is like Delta, but the delta can be applied with PatchInPlace. See DeltaReader.InPlace.
+func DeltaInPlace(oldDataSignature SignatureIndex, newData io.Reader) (<-chan Op, <-chan error) {
+	return DeltaInPlaceContext(context.Background(), oldDataSignature, newData)
+}
+
+// DeltaInPlaceContext is like DeltaInPlace, but stops when ctx is done. See DeltaContext.
+func DeltaInPlaceContext(ctx context.Context, oldDataSignature SignatureIndex, newData io.Reader) (<-chan Op, <-chan error) {
+	deltaReader := NewDeltaReader(oldDataSignature, progress.FromContext(ctx).Reader(newData))
+	deltaReader.InPlace = true
+	return sendOps(ctx, deltaReader.Next)
+}
+
+// PatchInPlace applies the operations from opsChan to the old data in f, overwriting it with the new data, so no second copy of the data is needed. The delta must be created by DeltaInPlace: PatchInPlace returns an error if an op reads data it has already overwritten. Like Patch, it checks the hash of the new data, but in case of error, f is left with part of the old and of the new data.
+func PatchInPlace(f *os.File, opsChan <-chan Op, errc <-chan error) error {
+	return PatchInPlaceContext(context.Background(), f, opsChan, errc)
+}
+
+// PatchInPlaceContext is like PatchInPlace, but stops when ctx is done, returning ctx.Err(). See PatchContext.
+func PatchInPlaceContext(ctx context.Context, f *os.File, opsChan <-chan Op, errc <-chan error) error {
+	meter := progress.FromContext(ctx)
+	sha1Writer := sha1.New()
+
+	blockSize := DefaultBlockSize
+	// pos is where the next data is written. Data before it is already overwritten.
+	var pos int64
+	var buf []byte
+	for {
+		var op Op
+		var ok bool
+		select {
+		case op, ok = <-opsChan:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !ok {
+			break
+		}
+
+		countOp(meter, op, blockSize)
+		switch op.OpCode {
+		case BLOCK_SIZE:
+			if op.Index <= 0 || op.Index > MaxBlockSize {
+				return fmt.Errorf("%w, invalid block size %v", ErrCorruptDelta, op.Index)
+			}
+			blockSize = op.Index
+		case BLOCK, COPY:
+			offset, length := op.Offset, op.Length
+			if op.OpCode == BLOCK {
+				offset, length = int64(op.Index)*int64(blockSize), int64(blockSize)
+			}
+			if offset < 0 || length < 0 || op.Basis != 0 {
+				return fmt.Errorf("%w, invalid %v", ErrCorruptDelta, op)
+			}
+			if offset < pos {
+				return fmt.Errorf("%w, %v reads data already overwritten, up to %v, delta is not in place", ErrCorruptDelta, op, pos)
+			}
+			n, err := copyInPlace(f, offset, pos, length, &buf, sha1Writer)
+			if err != nil {
+				return err
+			}
+			pos += n
+			meter.Add(n)
+		case BASIS_DIGEST:
+			if pos != 0 || op.Basis != 0 {
+				return fmt.Errorf("%w, invalid %v, it must come before any data", ErrCorruptDelta, op)
+			}
+			if err := checkBasis(f, op.Length, op.Data); err != nil {
+				return err
+			}
+		case RAW_DATA:
+			_, err := f.WriteAt(op.Data, pos)
+			if err != nil {
+				return err
+			}
+			sha1Writer.Write(op.Data)
+			pos += int64(len(op.Data))
+			meter.Add(int64(len(op.Data)))
+		case ZERO:
+			if op.Length < 0 {
+				return fmt.Errorf("%w, invalid ZERO of %v bytes", ErrCorruptDelta, op.Length)
+			}
+			// the old data is there, so the zeros are written
+			if err := writeZeros(io.NewOffsetWriter(f, pos), op.Length); err != nil {
+				return err
+			}
+			writeZeros(sha1Writer, op.Length)
+			pos += op.Length
+			meter.Add(op.Length)
+		case EOF:
+			h := sha1Writer.Sum(nil)
+			if bytes.Compare(h, op.Data) != 0 {
+				return ErrChecksumMismatch
+			}
+		}
+	}
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return f.Truncate(pos)
+}
+
+// copyInPlace copies length bytes of f at offset to pos, where pos <= offset, and writes them to h. Going forward, it never overwrites data before reading it. Like patchCopy, it stops without error at the end of f, and it returns the number of bytes copied.
+func copyInPlace(f *os.File, offset int64, pos int64, length int64, buf *[]byte, h hash.Hash) (int64, error) {
+	var copied int64
+	for copied < length {
+		if int64(len(*buf)) < length-copied && len(*buf) < maxCopyBuffer {
+			if length-copied < maxCopyBuffer {
+				*buf = make([]byte, length-copied)
+			} else {
+				*buf = make([]byte, maxCopyBuffer)
+			}
+		}
+		chunk := *buf
+		if int64(len(chunk)) > length-copied {
+			chunk = chunk[:length-copied]
+		}
+
+		n, err := f.ReadAt(chunk, offset+copied)
+		if err != nil && err != io.EOF {
+			return copied, err
+		}
+		h.Write(chunk[:n])
+		// the data is already there
+		if offset != pos {
+			_, werr := f.WriteAt(chunk[:n], pos+copied)
+			if werr != nil {
+				return copied, werr
+			}
+		}
+		copied += int64(n)
+		if err == io.EOF {
+			break
+		}
+	}
+	return copied, nil
+}
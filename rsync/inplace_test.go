@@ -0,0 +1,81 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPatchInPlace(t *testing.T) {
+	oldData := createFakeData(200 * 1024)
+	// blocks moved back and forth, so some must be sent as RAW_DATA
+	newData := append(append(append([]byte(nil), oldData[100*1024:150*1024]...), createFakeData(1000)...), oldData...)
+
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, shrink := range []bool{false, true} {
+		data := newData
+		if shrink {
+			data = oldData[50*1024 : 120*1024]
+		}
+
+		ops, err := chanToOps(DeltaInPlace(sig, bytes.NewReader(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats DeltaStats
+		for _, op := range ops {
+			stats.Add(op)
+		}
+		if stats.MatchedBytes < 50*1024 {
+			t.Errorf("shrink %v: expected at least 50KiB copied, got %v", shrink, stats.MatchedBytes)
+		}
+
+		f, err := ioutil.TempFile("", "rsync-inplace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := f.Write(oldData); err != nil {
+			t.Fatal(err)
+		}
+
+		opsChan, cerr := opsToChan(ops)
+		err = PatchInPlace(f, opsChan, cerr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patchedData, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patchedData, data) {
+			t.Errorf("shrink %v: patched data is not equal to the new data", shrink)
+		}
+	}
+
+	// a delta that is not in place
+	ops, err := chanToOps(Delta(sig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "rsync-inplace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(oldData); err != nil {
+		t.Fatal(err)
+	}
+	opsChan, cerr := opsToChan(ops)
+	if err := PatchInPlace(f, opsChan, cerr); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for a delta that is not in place, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package rsync
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// InvertDelta returns the delta that creates the old data from the new data, given the delta ops that create the new data from the old data. The ranges of the old data that ops copy are copied back from the new data, and the rest of the old data is read from oldData, the first oldSize bytes, into RAW_DATA ops. It ends with an EOF op carrying the hash of the old data, so oldData is read in full once. If ops has an EOF op, the result starts with a BASIS_DIGEST op of the new data. See InvertDeltaContext to invert deltas too large for memory.
+func InvertDelta(oldData io.ReaderAt, oldSize int64, ops []Op) ([]Op, error) {
+	opsChan, errc := DeltaArrayToChan(ops)
+	opsChan, errc = InvertDeltaContext(context.Background(), oldData, oldSize, opsChan, errc)
+	var inverted []Op
+	for op := range opsChan {
+		inverted = append(inverted, op)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return inverted, nil
+}
+
+// InvertDeltaContext is like InvertDelta, but reads the delta ops from opsChan and errc, as returned by DeltaContext, and sends the inverted ops through the returned channels. Only the ranges of the old data the delta copies are kept in memory, not its literal data, and the literal data of the inverted delta is read from oldData as it is sent, so memory use does not grow with the size of the data. The inverted ops are sent once all the delta ops are read. It stops when ctx is done, sending ctx.Err() through the error channel; cancel ctx to stop reading the ops before the rsync.Op channel is closed.
+func InvertDeltaContext(ctx context.Context, oldData io.ReaderAt, oldSize int64, opsChan <-chan Op, errc <-chan error) (<-chan Op, <-chan error) {
+	resultErrc := make(chan error, 1)
+	resultChan := make(chan Op, deltaFuncBuffer)
+
+	go func() {
+		defer close(resultChan)
+
+		if oldSize < 0 {
+			resultErrc <- fmt.Errorf("rsync: invalid old data size %v", oldSize)
+			return
+		}
+		forward, eof, err := forwardExtents(ctx, oldSize, opsChan, errc)
+		if err != nil {
+			resultErrc <- err
+			return
+		}
+
+		send := func(op Op) bool {
+			select {
+			case resultChan <- op:
+				return true
+			case <-ctx.Done():
+				resultErrc <- ctx.Err()
+				return false
+			}
+		}
+		// pending is a COPY op not sent yet, merged with the next one if it continues it
+		var pending *Op
+		sendPending := func() bool {
+			if pending == nil {
+				return true
+			}
+			op := *pending
+			pending = nil
+			return send(op)
+		}
+		sendCopy := func(offset int64, length int64) bool {
+			if pending != nil && pending.Offset+pending.Length == offset {
+				pending.Length += length
+				return true
+			}
+			if !sendPending() {
+				return false
+			}
+			pending = &Op{OpCode: COPY, Offset: offset, Length: length}
+			return true
+		}
+
+		// extents of the new data copied from the old data, by their offset in the old data
+		var copied []extent
+		for _, e := range forward.extents {
+			if e.kind == baseExtent {
+				copied = append(copied, e)
+			}
+		}
+		sort.Slice(copied, func(i, j int) bool {
+			return copied[i].baseOffset < copied[j].baseOffset
+		})
+
+		if len(eof) > 0 {
+			// the new data is the basis of the inverted delta
+			if !send(Op{OpCode: BASIS_DIGEST, Length: forward.size, Data: eof[0].Data}) {
+				return
+			}
+		}
+
+		oldReader := io.NewSectionReader(oldData, 0, oldSize)
+		sha1Writer := sha1.New()
+
+		var pos int64
+		var best *extent
+		i := 0
+		for pos < oldSize {
+			// best is the extent that starts at or before pos and ends the furthest
+			for ; i < len(copied) && copied[i].baseOffset <= pos; i++ {
+				if best == nil || copied[i].baseOffset+copied[i].length > best.baseOffset+best.length {
+					best = &copied[i]
+				}
+			}
+
+			if best != nil && best.baseOffset+best.length > pos {
+				end := best.baseOffset + best.length
+				if !sendCopy(best.offset+pos-best.baseOffset, end-pos) {
+					return
+				}
+				// the data is not needed, but its hash is
+				if _, err := io.CopyN(sha1Writer, oldReader, end-pos); err != nil {
+					resultErrc <- oldDataError(err)
+					return
+				}
+				pos = end
+				continue
+			}
+
+			// not copied by ops, send it up to where the next extent starts
+			end := oldSize
+			if i < len(copied) {
+				end = copied[i].baseOffset
+			}
+			for pos < end {
+				n := end - pos
+				if n > maxLiteralOp {
+					n = maxLiteralOp
+				}
+				data := make([]byte, n)
+				if _, err := io.ReadFull(oldReader, data); err != nil {
+					resultErrc <- oldDataError(err)
+					return
+				}
+				sha1Writer.Write(data)
+				if !sendPending() || !send(Op{OpCode: RAW_DATA, Data: data}) {
+					return
+				}
+				pos += n
+			}
+		}
+
+		if sendPending() && send(Op{OpCode: EOF, Data: sha1Writer.Sum(nil)}) {
+			resultErrc <- nil
+		}
+	}()
+
+	return resultChan, resultErrc
+}
+
+// forwardExtents reads the delta ops from opsChan and errc, and returns the extents of the new data they create, and their EOF op, if they have one. They are composed against the whole old data, of oldSize bytes, so that copies past its end are cut as Patch does. The data of RAW_DATA ops is not kept.
+func forwardExtents(ctx context.Context, oldSize int64, opsChan <-chan Op, errc <-chan error) (*extentMap, []Op, error) {
+	oldExtents := new(extentMap)
+	oldExtents.appendBase(0, oldSize)
+	c := newComposer(oldExtents)
+	var literalSize int64
+	for {
+		var op Op
+		var ok bool
+		select {
+		case op, ok = <-opsChan:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if !ok {
+			break
+		}
+
+		if op.OpCode == RAW_DATA {
+			// only its length matters
+			c.m.appendSpooled(literalSize, int64(len(op.Data)))
+			literalSize += int64(len(op.Data))
+			continue
+		}
+		if err := c.add(op); err != nil {
+			return nil, nil, fmt.Errorf("%w, %v", ErrCorruptDelta, err)
+		}
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			return nil, nil, err
+		}
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	return c.m, c.eof, nil
+}
+
+// oldDataError returns the error of reading the old data in InvertDeltaContext.
+func oldDataError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("rsync: old data is shorter than its size")
+	}
+	return err
+}
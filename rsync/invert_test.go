@@ -0,0 +1,89 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestInvertDelta(t *testing.T) {
+	oldData := createFakeData(200 * 1024)
+	newData := modify(oldData, 0)
+	// old data copied twice
+	newData = append(newData, oldData[:10000]...)
+
+	for _, chunks := range []bool{false, true} {
+		ops, err := createDelta(oldData, newData, chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inverted, err := InvertDelta(bytes.NewReader(oldData), int64(len(oldData)), ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		patchedData := new(bytes.Buffer)
+		opsChan, cerr := opsToChan(inverted)
+		err = Patch(bytes.NewReader(newData), opsChan, cerr, patchedData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patchedData.Bytes(), oldData) {
+			t.Error("patched data is not equal to the old data")
+		}
+
+		// only the removed data should be sent
+		var stats DeltaStats
+		for _, op := range inverted {
+			stats.Add(op)
+		}
+		if stats.LiteralBytes > 5000+2*8*1024 {
+			t.Errorf("expected about 5000 bytes of RAW_DATA, got %v", stats.LiteralBytes)
+		}
+	}
+}
+
+func TestInvertDeltaRanges(t *testing.T) {
+	oldData := []byte("0123456789")
+	ops := []Op{
+		{OpCode: COPY, Offset: 2, Length: 3},
+		{OpCode: RAW_DATA, Data: []byte("ab")},
+		{OpCode: COPY, Offset: 3, Length: 4},
+		// past the end of the old data
+		{OpCode: COPY, Offset: 8, Length: 10},
+	}
+	// new data is "234ab345689"
+
+	inverted, err := InvertDelta(bytes.NewReader(oldData), int64(len(oldData)), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(inverted)
+	err = Patch(bytes.NewReader([]byte("234ab345689")), opsChan, cerr, patchedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patchedData.String() != string(oldData) {
+		t.Errorf("expected %q, got %q", oldData, patchedData.String())
+	}
+
+	if _, err := InvertDelta(bytes.NewReader(oldData), 20, ops); err == nil {
+		t.Error("expected an error when the old data is shorter than its size")
+	}
+	if _, err := InvertDelta(bytes.NewReader(oldData), int64(len(oldData)), []Op{{OpCode: COPY, Offset: -1, Length: 1}}); !errors.Is(err, ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping ErrCorruptDelta for an invalid COPY, got %v", err)
+	}
+
+	// errors of the delta are sent through the error channel, before any inverted op
+	opsChan, _ = opsToChan(ops)
+	deltaErr := make(chan error, 1)
+	deltaErr <- io.ErrUnexpectedEOF
+	invertedChan, invertedErr := InvertDeltaContext(context.Background(), bytes.NewReader(oldData), int64(len(oldData)), opsChan, deltaErr)
+	if ops, err := chanToOps(invertedChan, invertedErr); len(ops) != 0 || err != io.ErrUnexpectedEOF {
+		t.Errorf("expected no ops and io.ErrUnexpectedEOF, got %v ops and %v", len(ops), err)
+	}
+}
@@ -0,0 +1,362 @@
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// librsync file formats, as read and written by the rdiff tool.
+//
+// A librsync signature is a 12 bytes header (magic, block length and strong checksum length, big-endian uint32) followed by the rollsum weak checksum (big-endian uint32) and the truncated strong checksum of each block of the file, in order.
+//
+// A librsync delta is the delta magic (big-endian uint32) followed by commands. A command is an opcode byte followed by its big-endian integer parameters: literal commands carry their length (in the opcode itself up to 64 bytes) and are followed by the literal data, copy commands carry the offset and length of the data to copy from the basis file, and the end command finishes the delta.
+const (
+	// LibrsyncMD4SigMagic starts librsync signatures with MD4 strong checksums.
+	LibrsyncMD4SigMagic = 0x72730136
+	// LibrsyncBlake2SigMagic starts librsync signatures with BLAKE2b strong checksums.
+	LibrsyncBlake2SigMagic = 0x72730137
+	// LibrsyncDeltaMagic starts librsync deltas.
+	LibrsyncDeltaMagic = 0x72730236
+)
+
+// librsync delta opcodes.
+const (
+	librsyncOpEnd = 0x00
+	// librsyncOpLiteral1 to librsyncOpLiteral64 are literals of 1 to 64 bytes.
+	librsyncOpLiteral1  = 0x01
+	librsyncOpLiteral64 = 0x40
+	// librsyncOpLiteralN1 to librsyncOpLiteralN1+3 are literals with a length of 1, 2, 4 or 8 bytes.
+	librsyncOpLiteralN1 = 0x41
+	// librsyncOpCopyN1N1 to librsyncOpCopyN1N1+15 are copies with an offset and a length of 1, 2, 4 or 8 bytes each. The opcode is librsyncOpCopyN1N1 + 4*offset size index + length size index.
+	librsyncOpCopyN1N1 = 0x45
+	librsyncOpCopyN8N8 = 0x54
+)
+
+// librsyncIntSizes are the integer sizes of librsync commands parameters, by size index.
+var librsyncIntSizes = [4]int{1, 2, 4, 8}
+
+// WriteLibrsyncSignature writes the librsync signature of data to w. Librsync signatures always use Rollsum weak checksums, so opts.WeakHash is ignored, and opts.StrongHash must be MD4 or BLAKE2b. Read it back with ReadLibrsyncSignature.
+func WriteLibrsyncSignature(w io.Writer, data io.Reader, opts SignatureOptions) error {
+	var magic uint32
+	switch opts.StrongHash {
+	case MD4:
+		magic = LibrsyncMD4SigMagic
+	case BLAKE2b:
+		magic = LibrsyncBlake2SigMagic
+	default:
+		return fmt.Errorf("rsync: librsync signatures do not support strong hash %v", opts.StrongHash)
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize < 0 || blockSize > MaxBlockSize {
+		return fmt.Errorf("rsync: invalid block size %v", blockSize)
+	}
+	strongHash, err := opts.StrongHash.New()
+	if err != nil {
+		return err
+	}
+	strongLen := opts.StrongLen
+	if strongLen == 0 {
+		strongLen = strongHash.Size()
+	}
+	if strongLen < 0 || strongLen > strongHash.Size() {
+		return fmt.Errorf("rsync: invalid strong checksum length %v for %v", strongLen, opts.StrongHash)
+	}
+
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header[0:4], magic)
+	binary.BigEndian.PutUint32(header[4:8], uint32(blockSize))
+	binary.BigEndian.PutUint32(header[8:12], uint32(strongLen))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	block := make([]byte, blockSize)
+	entry := make([]byte, 4, 4+strongHash.Size())
+	for {
+		n, err := io.ReadFull(data, block)
+		opts.Progress.Add(int64(n))
+		if n > 0 {
+			binary.BigEndian.PutUint32(entry[0:4], getRollsum(block[:n]))
+			strongHash.Reset()
+			strongHash.Write(block[:n])
+			entry = strongHash.Sum(entry[:4])
+			if _, err := w.Write(entry[:4+strongLen]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadLibrsyncSignature reads a librsync signature, as written by WriteLibrsyncSignature or by rdiff, from r. Errors of invalid or truncated signatures wrap ErrCorruptSignature.
+func ReadLibrsyncSignature(r io.Reader) (Signature, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Signature{}, readSignatureError("librsync signature header", err)
+	}
+
+	sig := Signature{WeakHash: Rollsum, Blocks: make(map[uint32]map[string]int)}
+	switch magic := binary.BigEndian.Uint32(header[0:4]); magic {
+	case LibrsyncMD4SigMagic:
+		sig.StrongHash = MD4
+	case LibrsyncBlake2SigMagic:
+		sig.StrongHash = BLAKE2b
+	default:
+		return Signature{}, fmt.Errorf("%w, unknown librsync signature magic %#x", ErrCorruptSignature, magic)
+	}
+	sig.BlockSize = int(binary.BigEndian.Uint32(header[4:8]))
+	if sig.BlockSize <= 0 || sig.BlockSize > MaxBlockSize {
+		return Signature{}, fmt.Errorf("%w, invalid librsync signature block size %v", ErrCorruptSignature, sig.BlockSize)
+	}
+	strongHash, err := sig.StrongHash.New()
+	if err != nil {
+		return Signature{}, err
+	}
+	sig.StrongLen = int(binary.BigEndian.Uint32(header[8:12]))
+	if sig.StrongLen <= 0 || sig.StrongLen > strongHash.Size() {
+		return Signature{}, fmt.Errorf("%w, invalid librsync signature strong checksum length %v", ErrCorruptSignature, sig.StrongLen)
+	}
+
+	entry := make([]byte, 4+sig.StrongLen)
+	for index := 0; ; index++ {
+		_, err := io.ReadFull(r, entry)
+		if err == io.EOF {
+			// librsync signatures have an entry for every block, even repeated ones
+			sig.blockCount = int64(index)
+			return sig, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return Signature{}, fmt.Errorf("%w, truncated librsync signature", ErrCorruptSignature)
+		}
+		if err != nil {
+			return Signature{}, err
+		}
+
+		weak := binary.BigEndian.Uint32(entry[0:4])
+		strong := string(entry[4:])
+		m, ok := sig.Blocks[weak]
+		if !ok {
+			m = make(map[string]int)
+			sig.Blocks[weak] = m
+		}
+		if _, ok := m[strong]; !ok {
+			m[strong] = index
+		}
+	}
+}
+
+// WriteLibrsyncDelta writes the operations from opsChan to w as a librsync delta, merging consecutive BLOCK and COPY ops into a single copy command. Librsync deltas do not carry the hashes of the new and the old data, so the EOF and BASIS_DIGEST ops are dropped, nor runs of zeros, so ZERO ops are written as literal zeros. See Delta and PatchLibrsync.
+func WriteLibrsyncDelta(w io.Writer, opsChan <-chan Op, errc <-chan error) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, LibrsyncDeltaMagic)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	blockSize := int64(DefaultBlockSize)
+	var copyOffset, copyLength int64
+	for op := range opsChan {
+		switch op.OpCode {
+		case BLOCK_SIZE:
+			blockSize = int64(op.Index)
+		case BLOCK, COPY:
+			if op.Basis != 0 {
+				return fmt.Errorf("rsync: librsync deltas have a single basis, cannot write %v", op)
+			}
+			offset, length := op.Offset, op.Length
+			if op.OpCode == BLOCK {
+				offset, length = int64(op.Index)*blockSize, blockSize
+			}
+			if copyLength > 0 && copyOffset+copyLength == offset {
+				copyLength += length
+				continue
+			}
+			if err := writeLibrsyncCopy(w, copyOffset, copyLength); err != nil {
+				return err
+			}
+			copyOffset, copyLength = offset, length
+		case RAW_DATA:
+			if err := writeLibrsyncCopy(w, copyOffset, copyLength); err != nil {
+				return err
+			}
+			copyLength = 0
+			if err := writeLibrsyncLiteral(w, op.Data); err != nil {
+				return err
+			}
+		case ZERO:
+			if err := writeLibrsyncCopy(w, copyOffset, copyLength); err != nil {
+				return err
+			}
+			copyLength = 0
+			for n := op.Length; n > 0; n -= int64(len(zeroBuffer)) {
+				chunk := zeroBuffer
+				if int64(len(chunk)) > n {
+					chunk = chunk[:n]
+				}
+				if err := writeLibrsyncLiteral(w, chunk); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if err := writeLibrsyncCopy(w, copyOffset, copyLength); err != nil {
+		return err
+	}
+
+	_, err := w.Write([]byte{librsyncOpEnd})
+	return err
+}
+
+// writeLibrsyncCopy writes a copy command, unless length is 0.
+func writeLibrsyncCopy(w io.Writer, offset int64, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	offsetSize := librsyncIntSize(offset)
+	lengthSize := librsyncIntSize(length)
+
+	cmd := make([]byte, 1, 1+8+8)
+	cmd[0] = byte(librsyncOpCopyN1N1 + 4*offsetSize + lengthSize)
+	cmd = appendLibrsyncInt(cmd, offset, librsyncIntSizes[offsetSize])
+	cmd = appendLibrsyncInt(cmd, length, librsyncIntSizes[lengthSize])
+	_, err := w.Write(cmd)
+	return err
+}
+
+// writeLibrsyncLiteral writes a literal command followed by data.
+func writeLibrsyncLiteral(w io.Writer, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	cmd := make([]byte, 1, 1+8)
+	if len(data) <= librsyncOpLiteral64 {
+		cmd[0] = byte(len(data))
+	} else {
+		lengthSize := librsyncIntSize(int64(len(data)))
+		cmd[0] = byte(librsyncOpLiteralN1 + lengthSize)
+		cmd = appendLibrsyncInt(cmd, int64(len(data)), librsyncIntSizes[lengthSize])
+	}
+	if _, err := w.Write(cmd); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// librsyncIntSize returns the size index of the smallest integer size that holds v.
+func librsyncIntSize(v int64) int {
+	switch {
+	case v <= 0xff:
+		return 0
+	case v <= 0xffff:
+		return 1
+	case v <= 0xffffffff:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func appendLibrsyncInt(buf []byte, v int64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(v>>(8*uint(i))))
+	}
+	return buf
+}
+
+func readLibrsyncInt(r io.Reader, size int) (int64, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	var v int64
+	for _, b := range buf {
+		v = v<<8 | int64(b)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("%w, librsync delta parameter overflows int64", ErrCorruptDelta)
+	}
+	return v, nil
+}
+
+// PatchLibrsync applies the librsync delta read from delta to oldData and writes the resulting data to newData. As librsync deltas carry no hash of the new data, the result cannot be verified. Errors of corrupt deltas, including data that is not a librsync delta, wrap ErrCorruptDelta. In case of error, the newData Writer may have incomplete data. See WriteLibrsyncDelta.
+func PatchLibrsync(oldData io.ReaderAt, delta io.Reader, newData io.Writer) error {
+	deltaBuffer := bufio.NewReader(delta)
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(deltaBuffer, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w, truncated librsync delta header", ErrCorruptDelta)
+		}
+		return fmt.Errorf("rsync: could not read librsync delta header: %v", err)
+	}
+	if magic := binary.BigEndian.Uint32(header); magic != LibrsyncDeltaMagic {
+		return fmt.Errorf("%w, unknown librsync delta magic %#x", ErrCorruptDelta, magic)
+	}
+
+	for {
+		cmd, err := deltaBuffer.ReadByte()
+		if err == io.EOF {
+			return fmt.Errorf("%w, librsync delta ended without end command", ErrCorruptDelta)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case cmd == librsyncOpEnd:
+			return nil
+		case cmd >= librsyncOpLiteral1 && cmd <= librsyncOpCopyN8N8:
+			var offset, length int64
+			if cmd <= librsyncOpLiteral64 {
+				length = int64(cmd)
+			} else if cmd < librsyncOpCopyN1N1 {
+				length, err = readLibrsyncInt(deltaBuffer, librsyncIntSizes[cmd-librsyncOpLiteralN1])
+			} else {
+				offset, err = readLibrsyncInt(deltaBuffer, librsyncIntSizes[(cmd-librsyncOpCopyN1N1)/4])
+				if err == nil {
+					length, err = readLibrsyncInt(deltaBuffer, librsyncIntSizes[(cmd-librsyncOpCopyN1N1)%4])
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("%w, truncated librsync delta", ErrCorruptDelta)
+			}
+			if err != nil {
+				return err
+			}
+
+			if cmd < librsyncOpCopyN1N1 {
+				_, err = io.CopyN(newData, deltaBuffer, length)
+				if err == io.EOF {
+					return fmt.Errorf("%w, truncated librsync delta literal", ErrCorruptDelta)
+				}
+			} else {
+				var n int64
+				n, err = io.CopyN(newData, io.NewSectionReader(oldData, offset, length), length)
+				if err == io.EOF {
+					return fmt.Errorf("rsync: librsync delta copies %v bytes at offset %v, basis has only %v", length, offset, n)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w, unknown librsync delta command %#x", ErrCorruptDelta, cmd)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// The rdiff-* files in test-data are a basis file, a new version of it, their librsync signatures (block length 512, BLAKE2b with full checksums and MD4 truncated to 8 bytes) and a librsync delta between them.
+const (
+	rdiffBasis     = "test-data/rdiff-basis.txt"
+	rdiffNew       = "test-data/rdiff-new.txt"
+	rdiffBlake2Sig = "test-data/rdiff-basis.blake2.sig"
+	rdiffMD4Sig    = "test-data/rdiff-basis.md4.sig"
+	rdiffDelta     = "test-data/rdiff-new.delta"
+)
+
+func readFiles(t *testing.T, filenames ...string) [][]byte {
+	var result [][]byte
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, data)
+	}
+	return result
+}
+
+func TestWriteLibrsyncSignature(t *testing.T) {
+	files := readFiles(t, rdiffBasis, rdiffBlake2Sig, rdiffMD4Sig)
+	basis, blake2Sig, md4Sig := files[0], files[1], files[2]
+
+	tests := []struct {
+		opts   SignatureOptions
+		golden []byte
+	}{
+		{SignatureOptions{BlockSize: 512, StrongHash: BLAKE2b}, blake2Sig},
+		{SignatureOptions{BlockSize: 512, StrongHash: MD4, StrongLen: 8}, md4Sig},
+	}
+
+	for _, test := range tests {
+		sig := new(bytes.Buffer)
+		err := WriteLibrsyncSignature(sig, bytes.NewReader(basis), test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig.Bytes(), test.golden) {
+			t.Errorf("librsync signature with %+v does not match golden file", test.opts)
+		}
+	}
+
+	err := WriteLibrsyncSignature(new(bytes.Buffer), bytes.NewReader(basis), SignatureOptions{StrongHash: MD5})
+	if err == nil {
+		t.Error("expected error for a librsync signature with MD5")
+	}
+}
+
+func TestReadLibrsyncSignature(t *testing.T) {
+	files := readFiles(t, rdiffBasis, rdiffNew, rdiffBlake2Sig, rdiffMD4Sig)
+	basis, newData := files[0], files[1]
+
+	for _, golden := range files[2:] {
+		sig, err := ReadLibrsyncSignature(bytes.NewReader(golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.BlockSize != 512 || sig.WeakHash != Rollsum {
+			t.Fatalf("unexpected signature parameters: block size %v, weak hash %v", sig.BlockSize, sig.WeakHash)
+		}
+		// librsync signatures have an entry for every block after a 12 byte header
+		if blocks := int64(len(golden)-12) / int64(4+sig.StrongLen); sig.BlockCount() != blocks {
+			t.Errorf("expected %v blocks, got %v", blocks, sig.BlockCount())
+		}
+
+		opsChan, cerr := Delta(sig, bytes.NewReader(newData))
+		delta := new(bytes.Buffer)
+		err = WriteLibrsyncDelta(delta, opsChan, cerr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta.Len() >= len(newData) {
+			t.Errorf("expected %v signature to match blocks, delta has %v bytes for %v bytes of new data", sig.StrongHash, delta.Len(), len(newData))
+		}
+
+		patched := new(bytes.Buffer)
+		err = PatchLibrsync(bytes.NewReader(basis), delta, patched)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patched.Bytes(), newData) {
+			t.Errorf("patched data does not match new data with %v signature", sig.StrongHash)
+		}
+	}
+
+	_, err := ReadLibrsyncSignature(bytes.NewReader(files[2][:len(files[2])-1]))
+	if !errors.Is(err, ErrCorruptSignature) {
+		t.Errorf("expected an error wrapping ErrCorruptSignature for a truncated librsync signature, got %v", err)
+	}
+	_, err = ReadLibrsyncSignature(bytes.NewReader(files[2][:5]))
+	if !errors.Is(err, ErrCorruptSignature) {
+		t.Errorf("expected an error wrapping ErrCorruptSignature for a truncated header, got %v", err)
+	}
+}
+
+func TestPatchLibrsync(t *testing.T) {
+	files := readFiles(t, rdiffBasis, rdiffNew, rdiffDelta)
+	basis, newData, delta := files[0], files[1], files[2]
+
+	patched := new(bytes.Buffer)
+	err := PatchLibrsync(bytes.NewReader(basis), bytes.NewReader(delta), patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patched.Bytes(), newData) {
+		t.Error("patched data does not match new data")
+	}
+
+	for _, test := range []struct {
+		name  string
+		delta []byte
+	}{
+		{"a librsync delta without end command", delta[:len(delta)-1]},
+		{"a short header", delta[:2]},
+		{"an empty delta", nil},
+		{"a file that is not a librsync delta", newData},
+	} {
+		err = PatchLibrsync(bytes.NewReader(basis), bytes.NewReader(test.delta), new(bytes.Buffer))
+		if !errors.Is(err, ErrCorruptDelta) {
+			t.Errorf("%v: expected an error wrapping ErrCorruptDelta, got %v", test.name, err)
+		}
+	}
+}
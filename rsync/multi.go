@@ -0,0 +1,151 @@
+package rsync
+
+import (
+	"context"
+	"fmt"
+	"github.com/mateusbraga/saveit/progress"
+	"io"
+)
+
+// BlockRef is a block of one of the bases of a MultiSignature.
+type BlockRef struct {
+	Basis int
+	Index int
+}
+
+// MultiSignature combines the signatures of several old data, the bases, so that the new data can reuse blocks of any of them. The basis of a block is the position of its signature in NewMultiSignature.
+type MultiSignature struct {
+	// BlockSize, WeakHash, StrongHash and StrongLen are the same in all the signatures combined.
+	BlockSize  int
+	WeakHash   WeakHash
+	StrongHash StrongHash
+	StrongLen  int
+	// Blocks maps the weak checksum of a block to the strong checksums of the blocks with that weak checksum, and those to the block.
+	Blocks map[uint32]map[string]BlockRef
+	// blockCount is the number of blocks of all the bases, counted by NewMultiSignature.
+	blockCount int64
+}
+
+// NewMultiSignature combines sigs into a MultiSignature. The signatures must have been created with the same options. If a block is in more than one basis, the first one is used.
+func NewMultiSignature(sigs ...Signature) (MultiSignature, error) {
+	if len(sigs) == 0 {
+		return MultiSignature{}, fmt.Errorf("rsync: no signatures to combine")
+	}
+	multiSig := MultiSignature{
+		BlockSize:  sigs[0].BlockSize,
+		WeakHash:   sigs[0].WeakHash,
+		StrongHash: sigs[0].StrongHash,
+		StrongLen:  sigs[0].StrongLen,
+		Blocks:     make(map[uint32]map[string]BlockRef),
+	}
+	// counts is the number of blocks of each basis, up to the last distinct block
+	counts := make([]int64, len(sigs))
+	for basis, sig := range sigs {
+		if sig.BlockSize != multiSig.BlockSize || sig.WeakHash != multiSig.WeakHash || sig.StrongHash != multiSig.StrongHash || sig.StrongLen != multiSig.StrongLen {
+			return MultiSignature{}, fmt.Errorf("rsync: signature of basis %v has different options than basis 0", basis)
+		}
+		for weak, strongs := range sig.Blocks {
+			m, ok := multiSig.Blocks[weak]
+			if !ok {
+				m = make(map[string]BlockRef)
+				multiSig.Blocks[weak] = m
+			}
+			for strong, index := range strongs {
+				if _, ok := m[strong]; !ok {
+					m[strong] = BlockRef{Basis: basis, Index: index}
+					if int64(index)+1 > counts[basis] {
+						counts[basis] = int64(index) + 1
+					}
+				}
+			}
+		}
+	}
+	for _, n := range counts {
+		multiSig.blockCount += n
+	}
+	return multiSig, nil
+}
+
+// Options returns the options the signatures combined were created with.
+func (sig MultiSignature) Options() SignatureOptions {
+	return SignatureOptions{
+		BlockSize:  sig.BlockSize,
+		WeakHash:   sig.WeakHash,
+		StrongHash: sig.StrongHash,
+		StrongLen:  sig.StrongLen,
+	}
+}
+
+// BlockCount returns the number of blocks of all the bases, up to the last distinct block of each. It is counted by NewMultiSignature, or, if sig was made otherwise, by scanning its blocks. See Signature.BlockCount.
+func (sig MultiSignature) BlockCount() int64 {
+	if sig.blockCount > 0 {
+		return sig.blockCount
+	}
+	counts := make(map[int]int64)
+	for _, strongs := range sig.Blocks {
+		for _, ref := range strongs {
+			if int64(ref.Index)+1 > counts[ref.Basis] {
+				counts[ref.Basis] = int64(ref.Index) + 1
+			}
+		}
+	}
+	var count int64
+	for _, n := range counts {
+		count += n
+	}
+	return count
+}
+
+// Candidates returns the blocks of any basis with the weak checksum weak, one for each strong checksum.
+func (sig MultiSignature) Candidates(weak uint32) ([]BlockRef, error) {
+	strongs, ok := sig.Blocks[weak]
+	if !ok {
+		return nil, nil
+	}
+	refs := make([]BlockRef, 0, len(strongs))
+	for _, ref := range strongs {
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// Verify returns whether the block ref has the given checksums.
+func (sig MultiSignature) Verify(weak uint32, strong []byte, ref BlockRef) (bool, error) {
+	found, ok := sig.Blocks[weak][string(strong)]
+	return ok && found == ref, nil
+}
+
+// BasisDigest returns a nil digest: deltas against several bases do not check them.
+func (sig MultiSignature) BasisDigest() (int64, []byte) {
+	return 0, nil
+}
+
+// Tail returns a length of 0: the last blocks of the bases are not matched at the end of the new data.
+func (sig MultiSignature) Tail() (int, int) {
+	return 0, 0
+}
+
+// NewMultiDeltaReader returns a DeltaReader of newData against the bases oldDataSignature was created from. Its COPY ops name the basis they copy from.
+func NewMultiDeltaReader(oldDataSignature MultiSignature, newData io.Reader) *DeltaReader {
+	return NewDeltaReader(oldDataSignature, newData)
+}
+
+// DeltaMulti is like Delta, but reuses the blocks of any of the bases oldDataSignature was created from. Its COPY ops name the basis they copy from. See PatchMulti.
+func DeltaMulti(oldDataSignature MultiSignature, newData io.Reader) (<-chan Op, <-chan error) {
+	return DeltaMultiContext(context.Background(), oldDataSignature, newData)
+}
+
+// DeltaMultiContext is like DeltaMulti, but stops when ctx is done. See DeltaContext.
+func DeltaMultiContext(ctx context.Context, oldDataSignature MultiSignature, newData io.Reader) (<-chan Op, <-chan error) {
+	return sendOps(ctx, NewMultiDeltaReader(oldDataSignature, progress.FromContext(ctx).Reader(newData)).Next)
+}
+
+// PatchMulti is like Patch, but for deltas created by DeltaMulti. resolve returns the old data of each basis.
+func PatchMulti(resolve func(basis int) (io.ReaderAt, error), opsChan <-chan Op, errc <-chan error, newData io.Writer) error {
+	return PatchMultiContext(context.Background(), resolve, opsChan, errc, newData)
+}
+
+// PatchMultiContext is like PatchMulti, but stops when ctx is done. See PatchContext.
+func PatchMultiContext(ctx context.Context, resolve func(basis int) (io.ReaderAt, error), opsChan <-chan Op, errc <-chan error, newData io.Writer) error {
+	return patch(ctx, resolve, opsChan, errc, newData)
+}
@@ -0,0 +1,116 @@
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDeltaMulti(t *testing.T) {
+	bases := [][]byte{createFakeData(100 * 1024), createFakeData(100 * 1024)}
+	newData := append(append(append([]byte(nil), bases[1][:50*1024]...), createFakeData(1000)...), bases[0][20*1024:]...)
+
+	var sigs []Signature
+	for _, basis := range bases {
+		sig, err := NewSignatureSize(bytes.NewReader(basis), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, sig)
+	}
+	multiSig, err := NewMultiSignature(sigs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := chanToOps(DeltaMulti(multiSig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copies []Op
+	for _, op := range ops {
+		if op.OpCode == COPY {
+			copies = append(copies, op)
+		}
+	}
+	expected := []Op{
+		{OpCode: COPY, Offset: 0, Length: 50 * 1024, Basis: 1},
+		{OpCode: COPY, Offset: 20 * 1024, Length: 80 * 1024, Basis: 0},
+	}
+	if !reflect.DeepEqual(copies, expected) {
+		t.Errorf("expected %v, got %v", expected, copies)
+	}
+
+	// the basis survives the encoding
+	encoded := new(bytes.Buffer)
+	enc := NewEncoder(encoded)
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	decodedOps := decodeAll(t, encoded)
+	if !reflect.DeepEqual(decodedOps, ops) {
+		t.Error("decoded ops differ from the encoded ones")
+	}
+
+	resolve := func(basis int) (io.ReaderAt, error) {
+		if basis < 0 || basis >= len(bases) {
+			return nil, fmt.Errorf("unknown basis %v", basis)
+		}
+		return bytes.NewReader(bases[basis]), nil
+	}
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	err = PatchMulti(resolve, opsChan, cerr, patchedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), newData) {
+		t.Error("patched data is not equal to the new data")
+	}
+
+	// Patch only knows basis 0
+	opsChan, cerr = opsToChan(ops)
+	err = Patch(bytes.NewReader(bases[0]), opsChan, cerr, new(bytes.Buffer))
+	if err == nil {
+		t.Error("expected an error patching a multi-basis delta with Patch")
+	}
+}
+
+func TestNewMultiSignature(t *testing.T) {
+	data := createFakeData(10 * 1024)
+	sig1, err := NewSignatureSize(bytes.NewReader(data), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := NewSignatureSize(bytes.NewReader(data), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewMultiSignature(sig1, sig2); err == nil {
+		t.Error("expected an error combining signatures of different block sizes")
+	}
+	if _, err := NewMultiSignature(); err == nil {
+		t.Error("expected an error combining no signatures")
+	}
+
+	// blocks in both bases are taken from the first
+	multiSig, err := NewMultiSignature(sig1, sig1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, strongs := range multiSig.Blocks {
+		for _, ref := range strongs {
+			if ref.Basis != 0 {
+				t.Fatalf("expected blocks of basis 0, got %v", ref)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package rsync
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelSignatureJobSize is about how many bytes each worker of NewSignatureReaderAt reads at once.
+const parallelSignatureJobSize = 4 * 1024 * 1024
+
+// blockSum holds the checksums of a block.
+type blockSum struct {
+	weak   uint32
+	strong string
+}
+
+// NewSignatureReaderAt creates the Signature of the first size bytes of data as configured by opts, like NewSignatureOptions. Ranges of blocks are read and hashed by opts.Workers goroutines at the same time, and the result is the same as the one of NewSignatureOptions. The data is read once: the Digest is computed from the ranges the goroutines read, in order, each one waiting for the ranges before its own to be added to it.
+func NewSignatureReaderAt(data io.ReaderAt, size int64, opts SignatureOptions) (Signature, error) {
+	if size < 0 {
+		return Signature{}, fmt.Errorf("rsync: invalid data size %v", size)
+	}
+	// validates opts
+	sigWriter, err := NewSignatureWriterOptions(opts)
+	if err != nil {
+		return Signature{}, err
+	}
+	sig := sigWriter.sig
+
+	blockSize := int64(sig.BlockSize)
+	numBlocks := (size + blockSize - 1) / blockSize
+	blocksPerJob := parallelSignatureJobSize / blockSize
+	if blocksPerJob < 1 {
+		blocksPerJob = 1
+	}
+	numJobs := (numBlocks + blocksPerJob - 1) / blocksPerJob
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if int64(workers) > numJobs {
+		workers = int(numJobs)
+	}
+
+	// the digest of the whole data cannot be split into jobs, the jobs are added to it in order, by the worker of each one after the previous one
+	digest := sha1.New()
+	var digestMu sync.Mutex
+	digestCond := sync.NewCond(&digestMu)
+	var digestJob int64
+
+	sums := make([]blockSum, numBlocks)
+	errs := make([]error, workers)
+	var nextJob int64
+	var failed int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		// each worker needs its own hashes
+		w, _ := NewSignatureWriterOptions(opts)
+
+		wg.Add(1)
+		go func(i int, w *SignatureWriter) {
+			defer wg.Done()
+
+			buf := make([]byte, blocksPerJob*blockSize)
+			for atomic.LoadInt32(&failed) == 0 {
+				job := atomic.AddInt64(&nextJob, 1) - 1
+				if job >= numJobs {
+					return
+				}
+
+				firstBlock := job * blocksPerJob
+				offset := firstBlock * blockSize
+				jobData := buf
+				if int64(len(jobData)) > size-offset {
+					jobData = jobData[:size-offset]
+				}
+				n, err := data.ReadAt(jobData, offset)
+				if n < len(jobData) {
+					if err == nil || err == io.EOF {
+						err = io.ErrUnexpectedEOF
+					}
+					errs[i] = err
+					// wake up the workers waiting for this job to be added to the digest
+					digestMu.Lock()
+					atomic.StoreInt32(&failed, 1)
+					digestCond.Broadcast()
+					digestMu.Unlock()
+					return
+				}
+				opts.Progress.Add(int64(n))
+				jobRead := jobData
+
+				for index := firstBlock; len(jobData) > 0; index++ {
+					block := jobData
+					if int64(len(block)) > blockSize {
+						block = block[:blockSize]
+					}
+					w.multiwriter.Write(block)
+					sums[index].weak, sums[index].strong = w.sum()
+					w.rollingWeakHash.Reset()
+					w.strongHash.Reset()
+					jobData = jobData[len(block):]
+				}
+
+				digestMu.Lock()
+				for digestJob != job && atomic.LoadInt32(&failed) == 0 {
+					digestCond.Wait()
+				}
+				if digestJob == job {
+					digest.Write(jobRead)
+					digestJob++
+					digestCond.Broadcast()
+				}
+				digestMu.Unlock()
+			}
+		}(i, w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return Signature{}, err
+		}
+	}
+
+	// merge in index order, so that the first of equal blocks is kept, like SignatureWriter does
+	for index, s := range sums {
+		sig.addBlock(s.weak, s.strong, index)
+	}
+	sig.setLength(size, digest.Sum(nil))
+	return sig, nil
+}
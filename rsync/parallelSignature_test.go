@@ -0,0 +1,157 @@
+package rsync
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewSignatureReaderAt(t *testing.T) {
+	originalData, err := ioutil.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, 1000, len(originalData)} {
+		data := originalData[:size]
+		for _, opts := range []SignatureOptions{
+			{BlockSize: MinBlockSize, Workers: 1},
+			{BlockSize: 1000, Workers: 3},
+			{BlockSize: 4096, WeakHash: Rollsum, StrongHash: BLAKE2b, StrongLen: 8, Workers: 8},
+			{},
+		} {
+			expected, err := NewSignatureOptions(bytes.NewReader(data), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := NewSignatureReaderAt(bytes.NewReader(data), int64(len(data)), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sig, expected) {
+				t.Errorf("size %v, %+v: signature differs from the sequential one", size, opts)
+			}
+		}
+	}
+}
+
+func TestNewSignatureReaderAtJobs(t *testing.T) {
+	// several jobs per worker, with equal blocks in different jobs
+	data := createFakeData(3*parallelSignatureJobSize + 1000)
+	copy(data[2*parallelSignatureJobSize:], data[:2*1024])
+	opts := SignatureOptions{BlockSize: 1024, Workers: 2}
+
+	expected, err := NewSignatureOptions(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := NewSignatureReaderAt(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sig, expected) {
+		t.Error("signature differs from the sequential one")
+	}
+}
+
+type failingReaderAt struct{}
+
+// firstJobFailing fails the reads of the first job of NewSignatureReaderAt.
+type firstJobFailing struct {
+	r io.ReaderAt
+}
+
+func (f firstJobFailing) ReadAt(p []byte, off int64) (int, error) {
+	if off == 0 {
+		return 0, errFailingReaderAt
+	}
+	return f.r.ReadAt(p, off)
+}
+
+var errFailingReaderAt = errors.New("failing ReaderAt")
+
+func (failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errFailingReaderAt
+}
+
+// countingReaderAt counts the bytes read from r, and fails the reads at or after failAt, if it is not 0.
+type countingReaderAt struct {
+	r      io.ReaderAt
+	n      int64
+	failAt int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if c.failAt > 0 && off >= c.failAt {
+		return 0, errFailingReaderAt
+	}
+	n, err := c.r.ReadAt(p, off)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestNewSignatureReaderAtReadsOnce(t *testing.T) {
+	data := createFakeData(5*parallelSignatureJobSize + 1000)
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	sig, err := NewSignatureReaderAt(r, int64(len(data)), SignatureOptions{Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.n != int64(len(data)) {
+		t.Errorf("expected %v bytes read, got %v", len(data), r.n)
+	}
+	digest := sha1.Sum(data)
+	if !bytes.Equal(sig.Digest, digest[:]) {
+		t.Errorf("expected digest %x, got %x", digest, sig.Digest)
+	}
+}
+
+func TestNewSignatureReaderAtErrors(t *testing.T) {
+	_, err := NewSignatureReaderAt(failingReaderAt{}, 100*1024*1024, SignatureOptions{Workers: 4})
+	if err != errFailingReaderAt {
+		t.Errorf("expected %v, got %v", errFailingReaderAt, err)
+	}
+
+	// the jobs after the first fail, and the first one does not
+	r := &countingReaderAt{r: bytes.NewReader(make([]byte, 5*parallelSignatureJobSize)), failAt: parallelSignatureJobSize}
+	_, err = NewSignatureReaderAt(r, 5*parallelSignatureJobSize, SignatureOptions{BlockSize: 1024, Workers: 4})
+	if err != errFailingReaderAt {
+		t.Errorf("expected %v, got %v", errFailingReaderAt, err)
+	}
+	// only the first job fails, the others wait for it to be added to the digest
+	_, err = NewSignatureReaderAt(firstJobFailing{bytes.NewReader(make([]byte, 5*parallelSignatureJobSize))}, 5*parallelSignatureJobSize, SignatureOptions{BlockSize: 1024, Workers: 4})
+	if err != errFailingReaderAt {
+		t.Errorf("expected %v, got %v", errFailingReaderAt, err)
+	}
+
+	// shorter than size
+	_, err = NewSignatureReaderAt(bytes.NewReader(make([]byte, 10)), 11, SignatureOptions{})
+	if err == nil {
+		t.Error("expected an error when data is shorter than size")
+	}
+
+	_, err = NewSignatureReaderAt(bytes.NewReader(nil), -1, SignatureOptions{})
+	if err == nil {
+		t.Error("expected an error for a negative size")
+	}
+}
+
+func BenchmarkRsyncNewSignatureReaderAt(b *testing.B) {
+	originalFile, err := ioutil.ReadFile(original)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		_, err := NewSignatureReaderAt(bytes.NewReader(originalFile), int64(len(originalFile)), SignatureOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package rsync
+
+// rabinKarpBase is the base of the polynomial of rabinKarp, the 32-bit FNV prime.
+const rabinKarpBase = 16777619
+
+func newRabinKarp(blockSize int) *rabinKarp {
+	d := &rabinKarp{window: window{data: make([]byte, blockSize)}, outFactor: 1}
+	for i := 0; i < blockSize; i++ {
+		d.outFactor *= rabinKarpBase
+	}
+	d.Reset()
+	return d
+}
+
+// rabinKarp is the Rabin-Karp rolling hash: the checksum of a window is the polynomial of its bytes in rabinKarpBase, modulo 2^32. It rolls over windows of len(data) bytes.
+type rabinKarp struct {
+	digest uint32
+	// outFactor is rabinKarpBase^len(data), the factor of the byte leaving the window once the others are shifted.
+	outFactor uint32
+	window
+}
+
+func (d *rabinKarp) Reset() {
+	d.digest = 0
+	d.reset()
+}
+
+func (d *rabinKarp) Write(p []byte) (int, error) {
+	d.write(p, d.addData, d.Roll)
+	return len(p), nil
+}
+
+func (d *rabinKarp) Roll(out []byte, in []byte, sums []uint32) {
+	digest := d.digest
+	for i, x := range in {
+		digest = digest*rabinKarpBase + uint32(x) - d.outFactor*uint32(out[i])
+		sums[i] = digest
+	}
+	d.digest = digest
+}
+
+func (d *rabinKarp) Sum32() uint32 { return d.digest }
+
+// getRabinKarp returns the Rabin-Karp hash of data.
+func getRabinKarp(data []byte) uint32 {
+	d := newRabinKarp(0)
+	d.addData(data)
+	return d.Sum32()
+}
+
+func (d *rabinKarp) addData(p []byte) {
+	for _, x := range p {
+		d.digest = d.digest*rabinKarpBase + uint32(x)
+	}
+}
@@ -0,0 +1,358 @@
+// Package remote implements a protocol to update a file on another node with the rsync algorithm, over any connection, such as a net.Conn.
+//
+// The sender, which has the new data, pushes it to the receiver, which has the old data:
+//
+//	sender                     receiver
+//	REQUEST name      ->
+//	                  <-       signature of the old data (DATA frames, END)
+//	delta (DATA, END) ->
+//	                  <-       DONE with the hash of the new data, or ERROR
+//
+// Each message is a frame: its type (a byte), the length of its payload (uvarint) and the payload. The signature is sent in the librsync format, and the delta in the rsync package encoding, each split into DATA frames and ended by an END frame. An ERROR frame, with the error message as payload, can take the place of any frame the receiver sends, and of the END frame of the delta.
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/mateusbraga/saveit/rsync"
+	"io"
+	"io/ioutil"
+)
+
+// ProtocolVersion is the version of the protocol, sent in the REQUEST frame.
+const ProtocolVersion = 1
+
+// Frame types.
+const (
+	frameRequest = iota + 1
+	frameData
+	frameEnd
+	frameError
+	frameDone
+)
+
+const (
+	// maxFramePayload bounds the payload of the frames read, so that a corrupted stream does not cause huge allocations.
+	maxFramePayload = 1024 * 1024
+	// dataFrameSize is the largest payload of the DATA frames written.
+	dataFrameSize = 32 * 1024
+)
+
+// RemoteError is an error sent by the other side of the connection.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: peer error: " + e.Message
+}
+
+// conn reads and writes frames.
+type conn struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	buf []byte
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	return &conn{
+		r:   bufio.NewReader(rw),
+		w:   bufio.NewWriter(rw),
+		buf: make([]byte, 0, 1+binary.MaxVarintLen64),
+	}
+}
+
+// writeFrame writes a frame, without flushing it.
+func (c *conn) writeFrame(frameType byte, payload []byte) error {
+	header := append(c.buf[:0], frameType)
+	header = binary.AppendUvarint(header, uint64(len(payload)))
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+	_, err := c.w.Write(payload)
+	return err
+}
+
+// writeError writes and flushes an ERROR frame with err.
+func (c *conn) writeError(err error) error {
+	if werr := c.writeFrame(frameError, []byte(err.Error())); werr != nil {
+		return werr
+	}
+	return c.w.Flush()
+}
+
+// readFrame reads a frame. ERROR frames are returned as a *RemoteError.
+func (c *conn) readFrame() (byte, []byte, error) {
+	frameType, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if n > maxFramePayload {
+		return 0, nil, fmt.Errorf("remote: frame of %v bytes is too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if frameType == frameError {
+		return 0, nil, &RemoteError{Message: string(payload)}
+	}
+	return frameType, payload, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// streamWriter writes a stream as DATA frames. Close ends it with an END frame.
+type streamWriter struct {
+	c *conn
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > dataFrameSize {
+			n = dataFrameSize
+		}
+		if err := s.c.writeFrame(frameData, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close writes the END frame and flushes the connection.
+func (s streamWriter) Close() error {
+	if err := s.c.writeFrame(frameEnd, nil); err != nil {
+		return err
+	}
+	return s.c.w.Flush()
+}
+
+// streamReader reads a stream written by streamWriter. It returns io.EOF at the END frame.
+type streamReader struct {
+	c    *conn
+	data []byte
+	err  error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.data) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		var frameType byte
+		frameType, s.data, s.err = s.c.readFrame()
+		if s.err == nil {
+			switch frameType {
+			case frameData:
+			case frameEnd:
+				s.err = io.EOF
+			default:
+				s.err = fmt.Errorf("remote: unexpected frame %v in stream", frameType)
+			}
+		}
+		if s.err != nil {
+			s.data = nil
+		}
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// Push sends newData to the receiver on rw, to update its data called name. It returns nil once the receiver confirmed that its new data has the same hash as newData.
+func Push(rw io.ReadWriter, name string, newData io.Reader) error {
+	c := newConn(rw)
+
+	request := append([]byte{ProtocolVersion}, name...)
+	if err := c.writeFrame(frameRequest, request); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	sigStream := &streamReader{c: c}
+	sig, err := rsync.ReadLibrsyncSignature(sigStream)
+	if err != nil {
+		if remoteErr, ok := sigStream.err.(*RemoteError); ok {
+			return remoteErr
+		}
+		return err
+	}
+	if n, err := io.Copy(ioutil.Discard, sigStream); err != nil || n != 0 {
+		return fmt.Errorf("%w, remote signature stream has %v bytes after the signature, error %v", rsync.ErrCorruptSignature, n, err)
+	}
+
+	hash, err := sendDelta(c, sig, newData)
+	if err != nil {
+		return err
+	}
+
+	frameType, payload, err := c.readFrame()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if frameType != frameDone {
+		return fmt.Errorf("remote: unexpected frame %v, expected DONE", frameType)
+	}
+	if !bytes.Equal(payload, hash) {
+		return fmt.Errorf("remote: receiver confirmed hash %x, expected %x: %w", payload, hash, rsync.ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// sendDelta sends the delta of newData against sig and returns the hash of newData. If the delta fails, the stream is ended by an ERROR frame instead of END, and the answer of the receiver is read.
+func sendDelta(c *conn, sig rsync.Signature, newData io.Reader) ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deltaStream := streamWriter{c: c}
+	enc := rsync.NewEncoder(deltaStream)
+	var hash []byte
+	opc, errc := rsync.DeltaContext(ctx, sig, newData)
+	for op := range opc {
+		if op.OpCode == rsync.EOF {
+			hash = op.Data
+		}
+		if err := enc.Encode(op); err != nil {
+			return nil, err
+		}
+	}
+	err := <-errc
+	if err == nil {
+		err = enc.Flush()
+	}
+	if err != nil {
+		// the receiver answers the ERROR frame with its own
+		if c.writeError(err) == nil {
+			c.readFrame()
+		}
+		return nil, err
+	}
+	return hash, deltaStream.Close()
+}
+
+// ReadRequest reads the REQUEST frame a sender starts with, and returns the name of the data to update. Call Receive next.
+func ReadRequest(rw io.ReadWriter) (string, error) {
+	c := newConn(rw)
+	frameType, payload, err := c.readFrame()
+	if err != nil {
+		return "", err
+	}
+	if frameType != frameRequest || len(payload) == 0 {
+		return "", fmt.Errorf("remote: unexpected frame %v, expected REQUEST", frameType)
+	}
+	if payload[0] != ProtocolVersion {
+		err := fmt.Errorf("remote: unsupported protocol version %v", payload[0])
+		c.writeError(err)
+		return "", err
+	}
+	if c.r.Buffered() > 0 {
+		return "", fmt.Errorf("remote: sender did not wait for the signature")
+	}
+	return string(payload[1:]), nil
+}
+
+// Receive updates the first oldSize bytes of oldData with the data a sender pushes on rw, after ReadRequest, and writes the result to newData. It sends the sender the hash of the new data once the delta is applied and verified.
+func Receive(rw io.ReadWriter, oldData io.ReaderAt, oldSize int64, newData io.Writer) error {
+	return receive(rw, oldData, oldSize, newData, nil)
+}
+
+// receive is Receive, but calls commit, if not nil, before confirming the hash to the sender.
+func receive(rw io.ReadWriter, oldData io.ReaderAt, oldSize int64, newData io.Writer, commit func() error) error {
+	c := newConn(rw)
+
+	opts := rsync.SignatureOptions{
+		BlockSize:  rsync.BlockSizeFor(oldSize),
+		StrongHash: rsync.BLAKE2b,
+		StrongLen:  16,
+	}
+	sigStream := streamWriter{c: c}
+	err := rsync.WriteLibrsyncSignature(sigStream, io.NewSectionReader(oldData, 0, oldSize), opts)
+	if err != nil {
+		c.writeError(err)
+		return err
+	}
+	if err := sigStream.Close(); err != nil {
+		return err
+	}
+
+	hash, err := receiveDelta(c, oldData, newData)
+	if err == nil && commit != nil {
+		err = commit()
+	}
+	if err != nil {
+		c.writeError(err)
+		return err
+	}
+
+	if err := c.writeFrame(frameDone, hash); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// receiveDelta reads the delta and applies it to oldData, returning the hash of the new data. The delta is read to its end even if applying it fails, so that the sender is not left writing it.
+func receiveDelta(c *conn, oldData io.ReaderAt, newData io.Writer) ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deltaStream := &streamReader{c: c}
+	opc := make(chan rsync.Op, 64)
+	errc := make(chan error, 1)
+	patchErr := make(chan error, 1)
+	go func() {
+		patchErr <- rsync.PatchContext(ctx, oldData, opc, errc, newData)
+	}()
+
+	var hash []byte
+	var err error
+	dec := rsync.NewDecoder(deltaStream)
+	for err == nil {
+		var op rsync.Op
+		decodeErr := dec.Decode(&op)
+		if decodeErr != nil {
+			if decodeErr == io.EOF {
+				decodeErr = nil
+			}
+			close(opc)
+			errc <- decodeErr
+			err = <-patchErr
+			break
+		}
+		if op.OpCode == rsync.EOF {
+			hash = op.Data
+		}
+
+		select {
+		case opc <- op:
+		case err = <-patchErr:
+			// Patch failed before reading all ops
+		}
+	}
+	if err != nil {
+		cancel()
+		io.Copy(ioutil.Discard, deltaStream)
+		return nil, err
+	}
+	if hash == nil {
+		return nil, fmt.Errorf("%w, remote delta has no EOF op", rsync.ErrCorruptDelta)
+	}
+	return hash, nil
+}
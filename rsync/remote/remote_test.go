@@ -0,0 +1,164 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createFakeData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPushReceive(t *testing.T) {
+	oldData := createFakeData(t, 300*1024)
+	newData := append(append(append([]byte(nil), oldData[:100*1024]...), createFakeData(t, 5000)...), oldData[150*1024:]...)
+
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	receiverErr := make(chan error, 1)
+	patchedData := new(bytes.Buffer)
+	go func() {
+		name, err := ReadRequest(receiverConn)
+		if err == nil && name != "a/file" {
+			t.Errorf("expected name %q, got %q", "a/file", name)
+		}
+		if err == nil {
+			err = Receive(receiverConn, bytes.NewReader(oldData), int64(len(oldData)), patchedData)
+		}
+		receiverErr <- err
+	}()
+
+	err := Push(senderConn, "a/file", bytes.NewReader(newData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-receiverErr; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), newData) {
+		t.Error("received data is not equal to the new data")
+	}
+}
+
+// failingReader returns an error after some data.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrClosedPipe
+	}
+	return n, err
+}
+
+func TestPushError(t *testing.T) {
+	oldData := createFakeData(t, 100*1024)
+
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	receiverErr := make(chan error, 1)
+	go func() {
+		_, err := ReadRequest(receiverConn)
+		if err == nil {
+			err = Receive(receiverConn, bytes.NewReader(oldData), int64(len(oldData)), ioutil.Discard)
+		}
+		receiverErr <- err
+	}()
+
+	err := Push(senderConn, "file", &failingReader{r: bytes.NewReader(oldData)})
+	if err != io.ErrClosedPipe {
+		t.Errorf("expected %v, got %v", io.ErrClosedPipe, err)
+	}
+	if _, ok := (<-receiverErr).(*RemoteError); !ok {
+		t.Error("expected the receiver to get the sender error")
+	}
+}
+
+func TestServer(t *testing.T) {
+	root, err := ioutil.TempDir("", "remote-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := &Server{Root: root}
+	go server.Serve(l)
+
+	push := func(name string, data []byte) error {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return Push(conn, name, bytes.NewReader(data))
+	}
+
+	// new file, then an update of it
+	versions := [][]byte{createFakeData(t, 200*1024)}
+	versions = append(versions, append(createFakeData(t, 1000), versions[0]...))
+	for _, data := range versions {
+		if err := push("dir/file", data); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadFile(filepath.Join(root, "dir", "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored, data) {
+			t.Error("stored data is not equal to the pushed data")
+		}
+	}
+
+	for _, name := range []string{"../file", "/etc/file", "", "dir/../../file"} {
+		err := push(name, []byte("data"))
+		if _, ok := err.(*RemoteError); !ok {
+			t.Errorf("%q: expected a RemoteError, got %v", name, err)
+		}
+	}
+
+	// symbolic links in the root can lead to directories in it, but not outside of it
+	outside, err := ioutil.TempDir("", "remote-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(root, "outside")); err != nil {
+		t.Skip("skipped, cannot create symbolic links: ", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "dir"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"outside/file", "outside/new/file"} {
+		err := push(name, []byte("data"))
+		if _, ok := err.(*RemoteError); !ok {
+			t.Errorf("%q: expected a RemoteError, got %v", name, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("expected no files written outside of the root, got %v", len(files))
+	}
+	if err := push("inside/other", []byte("data")); err != nil {
+		t.Errorf("expected a push through a symbolic link in the root to work, got %v", err)
+	}
+}
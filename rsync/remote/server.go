@@ -0,0 +1,141 @@
+package remote
+
+import (
+	"fmt"
+	"github.com/mateusbraga/saveit/rsync"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Server receives the files senders push, and updates them in Root. The protocol has no authentication: anyone who can connect can create or overwrite any file in Root, so only serve it to trusted peers, on a trusted network or through an authenticated tunnel.
+type Server struct {
+	// Root is the directory of the files. Names pushed are relative to it, and cannot reach outside of it.
+	Root string
+}
+
+// Serve accepts connections on l and serves each one in its own goroutine, until l.Accept returns an error.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.ServeConn(conn); err != nil {
+				log.Printf("remote: %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single push on rw. The file is only replaced once the new data is verified. A file that does not exist yet is created, as if its old data was empty.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	name, err := ReadRequest(rw)
+	if err != nil {
+		return err
+	}
+	path, err := s.path(name)
+	if err != nil {
+		newConn(rw).writeError(err)
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		newConn(rw).writeError(err)
+		return err
+	}
+	oldFile, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		newConn(rw).writeError(err)
+		return err
+	}
+	var oldData io.ReaderAt = strings.NewReader("")
+	var oldSize int64
+	if oldFile != nil {
+		defer oldFile.Close()
+		fi, err := oldFile.Stat()
+		if err != nil {
+			newConn(rw).writeError(err)
+			return err
+		}
+		oldData, oldSize = oldFile, fi.Size()
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".saveit-")
+	if err != nil {
+		newConn(rw).writeError(err)
+		return err
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+
+	// leaves the zeros of ZERO ops as holes
+	tempBuffer := rsync.NewSparseWriter(tempFile)
+
+	commit := func() error {
+		if err := tempBuffer.Flush(); err != nil {
+			return err
+		}
+		if err := tempFile.Sync(); err != nil {
+			return err
+		}
+		if oldFile != nil {
+			if fi, err := oldFile.Stat(); err == nil {
+				tempFile.Chmod(fi.Mode())
+			}
+		}
+		return os.Rename(tempFile.Name(), path)
+	}
+	return receive(rw, oldData, oldSize, tempBuffer, commit)
+}
+
+// path returns the path in Root of the file called name. Names that lead outside of Root, lexically or through a symbolic link in it, are rejected.
+func (s *Server) path(name string) (string, error) {
+	cleanName := filepath.Clean(filepath.FromSlash(name))
+	if name == "" || filepath.IsAbs(cleanName) || cleanName == "." || cleanName == ".." || strings.HasPrefix(cleanName, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("remote: invalid name %q", name)
+	}
+	path := filepath.Join(s.Root, cleanName)
+
+	root, err := resolveDir(s.Root)
+	if err != nil {
+		return "", err
+	}
+	dir, err := resolveDir(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("remote: invalid name %q, it leads outside of the root through a symbolic link", name)
+	}
+	return path, nil
+}
+
+// resolveDir returns dir with its symbolic links resolved. The directories that do not exist yet are kept as they are, as ServeConn creates them.
+func resolveDir(dir string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err == nil {
+		return resolved, nil
+	}
+	// a broken symbolic link exists, but cannot be resolved
+	if _, lerr := os.Lstat(dir); !os.IsNotExist(lerr) {
+		return "", err
+	}
+	parent := filepath.Dir(dir)
+	if parent == dir {
+		return "", err
+	}
+	resolvedParent, err := resolveDir(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(dir)), nil
+}
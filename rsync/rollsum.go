@@ -0,0 +1,55 @@
+package rsync
+
+// rollsumCharOffset is added to every byte by rollsum, as in librsync.
+const rollsumCharOffset = 31
+
+func newRollsum(blockSize int) *rollsum {
+	d := &rollsum{window: window{data: make([]byte, blockSize)}}
+	d.Reset()
+	return d
+}
+
+// rollsum is the rolling checksum of librsync. It adds rollsumCharOffset to every byte, so its sums differ from those of the checksum of the rsync tech report and of rsync itself. Unlike weakChecksum, its sums are kept modulo 2^16 instead of modulo a prime. It rolls over windows of len(data) bytes.
+type rollsum struct {
+	s1, s2 uint32
+	window
+}
+
+func (d *rollsum) Reset() {
+	d.s1 = 0
+	d.s2 = 0
+	d.reset()
+}
+
+func (d *rollsum) Write(p []byte) (int, error) {
+	d.write(p, d.addData, d.Roll)
+	return len(p), nil
+}
+
+func (d *rollsum) Roll(out []byte, in []byte, sums []uint32) {
+	s1, s2 := d.s1, d.s2
+	blockSize := uint32(len(d.data))
+	for i, x := range in {
+		oldByte := uint32(out[i])
+		s1 += uint32(x) - oldByte
+		s2 += s1 - blockSize*(oldByte+rollsumCharOffset)
+		sums[i] = s2<<16 | s1&0xffff
+	}
+	d.s1, d.s2 = s1, s2
+}
+
+func (d *rollsum) Sum32() uint32 { return d.s2<<16 | d.s1&0xffff }
+
+// getRollsum returns the rollsum of data.
+func getRollsum(data []byte) uint32 {
+	d := newRollsum(0)
+	d.addData(data)
+	return d.Sum32()
+}
+
+func (d *rollsum) addData(p []byte) {
+	for _, x := range p {
+		d.s1 += uint32(x) + rollsumCharOffset
+		d.s2 += d.s1
+	}
+}
@@ -2,26 +2,38 @@
 //
 // rsync is defined in http://rsync.samba.org/tech_report/tech_report.html.
 //
-// To update a file from an old version to a new one using rsync involves creating a Signature of the old version, using it to create a Delta between the versions (Delta(Signature, newData)), and then applying the Delta to the old version (Patch(oldData, Delta)). This workflow allows for the files to be on different nodes, requiring the exchange of only the Signature and the Delta between the nodes.
+// To update a file from an old version to a new one using rsync involves creating a Signature of the old version, using it to create a Delta between the versions (Delta(Signature, newData)), and then applying the Delta to the old version (Patch(oldData, Delta)). This workflow allows for the files to be on different nodes, requiring the exchange of only the Signature and the Delta between the nodes. Package remote implements that exchange over a connection.
+//
+// Delta looks up blocks through a SignatureIndex. For very large files, a CompactSignature keeps the blocks on disk, sorted, instead of in memory.
+//
+// ChunkSignature and ChunkDelta are an alternative to Signature and Delta that cut the data into content-defined chunks instead of fixed size blocks. They are faster when a lot of data is inserted, and their delta is applied by Patch too.
 package rsync
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/mateusbraga/saveit/progress"
 	"hash"
 	"io"
-	"log"
+	"math"
 )
 
 const (
-	// Beware when changing BlockSize. BlockSize * a byte should never overflow an uint32, otherwise weakChecksum will misbehave.
+	// DefaultBlockSize is the block size used when none is given.
+	DefaultBlockSize = 1024 * 64
 
-	BlockSize = 1024 * 64
+	// MinBlockSize and MaxBlockSize bound the block sizes picked by BlockSizeFor and accepted by NewSignatureWriterSize. MaxBlockSize * a byte should never overflow an uint32, otherwise weakChecksum will misbehave.
+	MinBlockSize = 256
+	MaxBlockSize = 1024 * 1024 * 16
 
 	deltaFuncBuffer = 512
+
+	// maxCopyBuffer is the largest read Patch does at once to serve a COPY op.
+	maxCopyBuffer = 1024 * 1024 * 8
 )
 
 // Op opcodes.
@@ -32,6 +44,25 @@ const (
 	RAW_DATA
 	// END_OF_FILE
 	EOF
+	// Block size of the signature used to create the delta, in Index. It comes before any BLOCK op.
+	BLOCK_SIZE
+	// Range of old file to copy, in Offset and Length.
+	COPY
+	// Length and SHA-1 digest of the old data the delta was created against, in Length and Data. It comes before any BLOCK or COPY op, so that Patch checks the old data before writing anything.
+	BASIS_DIGEST
+	// Run of zero bytes, in Length. Patch skips it with a seek when writing to the end of a file, so the file keeps a hole there.
+	ZERO
+)
+
+var (
+	// ErrBasisMismatch is returned when the old data is not the one a delta or a signature was created from.
+	ErrBasisMismatch = errors.New("rsync: old data does not match the basis of the delta or signature")
+	// ErrChecksumMismatch is returned when the data created by a patch does not have the hash the delta ends with.
+	ErrChecksumMismatch = errors.New("rsync: hash of data created does not match hash of original data")
+	// ErrCorruptDelta is wrapped by the errors returned for deltas that cannot be decoded or applied, whatever their format. Check for it with errors.Is.
+	ErrCorruptDelta = errors.New("rsync: corrupt delta")
+	// ErrCorruptSignature is wrapped by the errors returned for signatures that cannot be decoded or used, whatever their format. Check for it with errors.Is.
+	ErrCorruptSignature = errors.New("rsync: corrupt signature")
 )
 
 // Op describes an operation to build a file being patched/copied.
@@ -39,9 +70,17 @@ type Op struct {
 	OpCode int
 	Data   []byte
 	Index  int
+	Offset int64
+	Length int64
+	// Basis is the old data BLOCK and COPY ops refer to, for deltas against a MultiSignature. It is 0 for deltas against a single Signature.
+	Basis int
 }
 
 func (op Op) String() string {
+	if op.Basis != 0 && (op.OpCode == BLOCK || op.OpCode == COPY || op.OpCode == BASIS_DIGEST) {
+		return fmt.Sprintf("%v of basis %v", Op{OpCode: op.OpCode, Index: op.Index, Offset: op.Offset, Length: op.Length, Data: op.Data}, op.Basis)
+	}
+
 	switch op.OpCode {
 	case BLOCK:
 		return fmt.Sprintf("BLOCK %v", op.Index)
@@ -49,49 +88,175 @@ func (op Op) String() string {
 		return fmt.Sprintf("RAW_DATA %v bytes", len(op.Data))
 	case EOF:
 		return fmt.Sprintf("EOF sha1=%v", hex.EncodeToString(op.Data))
+	case BLOCK_SIZE:
+		return fmt.Sprintf("BLOCK_SIZE %v", op.Index)
+	case COPY:
+		return fmt.Sprintf("COPY %v bytes at %v", op.Length, op.Offset)
+	case BASIS_DIGEST:
+		return fmt.Sprintf("BASIS_DIGEST %v bytes sha1=%v", op.Length, hex.EncodeToString(op.Data))
+	case ZERO:
+		return fmt.Sprintf("ZERO %v bytes", op.Length)
 	default:
 		return fmt.Sprintf("Invalid OpCode %v", op.OpCode)
 	}
 }
 
 // Signature contains the block checksums used to find differences between two files
-type Signature map[uint32]map[[md5.Size]byte]int
+type Signature struct {
+	// BlockSize is the size of the blocks the checksums were computed over.
+	BlockSize int
+	// WeakHash is the rolling hash used for the weak checksums.
+	WeakHash WeakHash
+	// StrongHash is the hash used for the strong checksums, truncated to StrongLen bytes.
+	StrongHash StrongHash
+	StrongLen  int
+	// Blocks maps the weak checksum of a block to the strong checksums of the blocks with that weak checksum, and those to the block index.
+	Blocks map[uint32]map[string]int
+	// Length is the length of the data.
+	Length int64
+	// TailLength is the length of the last block: BlockSize, unless Length is not a multiple of it.
+	TailLength int
+	// Digest is the SHA-1 hash of the data, as in the EOF op of a delta that creates it. Length and TailLength are only known if Digest is set: signatures of older versions and librsync signatures do not have them.
+	Digest []byte
+	// blockCount is the number of blocks of the data, as far as the signature tells, counted as it is built or read by this package. See BlockCount.
+	blockCount int64
+}
+
+// SignatureOptions configures how a Signature is created. The zero value uses DefaultBlockSize, Adler32 weak checksums and full length MD5 strong checksums.
+type SignatureOptions struct {
+	// BlockSize is the size of the blocks. If 0, DefaultBlockSize is used. See BlockSizeFor.
+	BlockSize int
+	// WeakHash is the rolling hash used for the weak checksum of each block.
+	WeakHash WeakHash
+	// StrongHash is the hash used for the strong checksum of each block.
+	StrongHash StrongHash
+	// StrongLen truncates the strong checksums to StrongLen bytes. If 0, the full hash is used.
+	StrongLen int
+	// Workers is the number of goroutines NewSignatureReaderAt hashes blocks with. If 0, runtime.GOMAXPROCS(0) is used. Other functions hash blocks sequentially and ignore it.
+	Workers int
+	// Progress, if not nil, counts the bytes hashed. It is not part of the options a signature records.
+	Progress *progress.Meter
+}
 
-// NewSignature creates the Signature of the data.
+// NewSignature creates the Signature of the data using DefaultBlockSize.
 func NewSignature(data io.Reader) (Signature, error) {
-	sigWriter := NewSignatureWriter()
-	_, err := io.Copy(sigWriter, data)
+	return NewSignatureOptions(data, SignatureOptions{})
+}
+
+// NewSignatureSize creates the Signature of the data using blocks of blockSize bytes. See BlockSizeFor.
+func NewSignatureSize(data io.Reader, blockSize int) (Signature, error) {
+	return NewSignatureOptions(data, SignatureOptions{BlockSize: blockSize})
+}
+
+// NewSignatureOptions creates the Signature of the data as configured by opts.
+func NewSignatureOptions(data io.Reader, opts SignatureOptions) (Signature, error) {
+	sigWriter, err := NewSignatureWriterOptions(opts)
 	if err != nil {
-		return nil, err
+		return Signature{}, err
+	}
+	_, err = io.Copy(sigWriter, data)
+	if err != nil {
+		return Signature{}, err
 	}
 
 	return sigWriter.Signature(), nil
 }
 
+// BlockSizeFor returns a block size suited for data of size bytes. Like librsync, it uses the square root of size, rounded up to a multiple of 128 bytes and kept between MinBlockSize and MaxBlockSize. Use DefaultBlockSize if the size is unknown.
+func BlockSizeFor(size int64) int {
+	if size < 0 {
+		return DefaultBlockSize
+	}
+	blockSize := int(math.Ceil(math.Sqrt(float64(size))))
+	blockSize = (blockSize + 127) &^ 127
+	if blockSize < MinBlockSize {
+		return MinBlockSize
+	}
+	if blockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return blockSize
+}
+
 type SignatureWriter struct {
-	rollingWeakHash *weakChecksum
-	md5Hash         hash.Hash
+	rollingWeakHash RollingHash
+	strongHash      hash.Hash
+	strongBuf       []byte
 	multiwriter     io.Writer
 	sig             Signature
 	n               int
 	currentIndex    int
+	// digest and length are of all the data written
+	digest   hash.Hash
+	length   int64
+	progress *progress.Meter
 }
 
+// NewSignatureWriter returns a SignatureWriter that uses DefaultBlockSize.
 func NewSignatureWriter() *SignatureWriter {
-	rollingWeakHash := newWeakChecksum()
-	md5Writer := md5.New()
+	w, _ := NewSignatureWriterOptions(SignatureOptions{})
+	return w
+}
+
+// NewSignatureWriterSize returns a SignatureWriter that uses blocks of blockSize bytes. It returns an error if blockSize is not between 1 and MaxBlockSize.
+func NewSignatureWriterSize(blockSize int) (*SignatureWriter, error) {
+	return NewSignatureWriterOptions(SignatureOptions{BlockSize: blockSize})
+}
+
+// NewSignatureWriterOptions returns a SignatureWriter configured by opts. It returns an error if opts is invalid.
+func NewSignatureWriterOptions(opts SignatureOptions) (*SignatureWriter, error) {
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize < 0 || blockSize > MaxBlockSize {
+		return nil, fmt.Errorf("rsync: invalid block size %v", blockSize)
+	}
+	strongHash, err := opts.StrongHash.New()
+	if err != nil {
+		return nil, err
+	}
+	strongLen := opts.StrongLen
+	if strongLen == 0 {
+		strongLen = strongHash.Size()
+	}
+	if strongLen < 0 || strongLen > strongHash.Size() {
+		return nil, fmt.Errorf("rsync: invalid strong checksum length %v for %v", strongLen, opts.StrongHash)
+	}
+
+	rollingWeakHash, err := opts.WeakHash.New(blockSize)
+	if err != nil {
+		return nil, err
+	}
 	return &SignatureWriter{
 		rollingWeakHash: rollingWeakHash,
-		md5Hash:         md5Writer,
-		multiwriter:     io.MultiWriter(rollingWeakHash, md5Writer),
-		sig:             make(map[uint32]map[[md5.Size]byte]int),
-		n:               0,
-		currentIndex:    0,
-	}
+		strongHash:      strongHash,
+		strongBuf:       make([]byte, 0, strongHash.Size()),
+		multiwriter:     io.MultiWriter(rollingWeakHash, strongHash),
+		sig: Signature{
+			BlockSize:  blockSize,
+			WeakHash:   opts.WeakHash,
+			StrongHash: opts.StrongHash,
+			StrongLen:  strongLen,
+			Blocks:     make(map[uint32]map[string]int),
+		},
+		n:            0,
+		currentIndex: 0,
+		digest:       sha1.New(),
+		progress:     opts.Progress,
+	}, nil
 }
 
 func (w *SignatureWriter) Write(buf []byte) (int, error) {
-	remaining := BlockSize - w.n
+	w.digest.Write(buf)
+	w.length += int64(len(buf))
+	w.progress.Add(int64(len(buf)))
+	return w.writeBlocks(buf)
+}
+
+// writeBlocks adds the checksums of the blocks buf completes.
+func (w *SignatureWriter) writeBlocks(buf []byte) (int, error) {
+	remaining := w.sig.BlockSize - w.n
 	if len(buf) < remaining {
 		n, err := w.multiwriter.Write(buf)
 		w.n += n
@@ -103,180 +268,203 @@ func (w *SignatureWriter) Write(buf []byte) (int, error) {
 			return n, err
 		}
 
-		weak := w.rollingWeakHash.Sum32()
-		var strong [md5.Size]byte
-		w.md5Hash.Sum(strong[0:0:md5.Size])
-		m, ok := w.sig[weak]
-		if !ok {
-			m = make(map[[md5.Size]byte]int)
-			w.sig[weak] = m
-		}
-		_, ok2 := m[strong]
-		if !ok2 {
-			m[strong] = w.currentIndex
-		}
+		w.addBlock()
 
 		w.rollingWeakHash.Reset()
-		w.md5Hash.Reset()
+		w.strongHash.Reset()
 		w.n = 0
 		w.currentIndex++
 
-		secondWriteN, err := w.Write(buf[remaining:])
+		secondWriteN, err := w.writeBlocks(buf[remaining:])
 		return n + secondWriteN, err
 	}
 }
 
 func (w *SignatureWriter) Signature() Signature {
 	if w.n != 0 {
-		weak := w.rollingWeakHash.Sum32()
-		var strong [md5.Size]byte
-		w.md5Hash.Sum(strong[0:0:md5.Size])
-		m, ok := w.sig[weak]
-		if !ok {
-			m = make(map[[md5.Size]byte]int)
-			w.sig[weak] = m
-		}
-		_, ok2 := m[strong]
-		if !ok2 {
-			m[strong] = w.currentIndex
-		}
+		w.addBlock()
 	}
+	w.sig.setLength(w.length, w.digest.Sum(nil))
 	return w.sig
 }
 
-// Delta returns a chan with the operations required to update the old data to be equal the new data. It closes the rsync.Op channel when it's done. If the newData Reader returns an error, the error is sent through the error channel before the rsync.Op channel is closed. See Patch.
-func Delta(oldDataSignature Signature, newData io.Reader) (<-chan Op, <-chan error) {
+// setLength records the length and the digest of the data.
+func (sig *Signature) setLength(length int64, digest []byte) {
+	sig.Length = length
+	sig.TailLength = int(length % int64(sig.BlockSize))
+	if sig.TailLength == 0 && length > 0 {
+		sig.TailLength = sig.BlockSize
+	}
+	sig.Digest = digest
+}
+
+// addBlock adds the checksums of the current block to the signature.
+func (w *SignatureWriter) addBlock() {
+	weak, strong := w.sum()
+	w.sig.addBlock(weak, strong, w.currentIndex)
+}
+
+// sum returns the weak and the truncated strong checksums of the current block.
+func (w *SignatureWriter) sum() (uint32, string) {
+	return w.rollingWeakHash.Sum32(), string(w.strongHash.Sum(w.strongBuf[:0])[:w.sig.StrongLen])
+}
+
+// addBlock adds the checksums of the block with the given index, unless a block with the same checksums is already there.
+func (sig *Signature) addBlock(weak uint32, strong string, index int) {
+	m, ok := sig.Blocks[weak]
+	if !ok {
+		m = make(map[string]int)
+		sig.Blocks[weak] = m
+	}
+	_, ok2 := m[strong]
+	if !ok2 {
+		m[strong] = index
+	}
+	if int64(index)+1 > sig.blockCount {
+		sig.blockCount = int64(index) + 1
+	}
+}
+
+// Delta returns a chan with the operations required to update the old data to be equal the new data. It uses the block size and hashes recorded in oldDataSignature and sends it first as a BLOCK_SIZE op. Matched blocks that follow each other in both the old and the new data are sent as a single COPY op. It closes the rsync.Op channel when it's done. If the newData Reader or oldDataSignature returns an error, the error is sent through the error channel before the rsync.Op channel is closed. The ops must be read until the channel is closed, use DeltaContext to be able to stop early. See Patch and DeltaReader.
+func Delta(oldDataSignature SignatureIndex, newData io.Reader) (<-chan Op, <-chan error) {
+	return DeltaContext(context.Background(), oldDataSignature, newData)
+}
+
+// DeltaContext is like Delta, but stops when ctx is done, sending ctx.Err() through the error channel. Cancel ctx to stop reading the ops before the rsync.Op channel is closed, for example after PatchContext fails, so the goroutine creating them exits. If ctx carries a progress.Meter, the bytes read from newData, the blocks matched and the literal bytes are counted in it. PatchContext counts the blocks and bytes again, so do not give it the same Meter.
+func DeltaContext(ctx context.Context, oldDataSignature SignatureIndex, newData io.Reader) (<-chan Op, <-chan error) {
+	return sendOps(ctx, NewDeltaReader(oldDataSignature, progress.FromContext(ctx).Reader(newData)).Next)
+}
+
+// sendOps sends the ops returned by next through the returned channel until next returns io.EOF, an error or ctx is done. The error, or nil, is sent through the error channel before the rsync.Op channel is closed. The ops are counted in the progress.Meter of ctx.
+func sendOps(ctx context.Context, next func() (Op, error)) (<-chan Op, <-chan error) {
 	errc := make(chan error, 1)
 	resultChan := make(chan Op, deltaFuncBuffer)
 
 	go func() {
 		defer close(resultChan)
 
-		rollingWeakHash := newWeakChecksum()
-		sha1Writer := sha1.New()
-		dataBeingProcessed := bytes.NewBuffer(make([]byte, 0, BlockSize))
-		multiwriter := io.MultiWriter(dataBeingProcessed, rollingWeakHash, sha1Writer)
-		aByteSlice := make([]byte, 1)
-		aBlockSizeSlice := make([]byte, BlockSize)
-
-	startMatchSearchLoop:
+		meter := progress.FromContext(ctx)
+		blockSize := DefaultBlockSize
 		for {
-			// rollingWeakHash and dataBeingProcessed is in Reset() state at this point. It means it will try to find a block match after reading a BlockSize at once, instead of byte by byte, as later
-			_, err := readFullAndCopyN(multiwriter, newData, aBlockSizeSlice)
+			op, err := next()
 			if err == io.EOF {
-				// could not form a block, leave this big loop and send remaining data
-				break startMatchSearchLoop
+				errc <- nil
+				return
 			}
 			if err != nil {
 				errc <- err
 				return
 			}
-
-			weak := rollingWeakHash.Sum32()
-			possibleBlocks, found := oldDataSignature[weak]
-			for {
-				if found {
-					// found weakChecksum match, check strongChecksum
-					buf := dataBeingProcessed.Bytes()
-					block := buf[len(buf)-BlockSize : len(buf)]
-					strong := md5.Sum(block)
-					index, found2 := possibleBlocks[strong]
-					if found2 {
-						// found strongChecksum match, send unmatched data then block index that matched
-						numberOfBytesNotMatched := len(buf) - BlockSize
-						if numberOfBytesNotMatched > 0 {
-							dataToSend := make([]byte, numberOfBytesNotMatched)
-							copy(dataToSend, buf[0:numberOfBytesNotMatched])
-							newDataRsyncOp := Op{
-								OpCode: RAW_DATA,
-								Data:   dataToSend,
-							}
-							resultChan <- newDataRsyncOp
-						}
-						newBlockRsyncOp := Op{
-							OpCode: BLOCK,
-							Index:  index,
-						}
-						resultChan <- newBlockRsyncOp
-
-						rollingWeakHash.Reset()
-						dataBeingProcessed.Reset()
-						// continue trying to find matches for the following blocks
-						continue startMatchSearchLoop
-					}
-					log.Println("false negative")
-					// false negative of weakChecksum
-					// continue trying to find a weakChecksum match byte by byte
-				}
-
-				// send partial data if a BlockSize of data did not match
-				if dataBeingProcessed.Len() >= 2*BlockSize {
-					dataToSend := make([]byte, BlockSize)
-					// error here is impossible, we just asked dataBeingProcessed.Len()
-					io.ReadFull(dataBeingProcessed, dataToSend)
-					newDataRsyncOp := Op{
-						OpCode: RAW_DATA,
-						Data:   dataToSend,
-					}
-					resultChan <- newDataRsyncOp
-				}
-
-				// incremental search for match (will read one byte per time)
-				_, err := readFullAndCopyN(multiwriter, newData, aByteSlice)
-				if err == io.EOF {
-					// could not read another byte to form a block, exit big loop and send remaining data
-					break startMatchSearchLoop
-				}
-				if err != nil {
-					errc <- err
-					return
-				}
-
-				weak := rollingWeakHash.Sum32()
-				possibleBlocks, found = oldDataSignature[weak]
+			if op.OpCode == BLOCK_SIZE && op.Index > 0 {
+				blockSize = op.Index
 			}
-		}
+			countOp(meter, op, blockSize)
 
-		// send remaining data
-		if dataBeingProcessed.Len() > 0 {
-			dataToSend := make([]byte, dataBeingProcessed.Len())
-			copy(dataToSend, dataBeingProcessed.Bytes())
-			newDataRsyncOp := Op{
-				OpCode: RAW_DATA,
-				Data:   dataToSend,
+			select {
+			case resultChan <- op:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
 			}
-			resultChan <- newDataRsyncOp
-		}
-		//send EOF op
-		EOFOp := Op{
-			OpCode: EOF,
-			Data:   sha1Writer.Sum(nil),
 		}
-		resultChan <- EOFOp
-
-		errc <- nil
 	}()
 
 	return resultChan, errc
 }
 
-// Patch applies the operations from opsChan with oldData and writes resulting data to newData. It also makes sure that the resulting data sha1 hash matches the original data sha1 hash, returning an error otherwise. In case of error, the newData Writer may have incomplete data. See Delta.
+// DeltaArrayToChan returns ops as the channels returned by Delta. The channels are buffered, so nothing leaks if they are not read to the end.
+func DeltaArrayToChan(ops []Op) (<-chan Op, <-chan error) {
+	opc := make(chan Op, len(ops))
+	for _, op := range ops {
+		opc <- op
+	}
+	close(opc)
+
+	closedErrChan := make(chan error)
+	close(closedErrChan)
+
+	return opc, closedErrChan
+}
+
+// countOp counts the blocks matched, as DeltaStats does, or the literal bytes of op in meter. blockSize is the block size of the last BLOCK_SIZE op.
+func countOp(meter *progress.Meter, op Op, blockSize int) {
+	switch op.OpCode {
+	case BLOCK:
+		meter.AddMatched(1, int64(blockSize))
+	case COPY:
+		_, n := matchedBlocks(op.Offset, op.Length, blockSize)
+		meter.AddMatched(n, op.Length)
+	case RAW_DATA:
+		meter.AddLiteral(int64(len(op.Data)))
+	}
+}
+
+// Patch applies the operations from opsChan with oldData and writes resulting data to newData. BLOCK ops use the block size of the last BLOCK_SIZE op, or DefaultBlockSize if there was none. BLOCK and COPY ops that reach the end of oldData copy only the data that is there. If newData is an *os.File of a regular file written at its end, or a SparseWriter of one, the zeros of ZERO ops are skipped with a seek, leaving holes, instead of being written. It also makes sure that the resulting data sha1 hash matches the original data sha1 hash, returning an error otherwise. If the delta has a BASIS_DIGEST op, oldData is read in full to check it first, and ErrBasisMismatch is returned if it is not the old data the delta was created against. In case of error, the newData Writer may have incomplete data. See Delta.
 func Patch(oldData io.ReaderAt, opsChan <-chan Op, errc <-chan error, newData io.Writer) error {
+	return PatchContext(context.Background(), oldData, opsChan, errc, newData)
+}
+
+// PatchContext is like Patch, but stops when ctx is done, returning ctx.Err(). If it returns before opsChan is closed, the ops producer must be stopped by other means, like cancelling the context given to DeltaContext. If ctx carries a progress.Meter, the bytes written to newData, the blocks matched and the literal bytes are counted in it. DeltaContext counts the blocks and bytes too, so do not give it the same Meter.
+func PatchContext(ctx context.Context, oldData io.ReaderAt, opsChan <-chan Op, errc <-chan error, newData io.Writer) error {
+	resolve := func(basis int) (io.ReaderAt, error) {
+		if basis != 0 {
+			return nil, fmt.Errorf("rsync: unknown basis %v, delta is not against a single Signature", basis)
+		}
+		return oldData, nil
+	}
+	return patch(ctx, resolve, opsChan, errc, newData)
+}
+
+// patch is PatchContext and PatchMultiContext, resolving the old data of BLOCK and COPY ops with resolve.
+func patch(ctx context.Context, resolve func(basis int) (io.ReaderAt, error), opsChan <-chan Op, errc <-chan error, newData io.Writer) error {
+	meter := progress.FromContext(ctx)
 	sha1Writer := sha1.New()
-	multiwriter := io.MultiWriter(newData, sha1Writer)
+	multiwriter := io.MultiWriter(meter.Writer(newData), sha1Writer)
+	skipZeros := zeroSkipper(newData)
+
+	blockSize := DefaultBlockSize
+	var buf []byte
+	for {
+		var op Op
+		var ok bool
+		select {
+		case op, ok = <-opsChan:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !ok {
+			break
+		}
 
-	buf := make([]byte, BlockSize)
-	for op := range opsChan {
 		//log.Println(op)
+		countOp(meter, op, blockSize)
 		switch op.OpCode {
+		case BLOCK_SIZE:
+			if op.Index <= 0 || op.Index > MaxBlockSize {
+				return fmt.Errorf("%w, invalid block size %v", ErrCorruptDelta, op.Index)
+			}
+			blockSize = op.Index
 		case BLOCK:
-			n, err := oldData.ReadAt(buf, int64(op.Index*BlockSize))
+			if op.Index < 0 {
+				return fmt.Errorf("%w, invalid BLOCK %v", ErrCorruptDelta, op.Index)
+			}
+			oldData, err := resolve(op.Basis)
 			if err != nil {
-				if err != io.EOF {
-					return err
-				}
+				return err
 			}
-			_, err = multiwriter.Write(buf[:n])
+			err = patchCopy(multiwriter, oldData, int64(op.Index)*int64(blockSize), int64(blockSize), &buf)
+			if err != nil {
+				return err
+			}
+		case COPY:
+			if op.Offset < 0 || op.Length < 0 {
+				return fmt.Errorf("%w, invalid COPY of %v bytes at %v", ErrCorruptDelta, op.Length, op.Offset)
+			}
+			oldData, err := resolve(op.Basis)
+			if err != nil {
+				return err
+			}
+			err = patchCopy(multiwriter, oldData, op.Offset, op.Length, &buf)
 			if err != nil {
 				return err
 			}
@@ -285,48 +473,113 @@ func Patch(oldData io.ReaderAt, opsChan <-chan Op, errc <-chan error, newData io
 			if err != nil {
 				return err
 			}
+		case ZERO:
+			if op.Length < 0 {
+				return fmt.Errorf("%w, invalid ZERO of %v bytes", ErrCorruptDelta, op.Length)
+			}
+			if skipZeros == nil {
+				if err := writeZeros(multiwriter, op.Length); err != nil {
+					return err
+				}
+				break
+			}
+			if err := skipZeros(op.Length); err != nil {
+				return err
+			}
+			writeZeros(sha1Writer, op.Length)
+			meter.Add(op.Length)
+		case BASIS_DIGEST:
+			oldData, err := resolve(op.Basis)
+			if err != nil {
+				return err
+			}
+			if err := checkBasis(oldData, op.Length, op.Data); err != nil {
+				return err
+			}
 		case EOF:
 			h := sha1Writer.Sum(nil)
 			if bytes.Compare(h, op.Data) != 0 {
-				return fmt.Errorf("rsync: hash of data created does not match hash of original data")
+				return ErrChecksumMismatch
 			}
 		}
 	}
-	if err := <-errc; err != nil {
+	select {
+	case err := <-errc:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nil
 }
 
-// readFullAndCopyN does both what io.CopyN and io.ReadFull does at the same time. In case of EOF, it returns io.EOF instead of io.ErrUnexpectedEOF. If err == nil || err == io.EOF, everything written to dst is in buf[0:written]. On return, written == len(buf), if and only if err == nil.
-func readFullAndCopyN(dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
-	for {
-		nr, er := src.Read(buf[written:])
-		if nr > 0 {
-			nw, ew := dst.Write(buf[written : written+int64(nr)])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
+// patchCopy writes length bytes of oldData, starting at offset, to w. It reads up to maxCopyBuffer bytes at a time into *buf, growing it as needed. It stops without error at the end of oldData.
+func patchCopy(w io.Writer, oldData io.ReaderAt, offset int64, length int64, buf *[]byte) error {
+	for length > 0 {
+		if int64(len(*buf)) < length && len(*buf) < maxCopyBuffer {
+			if length < maxCopyBuffer {
+				*buf = make([]byte, length)
+			} else {
+				*buf = make([]byte, maxCopyBuffer)
 			}
 		}
-		if er == io.EOF {
-			err = io.EOF
-			break
+		chunk := *buf
+		if int64(len(chunk)) > length {
+			chunk = chunk[:length]
 		}
-		if er != nil {
-			err = er
-			break
+
+		n, err := oldData.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return err
 		}
-		if written == int64(len(buf)) {
-			break
+		_, werr := w.Write(chunk[:n])
+		if werr != nil {
+			return werr
 		}
+		if err == io.EOF {
+			return nil
+		}
+		offset += int64(n)
+		length -= int64(n)
+	}
+	return nil
+}
+
+// checkBasis returns ErrBasisMismatch unless oldData has length bytes with the SHA-1 digest digest.
+func checkBasis(oldData io.ReaderAt, length int64, digest []byte) error {
+	if length < 0 {
+		return fmt.Errorf("%w, invalid BASIS_DIGEST of %v bytes", ErrCorruptDelta, length)
+	}
+	h := sha1.New()
+	n, err := io.Copy(h, io.NewSectionReader(oldData, 0, length))
+	if err != nil {
+		return err
+	}
+	if n < length || !bytes.Equal(h.Sum(nil), digest) {
+		return ErrBasisMismatch
+	}
+	// and no more
+	n2, err := oldData.ReadAt(make([]byte, 1), length)
+	if n2 > 0 {
+		return ErrBasisMismatch
+	}
+	if err != nil && err != io.EOF {
+		return err
 	}
-	return written, err
+	return nil
+}
+
+// CheckBasis reads basis and returns ErrBasisMismatch if it is not the data sig was created from, by comparing their length and digest. It returns an error if sig does not record them.
+func CheckBasis(sig SignatureIndex, basis io.Reader) error {
+	length, digest := sig.BasisDigest()
+	if digest == nil {
+		return fmt.Errorf("rsync: signature does not record the length and digest of its basis")
+	}
+	h := sha1.New()
+	n, err := io.Copy(h, basis)
+	if err != nil {
+		return err
+	}
+	if n != length || !bytes.Equal(h.Sum(nil), digest) {
+		return ErrBasisMismatch
+	}
+	return nil
 }
@@ -3,9 +3,13 @@ package rsync
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -47,6 +51,234 @@ func TestRsync(t *testing.T) {
 	}
 }
 
+func TestRsyncBlockSize(t *testing.T) {
+	originalData, err := ioutil.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modifiedData, err := ioutil.ReadFile(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blockSize := range []int{MinBlockSize, 1000, BlockSizeFor(int64(len(originalData))), DefaultBlockSize} {
+		sig, err := NewSignatureSize(bytes.NewReader(originalData), blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.BlockSize != blockSize {
+			t.Errorf("expected signature block size %v, got %v", blockSize, sig.BlockSize)
+		}
+
+		opsChan, cerr := Delta(sig, bytes.NewReader(modifiedData))
+
+		patchedData := new(bytes.Buffer)
+		err = Patch(bytes.NewReader(originalData), opsChan, cerr, patchedData)
+		if err != nil {
+			t.Fatalf("Patch failed with block size %v: %v", blockSize, err)
+		}
+		if !bytes.Equal(patchedData.Bytes(), modifiedData) {
+			t.Errorf("patched data does not match modified data with block size %v", blockSize)
+		}
+	}
+}
+
+func TestRsyncWeakHash(t *testing.T) {
+	oldData := createFakeData(200 * 1024)
+	// low-entropy data, where Adler32 checksums collide
+	for i := 64 * 1024; i < 128*1024; i += 3 {
+		oldData[i] = 0
+	}
+	newData := modify(oldData, 0)
+
+	for _, weakHash := range []WeakHash{Adler32, Rollsum, Buzhash, RabinKarp} {
+		opts := SignatureOptions{BlockSize: 1000, WeakHash: weakHash}
+		sig, err := NewSignatureOptions(bytes.NewReader(oldData), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.WeakHash != weakHash {
+			t.Errorf("expected weak hash %v in the signature, got %v", weakHash, sig.WeakHash)
+		}
+		compactData := new(bytes.Buffer)
+		if err := WriteCompactSignature(compactData, bytes.NewReader(oldData), opts); err != nil {
+			t.Fatal(err)
+		}
+		compactSig, err := OpenCompactSignature(bytes.NewReader(compactData.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compactSig.Options().WeakHash != weakHash {
+			t.Errorf("expected weak hash %v in the compact signature, got %v", weakHash, compactSig.Options().WeakHash)
+		}
+
+		opsChan, cerr := Delta(compactSig, bytes.NewReader(newData))
+		patchedData := new(bytes.Buffer)
+		if err := Patch(bytes.NewReader(oldData), opsChan, cerr, patchedData); err != nil {
+			t.Fatalf("Patch failed with weak hash %v: %v", weakHash, err)
+		}
+		if !bytes.Equal(patchedData.Bytes(), newData) {
+			t.Errorf("patched data does not match new data with weak hash %v", weakHash)
+		}
+
+		if parsed, err := ParseWeakHash(weakHash.String()); err != nil || parsed != weakHash {
+			t.Errorf("expected ParseWeakHash(%q) to return %v, got %v, %v", weakHash.String(), weakHash, parsed, err)
+		}
+	}
+
+	if _, err := WeakHash(100).New(1000); err == nil {
+		t.Error("expected an error for an unknown weak hash")
+	}
+}
+
+func TestDeltaCoalescesBlocks(t *testing.T) {
+	// random data, so that no two blocks are the same
+	originalData := createFakeData(100*1024 + 100)
+	blockSize := 1024
+
+	sig, err := NewSignatureSize(bytes.NewReader(originalData), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var copies []Op
+	opsChan, cerr := Delta(sig, bytes.NewReader(originalData))
+	for op := range opsChan {
+		switch op.OpCode {
+		case BLOCK:
+			t.Errorf("expected matched blocks to be sent as COPY, got %v", op)
+		case COPY:
+			copies = append(copies, op)
+		}
+	}
+	if err := <-cerr; err != nil {
+		t.Fatal(err)
+	}
+
+	// the short last block is matched too
+	if len(copies) != 1 || copies[0].Offset != 0 || copies[0].Length != int64(len(originalData)) {
+		t.Errorf("expected a single COPY %v bytes at 0, got %v", len(originalData), copies)
+	}
+}
+
+func TestPatchCopy(t *testing.T) {
+	oldData := []byte("0123456789")
+	ops := []Op{
+		{OpCode: COPY, Offset: 5, Length: 3},
+		{OpCode: RAW_DATA, Data: []byte("ab")},
+		{OpCode: COPY, Offset: 0, Length: 4},
+		// reaches the end of oldData
+		{OpCode: COPY, Offset: 8, Length: 10},
+	}
+	opsChan, cerr := opsToChan(ops)
+
+	patchedData := new(bytes.Buffer)
+	err := Patch(bytes.NewReader(oldData), opsChan, cerr, patchedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "567ab012389"; patchedData.String() != expected {
+		t.Errorf("expected %q, got %q", expected, patchedData.String())
+	}
+}
+
+func TestDeltaReader(t *testing.T) {
+	originalData, err := ioutil.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modifiedData, err := ioutil.ReadFile(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := NewSignatureSize(bytes.NewReader(originalData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expectedOps []Op
+	opsChan, cerr := Delta(sig, bytes.NewReader(modifiedData))
+	for op := range opsChan {
+		expectedOps = append(expectedOps, op)
+	}
+	if err := <-cerr; err != nil {
+		t.Fatal(err)
+	}
+
+	deltaReader := NewDeltaReader(sig, bytes.NewReader(modifiedData))
+	for i := 0; ; i++ {
+		op, err := deltaReader.Next()
+		if err == io.EOF {
+			if i != len(expectedOps) {
+				t.Errorf("expected %v ops, got %v", len(expectedOps), i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(expectedOps) || !reflect.DeepEqual(op, expectedOps[i]) {
+			t.Fatalf("op %v: got %v", i, op)
+		}
+	}
+	if _, err := deltaReader.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the end, got %v", err)
+	}
+}
+
+func TestDeltaContextCancel(t *testing.T) {
+	data := createFakeData(1024 * 1024)
+	sig, err := NewSignatureSize(bytes.NewReader(nil), MinBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing matches, so Delta has more RAW_DATA ops to send than its channel buffers
+	ctx, cancel := context.WithCancel(context.Background())
+	opsChan, cerr := DeltaContext(ctx, sig, bytes.NewReader(data))
+	<-opsChan
+	cancel()
+
+	for range opsChan {
+	}
+	if err := <-cerr; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestPatchContextCancel(t *testing.T) {
+	// never sends an op
+	opsChan := make(chan Op)
+	cerr := make(chan error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := PatchContext(ctx, bytes.NewReader(nil), opsChan, cerr, ioutil.Discard)
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	tests := []struct {
+		size      int64
+		blockSize int
+	}{
+		{-1, DefaultBlockSize},
+		{0, MinBlockSize},
+		{1000, MinBlockSize},
+		{1000 * 1000, 1024},
+		{1 << 30, 1 << 15},
+		{1 << 50, MaxBlockSize},
+	}
+
+	for _, test := range tests {
+		if blockSize := BlockSizeFor(test.size); blockSize != test.blockSize {
+			t.Errorf("BlockSizeFor(%v): expected %v, got %v", test.size, test.blockSize, blockSize)
+		}
+	}
+}
+
 func BenchmarkRsyncComplete(b *testing.B) {
 	originalFile, err := ioutil.ReadFile(original)
 	if err != nil {
@@ -78,6 +310,46 @@ func BenchmarkRsyncComplete(b *testing.B) {
 	}
 }
 
+// BenchmarkDeltaHighChange measures the byte by byte search for matches: no block of the new data is in the old data.
+func BenchmarkDeltaHighChange(b *testing.B) {
+	benchmarkDelta(b, createFakeData(4*1024*1024), createFakeData(4*1024*1024))
+}
+
+// BenchmarkDeltaHalfChange changes a byte of every other block, so the search alternates between matches and misses.
+func BenchmarkDeltaHalfChange(b *testing.B) {
+	oldData := createFakeData(4 * 1024 * 1024)
+	newData := append([]byte(nil), oldData...)
+	for i := 0; i < len(newData); i += 2 * 2048 {
+		newData[i]++
+	}
+	benchmarkDelta(b, oldData, newData)
+}
+
+// BenchmarkDeltaLowChange measures the search when most blocks match.
+func BenchmarkDeltaLowChange(b *testing.B) {
+	oldData := createFakeData(4 * 1024 * 1024)
+	benchmarkDelta(b, oldData, modify(oldData, 0))
+}
+
+// benchmarkDelta measures the throughput of Delta of newData against the signature of oldData, with blocks of 2048 bytes.
+func benchmarkDelta(b *testing.B, oldData []byte, newData []byte) {
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(newData)))
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		opsChan, cerr := Delta(sig, bytes.NewReader(newData))
+		for range opsChan {
+		}
+		if err := <-cerr; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkRsyncNewSignature(b *testing.B) {
 	originalFile, err := ioutil.ReadFile(original)
 	if err != nil {
@@ -150,3 +422,93 @@ func Example() {
         log.Fatal("Patch failed:", err)
     }
 }
+
+func TestPatchBasisDigest(t *testing.T) {
+	oldData := createFakeData(20 * 1024)
+	newData := modify(oldData, 0)
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := chanToOps(Delta(sig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops[1].OpCode != BASIS_DIGEST || ops[1].Length != int64(len(oldData)) {
+		t.Fatalf("expected a BASIS_DIGEST op of %v bytes after BLOCK_SIZE, got %v", len(oldData), ops[1])
+	}
+
+	changed := append([]byte(nil), oldData...)
+	changed[len(changed)-1]++
+	for _, basis := range [][]byte{changed, oldData[:len(oldData)-1], append(oldData, 0)} {
+		patchedData := new(bytes.Buffer)
+		opsChan, cerr := opsToChan(ops)
+		err := Patch(bytes.NewReader(basis), opsChan, cerr, patchedData)
+		if err != ErrBasisMismatch {
+			t.Errorf("expected ErrBasisMismatch, got %v", err)
+		}
+		if patchedData.Len() != 0 {
+			t.Errorf("expected no data written, got %v bytes", patchedData.Len())
+		}
+	}
+
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	if err := Patch(bytes.NewReader(oldData), opsChan, cerr, patchedData); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), newData) {
+		t.Error("patched data is not equal to the new data")
+	}
+}
+
+func TestPatchErrors(t *testing.T) {
+	oldData := createFakeData(20 * 1024)
+	newData := modify(oldData, 0)
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := chanToOps(Delta(sig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badHash := append([]Op(nil), ops...)
+	eof := &badHash[len(badHash)-1]
+	eof.Data = append([]byte(nil), eof.Data...)
+	eof.Data[0]++
+	opsChan, cerr := opsToChan(badHash)
+	if err := Patch(bytes.NewReader(oldData), opsChan, cerr, ioutil.Discard); err != ErrChecksumMismatch {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	for _, bad := range []Op{{OpCode: COPY, Offset: -1, Length: 10}, {OpCode: BLOCK, Index: -1}} {
+		badOps := append([]Op{ops[0], bad}, ops[1:]...)
+		opsChan, cerr = opsToChan(badOps)
+		if err := Patch(bytes.NewReader(oldData), opsChan, cerr, ioutil.Discard); !errors.Is(err, ErrCorruptDelta) {
+			t.Errorf("%v: expected an error wrapping ErrCorruptDelta, got %v", bad, err)
+		}
+	}
+}
+
+// opsToChan returns ops as the channels returned by Delta.
+func opsToChan(ops []Op) (<-chan Op, <-chan error) {
+	opsChan := make(chan Op, len(ops))
+	for _, op := range ops {
+		opsChan <- op
+	}
+	close(opsChan)
+	cerr := make(chan error, 1)
+	cerr <- nil
+	return opsChan, cerr
+}
+
+// chanToOps reads all the ops of the channels returned by Delta.
+func chanToOps(opsChan <-chan Op, cerr <-chan error) ([]Op, error) {
+	var ops []Op
+	for op := range opsChan {
+		ops = append(ops, op)
+	}
+	return ops, <-cerr
+}
@@ -2,94 +2,392 @@ package rsyncutil
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
+	"github.com/mateusbraga/saveit/progress"
 	"github.com/mateusbraga/saveit/rsync"
+	"io"
+	"io/ioutil"
 	"os"
 )
 
-func CreateSignatureFile(signatureFile string, file string) (err error) {
-	fp, err := os.Open(file)
+// Stdio is the file name the functions of this package read from stdin or write to stdout instead of a file. Old files that are patched must be regular files, and only one file of each call can be read from stdin.
+const Stdio = "-"
+
+// opsBuffer is the number of decoded ops buffered while a delta file is patched.
+const opsBuffer = 512
+
+// openFile opens name for reading, or returns os.Stdin if name is Stdio. Calling closeFile does not close os.Stdin.
+func openFile(name string) (fp *os.File, closeFile func() error, err error) {
+	if name == Stdio {
+		return os.Stdin, func() error { return nil }, nil
+	}
+	fp, err = os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fp, fp.Close, nil
+}
+
+// createFile creates name for writing, or returns os.Stdout if name is Stdio. closeFile removes the created file if failed is true, and does not close os.Stdout.
+func createFile(name string) (fp *os.File, closeFile func(failed bool), err error) {
+	if name == Stdio {
+		return os.Stdout, func(bool) {}, nil
+	}
+	fp, err = os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fp, func(failed bool) {
+		fp.Close()
+		if failed {
+			os.Remove(name)
+		}
+	}, nil
+}
+
+// isRegularFile returns whether fp is a regular file other than os.Stdin, that can be read at any offset.
+func isRegularFile(fp *os.File) bool {
+	if fp == os.Stdin {
+		return false
+	}
+	fi, err := fp.Stat()
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// CreateSignatureFile writes the gob encoded signature of file to signatureFile, as configured by opts. If opts.BlockSize is 0, it is picked from the size of file with rsync.BlockSizeFor, or is rsync.DefaultBlockSize if file is not a regular file. The blocks of regular files are hashed by opts.Workers goroutines, see rsync.NewSignatureReaderAt. Either file may be Stdio. The bytes hashed are counted in opts.Progress.
+func CreateSignatureFile(signatureFile string, file string, opts rsync.SignatureOptions) error {
+	return createSignatureFile(signatureFile, file, opts, writeGobSignature)
+}
+
+// CreateLibrsyncSignatureFile is like CreateSignatureFile, but writes a librsync signature that rdiff can read. See rsync.WriteLibrsyncSignature.
+func CreateLibrsyncSignatureFile(signatureFile string, file string, opts rsync.SignatureOptions) error {
+	return createSignatureFile(signatureFile, file, opts, writeLibrsyncSignature)
+}
+
+// CreateCompactSignatureFile is like CreateSignatureFile, but writes a compact signature, that rsync.Delta reads as needed instead of all at once. See rsync.WriteCompactSignature and OpenSignatureFile.
+func CreateCompactSignatureFile(signatureFile string, file string, opts rsync.SignatureOptions) error {
+	return createSignatureFile(signatureFile, file, opts, writeCompactSignature)
+}
+
+// writeGobSignature writes the gob encoded signature of fp. If size is negative, fp is not a regular file and is read in order.
+func writeGobSignature(w io.Writer, fp *os.File, size int64, opts rsync.SignatureOptions) error {
+	var sig rsync.Signature
+	var err error
+	if size < 0 {
+		sig, err = rsync.NewSignatureOptions(bufio.NewReader(fp), opts)
+	} else {
+		sig, err = rsync.NewSignatureReaderAt(fp, size, opts)
+	}
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	fileBuffer := bufio.NewReader(fp)
 
-	sig, err := rsync.NewSignature(fileBuffer)
+	enc := gob.NewEncoder(w)
+	return enc.Encode(sig)
+}
+
+func writeLibrsyncSignature(w io.Writer, fp *os.File, size int64, opts rsync.SignatureOptions) error {
+	return rsync.WriteLibrsyncSignature(w, bufio.NewReader(fp), opts)
+}
+
+func writeCompactSignature(w io.Writer, fp *os.File, size int64, opts rsync.SignatureOptions) error {
+	return rsync.WriteCompactSignature(w, bufio.NewReader(fp), opts)
+}
+
+func createSignatureFile(signatureFile string, file string, opts rsync.SignatureOptions, write func(w io.Writer, fp *os.File, size int64, opts rsync.SignatureOptions) error) (err error) {
+	fp, closeFp, err := openFile(file)
 	if err != nil {
 		return err
 	}
+	defer closeFp()
 
-	sfp, err := os.Create(signatureFile)
+	size := int64(-1)
+	if isRegularFile(fp) {
+		fi, err := fp.Stat()
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = rsync.BlockSizeFor(size)
+	}
+
+	sfp, closeSfp, err := createFile(signatureFile)
 	if err != nil {
 		return err
 	}
-	defer func() {
-        sfp.Close()
-	    if err != nil {
-	        os.Remove(signatureFile)
-	    }
-	}()
+	defer func() { closeSfp(err != nil) }()
 
 	signatureBuffer := bufio.NewWriter(sfp)
-	defer signatureBuffer.Flush()
-
-	enc := gob.NewEncoder(signatureBuffer)
-	err = enc.Encode(sig)
+	err = write(signatureBuffer, fp, size, opts)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return signatureBuffer.Flush()
 }
 
-func CreateDeltaFile(deltaFile string, signatureOldFile string, newFile string) (err error) {
-	sfp, err := os.Open(signatureOldFile)
+// ReadSignatureFile reads a signature written by CreateSignatureFile, CreateLibrsyncSignatureFile, CreateCompactSignatureFile or rdiff. The whole signature is read in memory, use OpenSignatureFile to read compact signatures as needed. signatureFile may be Stdio.
+func ReadSignatureFile(signatureFile string) (rsync.Signature, error) {
+	sig, closeSig, err := OpenSignatureFile(signatureFile)
 	if err != nil {
-		return err
+		return rsync.Signature{}, err
+	}
+	defer closeSig()
+
+	if compactSig, ok := sig.(*rsync.CompactSignature); ok {
+		return compactSig.Signature()
+	}
+	return sig.(rsync.Signature), nil
+}
+
+// OpenSignatureFile opens a signature for rsync.Delta. A compact signature in a regular file is read from signatureFile as needed, and the file is kept open until close is called. Other signatures, and signatures read from Stdio, are read in memory. Gob signatures written by older versions are read too, see rsync.ReadGobSignature. Errors of corrupt signatures wrap rsync.ErrCorruptSignature.
+func OpenSignatureFile(signatureFile string) (sig rsync.SignatureIndex, close func() error, err error) {
+	sfp, closeSfp, err := openFile(signatureFile)
+	if err != nil {
+		return nil, nil, err
 	}
-	defer sfp.Close()
 	signatureBuffer := bufio.NewReader(sfp)
 
-	dec := gob.NewDecoder(signatureBuffer)
+	if peekMagic(signatureBuffer) == rsync.CompactSignatureMagic && isRegularFile(sfp) {
+		compactSig, err := rsync.OpenCompactSignature(sfp)
+		if err != nil {
+			closeSfp()
+			return nil, nil, err
+		}
+		return compactSig, closeSfp, nil
+	}
+	defer closeSfp()
 
-	var sig rsync.Signature
-	dec.Decode(&sig)
+	switch peekMagic(signatureBuffer) {
+	case rsync.LibrsyncMD4SigMagic, rsync.LibrsyncBlake2SigMagic:
+		sig, err := rsync.ReadLibrsyncSignature(signatureBuffer)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sig, func() error { return nil }, nil
+	case rsync.CompactSignatureMagic:
+		data, err := ioutil.ReadAll(signatureBuffer)
+		if err != nil {
+			return nil, nil, err
+		}
+		compactSig, err := rsync.OpenCompactSignature(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		return compactSig, func() error { return nil }, nil
+	}
+
+	gobSig, err := rsync.ReadGobSignature(signatureBuffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gobSig, func() error { return nil }, nil
+}
 
-	fp, err := os.Open(newFile)
+// VerifySignatureFile returns rsync.ErrBasisMismatch if file is not the file signatureFile was created from. Either file may be Stdio. See rsync.CheckBasis.
+func VerifySignatureFile(signatureFile string, file string) error {
+	if signatureFile == Stdio && file == Stdio {
+		return fmt.Errorf("rsyncutil: cannot read both the signature and the file from stdin")
+	}
+	sig, closeSig, err := OpenSignatureFile(signatureFile)
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	fileBuffer := bufio.NewReader(fp)
+	defer closeSig()
 
-	opc, errc := rsync.Delta(sig, fileBuffer)
+	fp, closeFp, err := openFile(file)
+	if err != nil {
+		return err
+	}
+	defer closeFp()
+	return rsync.CheckBasis(sig, bufio.NewReader(fp))
+}
 
-	ops, err := DeltaChanToArray(opc, errc)
+// peekMagic returns the big-endian uint32 at the start of r, or 0 if r is shorter than that.
+func peekMagic(r *bufio.Reader) uint32 {
+	magic, err := r.Peek(4)
 	if err != nil {
-		return nil
+		return 0
 	}
+	return binary.BigEndian.Uint32(magic)
+}
 
-	dfp, err := os.Create(deltaFile)
+// CreateDeltaFile writes the delta between the file signatureOldFile was created from and newFile to deltaFile, encoded with rsync.Encoder. Ops are written as they are created, so memory use does not grow with the size of the delta. Any of the files may be Stdio.
+func CreateDeltaFile(deltaFile string, signatureOldFile string, newFile string) error {
+	return CreateDeltaFileContext(context.Background(), deltaFile, signatureOldFile, newFile)
+}
+
+// CreateDeltaFileContext is like CreateDeltaFile, but stops when ctx is done, and counts its progress in the progress.Meter of ctx. See rsync.DeltaContext.
+func CreateDeltaFileContext(ctx context.Context, deltaFile string, signatureOldFile string, newFile string) error {
+	return CreateDeltaFileOptions(ctx, deltaFile, signatureOldFile, newFile, DeltaFileOptions{})
+}
+
+// DeltaFileOptions configures how CreateDeltaFileOptions creates a delta. The zero value creates the delta of CreateDeltaFile.
+type DeltaFileOptions struct {
+	// InPlace creates a delta that can be applied with PatchFileInPlace, as CreateInPlaceDeltaFile does.
+	InPlace bool
+	// Encoding configures the encoding of the delta, like the compression of its literal data. PatchFile reads it from the delta.
+	Encoding rsync.EncoderOptions
+}
+
+// CreateDeltaFileOptions is like CreateDeltaFileContext, but creates the delta as configured by opts.
+func CreateDeltaFileOptions(ctx context.Context, deltaFile string, signatureOldFile string, newFile string, opts DeltaFileOptions) error {
+	write := func(w io.Writer, opc <-chan rsync.Op, errc <-chan error) error {
+		return writeDelta(w, opc, errc, opts.Encoding)
+	}
+	return createDeltaFile(ctx, deltaFile, signatureOldFile, newFile, opts.InPlace, write)
+}
+
+// CreateInPlaceDeltaFile is like CreateDeltaFile, but the delta can be applied with PatchFileInPlace. See rsync.DeltaInPlace.
+func CreateInPlaceDeltaFile(deltaFile string, signatureOldFile string, newFile string) error {
+	return CreateInPlaceDeltaFileContext(context.Background(), deltaFile, signatureOldFile, newFile)
+}
+
+// CreateInPlaceDeltaFileContext is like CreateInPlaceDeltaFile, but stops when ctx is done. See CreateDeltaFileContext.
+func CreateInPlaceDeltaFileContext(ctx context.Context, deltaFile string, signatureOldFile string, newFile string) error {
+	return CreateDeltaFileOptions(ctx, deltaFile, signatureOldFile, newFile, DeltaFileOptions{InPlace: true})
+}
+
+// CreateLibrsyncDeltaFile is like CreateDeltaFile, but writes a librsync delta that rdiff can apply. See rsync.WriteLibrsyncDelta.
+func CreateLibrsyncDeltaFile(deltaFile string, signatureOldFile string, newFile string) error {
+	return CreateLibrsyncDeltaFileContext(context.Background(), deltaFile, signatureOldFile, newFile)
+}
+
+// CreateLibrsyncDeltaFileContext is like CreateLibrsyncDeltaFile, but stops when ctx is done. See CreateDeltaFileContext.
+func CreateLibrsyncDeltaFileContext(ctx context.Context, deltaFile string, signatureOldFile string, newFile string) error {
+	return createDeltaFile(ctx, deltaFile, signatureOldFile, newFile, false, rsync.WriteLibrsyncDelta)
+}
+
+func writeDelta(w io.Writer, opc <-chan rsync.Op, errc <-chan error, opts rsync.EncoderOptions) error {
+	enc, err := rsync.NewEncoderOptions(w, opts)
 	if err != nil {
 		return err
 	}
-	defer func() {
-        dfp.Close()
-	    if err != nil {
-	        os.Remove(deltaFile)
-	    }
+	for op := range opc {
+		err := enc.Encode(op)
+		if err != nil {
+			return err
+		}
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// decodeDelta decodes the ops of a delta written by writeDelta as they are read from r, and sends them through the returned channels like rsync.DeltaContext. Ops of an older gob encoded []rsync.Op are decoded all at once.
+func decodeDelta(ctx context.Context, r *bufio.Reader) (<-chan rsync.Op, <-chan error) {
+	if peekMagic(r) != rsync.DeltaMagic {
+		var ops []rsync.Op
+		dec := gob.NewDecoder(r)
+		if err := dec.Decode(&ops); err != nil {
+			opc := make(chan rsync.Op)
+			close(opc)
+			errc := make(chan error, 1)
+			errc <- fmt.Errorf("%w, %v", rsync.ErrCorruptDelta, err)
+			return opc, errc
+		}
+		return rsync.DeltaArrayToChan(ops)
+	}
+
+	opc := make(chan rsync.Op, opsBuffer)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(opc)
+
+		dec := rsync.NewDecoder(r)
+		for {
+			var op rsync.Op
+			err := dec.Decode(&op)
+			if err == io.EOF {
+				errc <- nil
+				return
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			select {
+			case opc <- op:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
 	}()
+	return opc, errc
+}
+
+// ReadDeltaStats reads the delta in deltaFile, written by CreateDeltaFile, and returns its stats. Librsync deltas are not supported. deltaFile may be Stdio.
+func ReadDeltaStats(deltaFile string) (rsync.DeltaStats, error) {
+	var stats rsync.DeltaStats
+
+	dfp, closeDfp, err := openFile(deltaFile)
+	if err != nil {
+		return stats, err
+	}
+	defer closeDfp()
+	deltaBuffer := bufio.NewReader(dfp)
+
+	if peekMagic(deltaBuffer) == rsync.LibrsyncDeltaMagic {
+		return stats, fmt.Errorf("rsyncutil: stats of librsync deltas are not supported")
+	}
+
+	opc, errc := decodeDelta(context.Background(), deltaBuffer)
+	for op := range opc {
+		stats.Add(op)
+	}
+	return stats, <-errc
+}
+
+func createDeltaFile(ctx context.Context, deltaFile string, signatureOldFile string, newFile string, inPlace bool, write func(io.Writer, <-chan rsync.Op, <-chan error) error) (err error) {
+	if signatureOldFile == Stdio && newFile == Stdio {
+		return fmt.Errorf("rsyncutil: cannot read both the signature and the new file from stdin")
+	}
+	sig, closeSig, err := OpenSignatureFile(signatureOldFile)
+	if err != nil {
+		return err
+	}
+	defer closeSig()
+
+	fp, closeFp, err := openFile(newFile)
+	if err != nil {
+		return err
+	}
+	defer closeFp()
+	fileBuffer := bufio.NewReader(fp)
+
+	dfp, closeDfp, err := createFile(deltaFile)
+	if err != nil {
+		return err
+	}
+	defer func() { closeDfp(err != nil) }()
 	deltaBuffer := bufio.NewWriter(dfp)
-	defer deltaBuffer.Flush()
 
-	enc := gob.NewEncoder(deltaBuffer)
-	err = enc.Encode(ops)
+	// stop the delta if write returns early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var opc <-chan rsync.Op
+	var errc <-chan error
+	if inPlace {
+		opc, errc = rsync.DeltaInPlaceContext(ctx, sig, fileBuffer)
+	} else {
+		opc, errc = rsync.DeltaContext(ctx, sig, fileBuffer)
+	}
+	err = write(deltaBuffer, opc, errc)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return deltaBuffer.Flush()
 }
 
 func DeltaChanToArray(opc <-chan rsync.Op, errc <-chan error) ([]rsync.Op, error) {
@@ -103,58 +401,89 @@ func DeltaChanToArray(opc <-chan rsync.Op, errc <-chan error) ([]rsync.Op, error
 	return result, nil
 }
 
+// DeltaArrayToChan returns ops as the channels returned by rsync.Delta. See rsync.DeltaArrayToChan.
 func DeltaArrayToChan(ops []rsync.Op) (<-chan rsync.Op, <-chan error) {
-	opc := make(chan rsync.Op)
-    closedErrChan := make(chan error)
-    close(closedErrChan)
-
-	go func() {
-	    defer close(opc)
-		for _, op := range ops {
-			opc <- op
-		}
-	}()
+	return rsync.DeltaArrayToChan(ops)
+}
 
-	return opc, closedErrChan
+// PatchFile applies the delta in deltaFile, written by CreateDeltaFile, CreateLibrsyncDeltaFile or rdiff, to oldFile and writes the result to newFile. The zeros of ZERO ops are left as holes in newFile, if it is a regular file. Ops are decoded as they are applied, so memory use does not grow with the size of the delta. deltaFile and newFile may be Stdio, oldFile must be a regular file. If the delta records the digest of its basis and oldFile is not it, it returns rsync.ErrBasisMismatch before writing any data. Errors of corrupt deltas wrap rsync.ErrCorruptDelta, and if the result does not have the hash the delta ends with, it returns rsync.ErrChecksumMismatch.
+func PatchFile(newFile string, oldFile string, deltaFile string) error {
+	return PatchFileContext(context.Background(), newFile, oldFile, deltaFile)
 }
 
-func PatchFile(newFile string, oldFile string, deltaFile string) (err error) {
-	dfp, err := os.Open(deltaFile)
+// PatchFileContext is like PatchFile, but stops when ctx is done, and counts its progress in the progress.Meter of ctx. See rsync.PatchContext.
+func PatchFileContext(ctx context.Context, newFile string, oldFile string, deltaFile string) (err error) {
+	if oldFile == Stdio {
+		return fmt.Errorf("rsyncutil: cannot patch stdin, the old file must be a regular file")
+	}
+	dfp, closeDfp, err := openFile(deltaFile)
 	if err != nil {
 		return err
 	}
-	defer dfp.Close()
+	defer closeDfp()
 	deltaBuffer := bufio.NewReader(dfp)
 
-	dec := gob.NewDecoder(deltaBuffer)
-
-	var ops []rsync.Op
-	dec.Decode(&ops)
-    opc, errc := DeltaArrayToChan(ops)
-
 	oldFp, err := os.Open(oldFile)
 	if err != nil {
 		return err
 	}
 	defer oldFp.Close()
 
-	newFp, err := os.Create(newFile)
+	newFp, closeNewFp, err := createFile(newFile)
 	if err != nil {
 		return err
 	}
-	defer func() {
-        newFp.Close()
-	    if err != nil {
-	        os.Remove(newFile)
-	    }
-	}()
-	newFileBuffer := bufio.NewWriter(newFp)
-	defer newFileBuffer.Flush()
+	defer func() { closeNewFp(err != nil) }()
+	// leaves the zeros of ZERO ops as holes, if newFp is a regular file
+	newFileBuffer := rsync.NewSparseWriter(newFp)
+
+	if peekMagic(deltaBuffer) == rsync.LibrsyncDeltaMagic {
+		err = rsync.PatchLibrsync(oldFp, deltaBuffer, progress.FromContext(ctx).Writer(newFileBuffer))
+	} else {
+		// stop decoding if the patch fails
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		opc, errc := decodeDelta(ctx, deltaBuffer)
+		err = rsync.PatchContext(ctx, oldFp, opc, errc, newFileBuffer)
+	}
+	if err != nil {
+		return err
+	}
+
+	return newFileBuffer.Flush()
+}
 
-	err = rsync.Patch(oldFp, opc, errc, newFileBuffer)
+// PatchFileInPlace applies the delta in deltaFile, written by CreateInPlaceDeltaFile, to file, overwriting it. deltaFile may be Stdio. See rsync.PatchInPlace.
+func PatchFileInPlace(file string, deltaFile string) error {
+	return PatchFileInPlaceContext(context.Background(), file, deltaFile)
+}
+
+// PatchFileInPlaceContext is like PatchFileInPlace, but stops when ctx is done. See PatchFileContext.
+func PatchFileInPlaceContext(ctx context.Context, file string, deltaFile string) error {
+	if file == Stdio {
+		return fmt.Errorf("rsyncutil: cannot patch stdin in place, the file must be a regular file")
+	}
+	dfp, closeDfp, err := openFile(deltaFile)
 	if err != nil {
-        return err
+		return err
 	}
+	defer closeDfp()
+	deltaBuffer := bufio.NewReader(dfp)
 
-	return nil
+	fp, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opc, errc := decodeDelta(ctx, deltaBuffer)
+	err = rsync.PatchInPlaceContext(ctx, fp, opc, errc)
+	if err != nil {
+		return err
+	}
+	return fp.Sync()
 }
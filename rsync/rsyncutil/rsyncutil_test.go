@@ -0,0 +1,223 @@
+package rsyncutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/mateusbraga/saveit/rsync"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createFakeData returns size pseudo-random bytes.
+func createFakeData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// writeFiles writes an old file and a new file, made of parts of the old one and new data, to dir, and returns their names and the new data.
+func writeFiles(t *testing.T, dir string) (oldFile string, newFile string, newData []byte) {
+	oldData := createFakeData(300*1024, 0)
+	newData = append(append(append([]byte(nil), oldData[100*1024:]...), createFakeData(5000, 1)...), oldData[:50*1024]...)
+
+	oldFile = filepath.Join(dir, "old")
+	newFile = filepath.Join(dir, "new")
+	if err := ioutil.WriteFile(oldFile, oldData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newFile, newData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return oldFile, newFile, newData
+}
+
+// pipeStdio replaces os.Stdin and os.Stdout by the ends of a pipe, until the returned function is called.
+func pipeStdio(t *testing.T) (restore func()) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = r, w
+	return func() {
+		os.Stdin, os.Stdout = stdin, stdout
+		r.Close()
+		w.Close()
+	}
+}
+
+func TestStdioRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsyncutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile, newFile, newData := writeFiles(t, dir)
+
+	sigFile := filepath.Join(dir, "sig")
+	if err := CreateSignatureFile(sigFile, oldFile, rsync.SignatureOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delta is written to stdout and patched from stdin, through a pipe, as it is created
+	restore := pipeStdio(t)
+	defer restore()
+	deltaErr := make(chan error, 1)
+	go func() {
+		opts := DeltaFileOptions{Encoding: rsync.EncoderOptions{Compression: rsync.Deflate}}
+		err := CreateDeltaFileOptions(context.Background(), Stdio, sigFile, newFile, opts)
+		// ends the delta read from stdin
+		os.Stdout.Close()
+		deltaErr <- err
+	}()
+
+	patchedFile := filepath.Join(dir, "patched")
+	if err := PatchFile(patchedFile, oldFile, Stdio); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-deltaErr; err != nil {
+		t.Fatal(err)
+	}
+	patched, err := ioutil.ReadFile(patchedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patched, newData) {
+		t.Error("patched file is not equal to the new file")
+	}
+}
+
+func TestPatchFileStdout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsyncutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile, newFile, newData := writeFiles(t, dir)
+
+	sigFile := filepath.Join(dir, "sig")
+	deltaFile := filepath.Join(dir, "delta")
+	if err := CreateSignatureFile(sigFile, oldFile, rsync.SignatureOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDeltaFile(deltaFile, sigFile, newFile); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := pipeStdio(t)
+	defer restore()
+	patchedReader := os.Stdin
+	patched := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(patchedReader)
+		patched <- data
+	}()
+
+	err = PatchFile(Stdio, oldFile, deltaFile)
+	os.Stdout.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(<-patched, newData) {
+		t.Error("data written to stdout is not equal to the new file")
+	}
+}
+
+func TestPatchFileCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsyncutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile, _, _ := writeFiles(t, dir)
+
+	deltaFile := filepath.Join(dir, "delta")
+	delta := new(bytes.Buffer)
+	enc := rsync.NewEncoder(delta)
+	enc.Encode(rsync.Op{OpCode: rsync.RAW_DATA, Data: []byte("some data")})
+	enc.Flush()
+	// an op the decoder does not know
+	if err := ioutil.WriteFile(deltaFile, append(delta.Bytes(), 0x7f), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	patchedFile := filepath.Join(dir, "patched")
+	if err := PatchFile(patchedFile, oldFile, deltaFile); !errors.Is(err, rsync.ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping rsync.ErrCorruptDelta, got %v", err)
+	}
+	if _, err := os.Stat(patchedFile); !os.IsNotExist(err) {
+		t.Errorf("expected the patched file to be removed, got %v", err)
+	}
+}
+
+// encodeDelta returns ops encoded by rsync.Encoder.
+func encodeDelta(t *testing.T, ops []rsync.Op) []byte {
+	buf := new(bytes.Buffer)
+	enc := rsync.NewEncoder(buf)
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeDelta(t *testing.T) {
+	var ops []rsync.Op
+	for i := 0; i < 3*opsBuffer; i++ {
+		ops = append(ops, rsync.Op{OpCode: rsync.RAW_DATA, Data: []byte{byte(i)}})
+	}
+	encoded := encodeDelta(t, ops)
+
+	opc, errc := decodeDelta(context.Background(), bufio.NewReader(bytes.NewReader(encoded)))
+	decoded, err := DeltaChanToArray(opc, errc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(ops) {
+		t.Errorf("expected %v ops, got %v", len(ops), len(decoded))
+	}
+
+	// the decoder stops when ctx is done, with more ops than are buffered left
+	ctx, cancel := context.WithCancel(context.Background())
+	opc, errc = decodeDelta(ctx, bufio.NewReader(bytes.NewReader(encoded)))
+	<-opc
+	cancel()
+	n := 1
+	for range opc {
+		n++
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if n >= len(ops) {
+		t.Errorf("expected the decoder to stop before %v ops, got %v", len(ops), n)
+	}
+
+	// errors are sent after the ops decoded before them
+	truncated := encoded[:len(encoded)-1]
+	opc, errc = decodeDelta(context.Background(), bufio.NewReader(bytes.NewReader(truncated)))
+	if _, err := DeltaChanToArray(opc, errc); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated delta, got %v", err)
+	}
+
+	opc, errc = decodeDelta(context.Background(), bufio.NewReader(bytes.NewReader(append(encoded, 0x7f))))
+	if _, err := DeltaChanToArray(opc, errc); !errors.Is(err, rsync.ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping rsync.ErrCorruptDelta for an invalid op, got %v", err)
+	}
+
+	// neither a delta nor gob encoded ops
+	opc, errc = decodeDelta(context.Background(), bufio.NewReader(bytes.NewReader([]byte{1, 2, 3})))
+	if _, err := DeltaChanToArray(opc, errc); !errors.Is(err, rsync.ErrCorruptDelta) {
+		t.Errorf("expected an error wrapping rsync.ErrCorruptDelta for data that is not a delta, got %v", err)
+	}
+}
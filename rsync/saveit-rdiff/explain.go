@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mateusbraga/saveit/rsync"
+	"github.com/mateusbraga/saveit/rsync/rsyncutil"
+	"io"
+	"sort"
+	"strings"
+)
+
+// deltaInfo is the output of explain.
+type deltaInfo struct {
+	rsync.DeltaStats
+	TotalOps int
+	NewSize  int64
+	Ratio    float64
+}
+
+// explain writes the stats of deltaFile to w, as text or JSON.
+func explain(w io.Writer, deltaFile string, asJSON bool) error {
+	stats, err := rsyncutil.ReadDeltaStats(deltaFile)
+	if err != nil {
+		return err
+	}
+	info := deltaInfo{
+		DeltaStats: stats,
+		TotalOps:   stats.TotalOps(),
+		NewSize:    stats.NewSize(),
+		Ratio:      stats.Ratio(),
+	}
+	if asJSON {
+		return writeJSON(w, info)
+	}
+
+	var opCounts []string
+	for _, name := range sortedKeys(info.Ops) {
+		opCounts = append(opCounts, fmt.Sprintf("%v %v", name, info.Ops[name]))
+	}
+	fmt.Fprintf(w, "Block size:      %v\n", info.BlockSize)
+	fmt.Fprintf(w, "Ops:             %v (%v)\n", info.TotalOps, strings.Join(opCounts, ", "))
+	fmt.Fprintf(w, "Matched blocks:  %v\n", info.MatchedBlocks)
+	fmt.Fprintf(w, "Matched bytes:   %v\n", info.MatchedBytes)
+	fmt.Fprintf(w, "Literal bytes:   %v\n", info.LiteralBytes)
+	fmt.Fprintf(w, "Zero bytes:      %v\n", info.ZeroBytes)
+	fmt.Fprintf(w, "New size:        %v\n", info.NewSize)
+	fmt.Fprintf(w, "Ratio:           %.2f%% copied from the basis\n", 100*info.Ratio)
+	fmt.Fprintf(w, "Reuse histogram:\n")
+	var uses []int
+	for n := range info.ReuseHistogram {
+		uses = append(uses, n)
+	}
+	sort.Ints(uses)
+	for _, n := range uses {
+		fmt.Fprintf(w, "  %v blocks copied %v times\n", info.ReuseHistogram[n], n)
+	}
+	return nil
+}
+
+// signatureInfo is the output of inspect.
+type signatureInfo struct {
+	BlockSize  int
+	WeakHash   string
+	StrongHash string
+	StrongLen  int
+	// Blocks is the number of distinct blocks. Blocks equal to a previous one are not in the signature.
+	Blocks int
+	// BlockCount is the number of blocks of the basis, as far as the signature tells.
+	BlockCount int
+	// WeakCollisions is the number of weak checksums shared by different blocks.
+	WeakCollisions int
+	// Length and Digest are the length and the SHA-1 digest of the basis, if the signature records them.
+	Length int64  `json:",omitempty"`
+	Digest string `json:",omitempty"`
+}
+
+// inspect writes a summary of signatureFile to w, as text or JSON.
+func inspect(w io.Writer, signatureFile string, asJSON bool) error {
+	sig, err := rsyncutil.ReadSignatureFile(signatureFile)
+	if err != nil {
+		return err
+	}
+	info := signatureInfo{
+		BlockSize:  sig.BlockSize,
+		WeakHash:   sig.WeakHash.String(),
+		StrongHash: sig.StrongHash.String(),
+		StrongLen:  sig.StrongLen,
+		BlockCount: int(sig.BlockCount()),
+	}
+	if sig.Digest != nil {
+		info.Length = sig.Length
+		info.Digest = fmt.Sprintf("%x", sig.Digest)
+	}
+	for _, strongs := range sig.Blocks {
+		info.Blocks += len(strongs)
+		if len(strongs) > 1 {
+			info.WeakCollisions++
+		}
+	}
+	if asJSON {
+		return writeJSON(w, info)
+	}
+
+	fmt.Fprintf(w, "Block size:      %v\n", info.BlockSize)
+	fmt.Fprintf(w, "Weak hash:       %v\n", info.WeakHash)
+	fmt.Fprintf(w, "Strong hash:     %v (%v bytes)\n", info.StrongHash, info.StrongLen)
+	fmt.Fprintf(w, "Blocks:          %v distinct of %v\n", info.Blocks, info.BlockCount)
+	fmt.Fprintf(w, "Weak collisions: %v\n", info.WeakCollisions)
+	if info.Digest != "" {
+		fmt.Fprintf(w, "Basis:           %v bytes, SHA-1 %v\n", info.Length, info.Digest)
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func sortedKeys(m map[string]int) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"github.com/mateusbraga/saveit/rsync/remote"
+	"log"
+	"net"
+	"os"
+)
+
+// serve receives the files pushed to addr and updates them in root. Pushes are not authenticated, see remote.Server.
+func serve(addr string, root string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving %v on %v", root, l.Addr())
+
+	server := &remote.Server{Root: root}
+	return server.Serve(l)
+}
+
+// push sends file to the server at addr, to update its file called name.
+func push(file string, addr string, name string) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return remote.Push(conn, name, bufio.NewReader(fp))
+}
@@ -1,37 +1,178 @@
 package main
 
 import (
-    "flag"
-    "github.com/mateusbraga/saveit/rsync/rsyncutil"
-    "log"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/mateusbraga/saveit/progress"
+	"github.com/mateusbraga/saveit/rsync"
+	"github.com/mateusbraga/saveit/rsync/rsyncutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	blockSize  = flag.Int("block-size", 0, "signature block size in bytes (0 picks one from the file size)")
+	strongHash = flag.String("hash", "", "signature strong hash: md5, sha256, blake2b or md4 (default md5, or blake2b with -format=librsync)")
+	weakHash   = flag.String("weak-hash", "", "signature rolling hash: adler32, rollsum, buzhash or rabinkarp (default adler32, librsync format always uses rollsum)")
+	sumSize    = flag.Int("sum-size", 0, "truncate strong checksums to this many bytes (0 keeps the full hash)")
+	format     = flag.String("format", "saveit", "signature and delta file format: saveit, compact or librsync (patch detects it; compact only changes the signature, which delta reads as needed)")
+	compress   = flag.String("compress", "", "delta: compress literal data: deflate (default none, saveit format only; patch detects it)")
+	level      = flag.Int("level", 0, "compression level of -compress, 1 (fastest) to 9 (smallest) (0 picks the default)")
+	inPlace    = flag.Bool("inplace", false, "delta: create a delta that can be applied in place; patch: apply it to BASIS, without NEWFILE")
+	addr       = flag.String("addr", "localhost:7007", "address serve listens on; serve has no authentication, so only listen where peers are trusted")
+	asJSON     = flag.Bool("json", false, "print explain and inspect output as JSON")
+	workers    = flag.Int("workers", 0, "number of goroutines hashing signature blocks (0 uses GOMAXPROCS, saveit format only)")
+	progressTo = flag.String("progress", "", "report the progress of signature, delta and patch on stderr: bar or json (default none)")
 )
 
 func main() {
-    flag.Parse()
+	flag.Parse()
+
+	librsync, compact := false, false
+	switch *format {
+	case "saveit":
+	case "compact":
+		compact = true
+	case "librsync":
+		librsync = true
+	default:
+		log.Fatalf("Unknown format %q, use 'saveit', 'compact' or 'librsync'", *format)
+	}
+
+	printer, err := progress.NewPrinter(*progressTo, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var meter *progress.Meter
+
+	switch flag.Arg(0) {
+	case "signature":
+		switch flag.NArg() {
+		case 3:
+			meter = progress.NewMeter("signature", fileSize(flag.Arg(1)), printer)
+			opts := rsync.SignatureOptions{BlockSize: *blockSize, StrongLen: *sumSize, Workers: *workers, Progress: meter}
+			if *strongHash != "" {
+				opts.StrongHash, err = rsync.ParseStrongHash(*strongHash)
+				if err != nil {
+					log.Fatal(err)
+				}
+			} else if librsync {
+				opts.StrongHash = rsync.BLAKE2b
+			}
+			if *weakHash != "" {
+				opts.WeakHash, err = rsync.ParseWeakHash(*weakHash)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			if librsync {
+				err = rsyncutil.CreateLibrsyncSignatureFile(flag.Arg(2), flag.Arg(1), opts)
+			} else if compact {
+				err = rsyncutil.CreateCompactSignatureFile(flag.Arg(2), flag.Arg(1), opts)
+			} else {
+				err = rsyncutil.CreateSignatureFile(flag.Arg(2), flag.Arg(1), opts)
+			}
+		default:
+			log.Fatal("Usage: saveit-rdiff signature BASIS SIGNATURE")
+		}
+	case "delta":
+		switch flag.NArg() {
+		case 4:
+			meter = progress.NewMeter("delta", fileSize(flag.Arg(2)), printer)
+			ctx := progress.NewContext(context.Background(), meter)
+			opts := rsyncutil.DeltaFileOptions{InPlace: *inPlace, Encoding: rsync.EncoderOptions{Level: *level}}
+			if *compress != "" {
+				opts.Encoding.Compression, err = rsync.ParseCompression(*compress)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			if librsync {
+				if opts.Encoding.Compression != rsync.NoCompression {
+					log.Fatal("librsync deltas cannot be compressed")
+				}
+				err = rsyncutil.CreateLibrsyncDeltaFileContext(ctx, flag.Arg(3), flag.Arg(1), flag.Arg(2))
+			} else {
+				err = rsyncutil.CreateDeltaFileOptions(ctx, flag.Arg(3), flag.Arg(1), flag.Arg(2), opts)
+			}
+		default:
+			log.Fatal("Usage: saveit-rdiff delta SIGNATURE NEWFILE DELTA")
+		}
+	case "patch":
+		// the size of the new data is not known before the end of the delta
+		meter = progress.NewMeter("patch", 0, printer)
+		ctx := progress.NewContext(context.Background(), meter)
+		switch {
+		case *inPlace && flag.NArg() == 3:
+			err = rsyncutil.PatchFileInPlaceContext(ctx, flag.Arg(1), flag.Arg(2))
+		case !*inPlace && flag.NArg() == 4:
+			err = rsyncutil.PatchFileContext(ctx, flag.Arg(3), flag.Arg(1), flag.Arg(2))
+		default:
+			log.Fatal("Usage: saveit-rdiff patch BASIS DELTA NEWFILE, or saveit-rdiff -inplace patch BASIS DELTA")
+		}
+	case "verify":
+		switch flag.NArg() {
+		case 3:
+			err = rsyncutil.VerifySignatureFile(flag.Arg(2), flag.Arg(1))
+			if err == nil {
+				fmt.Printf("%v matches %v\n", flag.Arg(1), flag.Arg(2))
+			}
+		default:
+			log.Fatal("Usage: saveit-rdiff verify BASIS SIGNATURE")
+		}
+	case "explain":
+		switch flag.NArg() {
+		case 2:
+			err = explain(os.Stdout, flag.Arg(1), *asJSON)
+		default:
+			log.Fatal("Usage: saveit-rdiff explain DELTA")
+		}
+	case "inspect":
+		switch flag.NArg() {
+		case 2:
+			err = inspect(os.Stdout, flag.Arg(1), *asJSON)
+		default:
+			log.Fatal("Usage: saveit-rdiff inspect SIGNATURE")
+		}
+	case "serve":
+		switch flag.NArg() {
+		case 2:
+			err = serve(*addr, flag.Arg(1))
+		default:
+			log.Fatal("Usage: saveit-rdiff [-addr HOST:PORT] serve ROOT. The protocol has no authentication: anyone who can connect to -addr can create or overwrite any file in ROOT.")
+		}
+	case "push":
+		switch flag.NArg() {
+		case 3:
+			err = push(flag.Arg(1), flag.Arg(2), filepath.Base(flag.Arg(1)))
+		case 4:
+			err = push(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		default:
+			log.Fatal("Usage: saveit-rdiff push FILE HOST:PORT [NAME]")
+		}
+	default:
+		log.Fatal("You must specify one of the following action: 'signature', 'delta', 'patch', 'verify', 'explain', 'inspect', 'serve' or 'push'. Files but BASIS of patch may be '-' for stdin or stdout.")
+	}
+	if err != nil {
+		if meter != nil && *progressTo == "bar" {
+			// end the line of the bar, that is not done, before the error
+			fmt.Fprintln(os.Stderr)
+		}
+		log.Fatal(err)
+	}
+	meter.Done()
+}
 
-    switch flag.Arg(0) {
-    case "signature":
-        switch flag.NArg() {
-        case 3:
-            rsyncutil.CreateSignatureFile(flag.Arg(2), flag.Arg(1))
-        default:
-            log.Fatal("Usage: saveit-rdiff signature BASIS SIGNATURE")
-        }
-    case "delta":
-        switch flag.NArg() {
-        case 4:
-            rsyncutil.CreateDeltaFile(flag.Arg(3), flag.Arg(1), flag.Arg(2))
-        default:
-            log.Fatal("Usage: saveit-rdiff delta SIGNATURE NEWFILE DELTA")
-        }
-    case "patch":
-        switch flag.NArg() {
-        case 4:
-            rsyncutil.PatchFile(flag.Arg(3), flag.Arg(1), flag.Arg(2))
-        default:
-            log.Fatal("Usage: saveit-rdiff patch BASIS DELTA NEWFILE")
-        }
-    default:
-        log.Fatal("You must specify one of the following action: 'signature', 'delta', or 'patch'.")
-    }
+// fileSize returns the size of file, or 0 if it is unknown, like for stdin.
+func fileSize(file string) int64 {
+	if file == rsyncutil.Stdio {
+		return 0
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
 }
@@ -0,0 +1,133 @@
+package rsync
+
+// SignatureIndex is where Delta looks up the blocks of the old data, so that it works with any representation of a signature: Signature and MultiSignature hold every block in memory, CompactSignature reads them from disk as needed and FilteredSignature hides some of the blocks of another one.
+//
+// Delta asks for the Candidates of the weak checksum of each position of the new data, and only computes the strong checksum when there are some. It then calls Verify for each candidate until one matches.
+type SignatureIndex interface {
+	// Options returns the block size and the hashes the signature was created with. StrongLen is the length of its strong checksums.
+	Options() SignatureOptions
+	// BlockCount returns the number of blocks of the old data, as far as the signature tells. It is not used by Delta.
+	BlockCount() int64
+	// Candidates returns the blocks that may have the weak checksum weak. It may return blocks that do not, but must return a block of each strong checksum the blocks with weak have. It returns nil if there are none.
+	Candidates(weak uint32) ([]BlockRef, error)
+	// Verify returns whether the block ref has the weak checksum weak and the strong checksum strong, truncated to StrongLen bytes.
+	Verify(weak uint32, strong []byte, ref BlockRef) (bool, error)
+	// BasisDigest returns the length and the SHA-1 digest of the data of basis 0, or a nil digest if the signature does not record them. Delta sends them in a BASIS_DIGEST op.
+	BasisDigest() (length int64, digest []byte)
+	// Tail returns the index and the length of the last block of basis 0, if it is shorter than BlockSize and the signature records it, or a length of 0. Delta only looks for it at the end of the new data, as it cannot be found by the weak checksums of full blocks.
+	Tail() (index int, length int)
+}
+
+// Options returns the options sig was created with.
+func (sig Signature) Options() SignatureOptions {
+	return SignatureOptions{
+		BlockSize:  sig.BlockSize,
+		WeakHash:   sig.WeakHash,
+		StrongHash: sig.StrongHash,
+		StrongLen:  sig.StrongLen,
+	}
+}
+
+// BlockCount returns the number of blocks of the data. If sig does not record the Length, it returns the number of blocks counted when sig was built or read, which for signatures other than librsync ones is up to the last distinct block, as blocks at the end equal to previous ones are not in the signature. Older signatures decoded with gob do not have that count, and their blocks are scanned for it.
+func (sig Signature) BlockCount() int64 {
+	if sig.Digest != nil {
+		return (sig.Length + int64(sig.BlockSize) - 1) / int64(sig.BlockSize)
+	}
+	if sig.blockCount > 0 {
+		return sig.blockCount
+	}
+	var count int64
+	for _, strongs := range sig.Blocks {
+		for _, index := range strongs {
+			if int64(index)+1 > count {
+				count = int64(index) + 1
+			}
+		}
+	}
+	return count
+}
+
+// Candidates returns the blocks of sig with the weak checksum weak, one for each strong checksum.
+func (sig Signature) Candidates(weak uint32) ([]BlockRef, error) {
+	strongs, ok := sig.Blocks[weak]
+	if !ok {
+		return nil, nil
+	}
+	refs := make([]BlockRef, 0, len(strongs))
+	for _, index := range strongs {
+		refs = append(refs, BlockRef{Index: index})
+	}
+	return refs, nil
+}
+
+// Verify returns whether the block ref has the given checksums.
+func (sig Signature) Verify(weak uint32, strong []byte, ref BlockRef) (bool, error) {
+	index, ok := sig.Blocks[weak][string(strong)]
+	return ok && ref.Basis == 0 && ref.Index == index, nil
+}
+
+// BasisDigest returns sig.Length and sig.Digest.
+func (sig Signature) BasisDigest() (int64, []byte) {
+	return sig.Length, sig.Digest
+}
+
+// Tail returns the index and the length of the last block, if it is shorter than BlockSize.
+func (sig Signature) Tail() (int, int) {
+	if sig.Digest == nil || sig.TailLength == 0 || sig.TailLength == sig.BlockSize {
+		return 0, 0
+	}
+	return int(sig.BlockCount() - 1), sig.TailLength
+}
+
+// FilteredSignature is the SignatureIndex of the blocks of Index that Keep returns true for. Delta against it does not copy the other blocks.
+type FilteredSignature struct {
+	Index SignatureIndex
+	Keep  func(ref BlockRef) bool
+}
+
+// Options returns the options of f.Index.
+func (f FilteredSignature) Options() SignatureOptions {
+	return f.Index.Options()
+}
+
+// BlockCount returns the block count of f.Index, including the blocks filtered out.
+func (f FilteredSignature) BlockCount() int64 {
+	return f.Index.BlockCount()
+}
+
+// Candidates returns the candidates of f.Index that f.Keep returns true for.
+func (f FilteredSignature) Candidates(weak uint32) ([]BlockRef, error) {
+	candidates, err := f.Index.Candidates(weak)
+	if err != nil {
+		return nil, err
+	}
+	var kept []BlockRef
+	for _, ref := range candidates {
+		if f.Keep(ref) {
+			kept = append(kept, ref)
+		}
+	}
+	return kept, nil
+}
+
+// Verify returns whether f.Keep returns true for ref, and f.Index verifies it.
+func (f FilteredSignature) Verify(weak uint32, strong []byte, ref BlockRef) (bool, error) {
+	if !f.Keep(ref) {
+		return false, nil
+	}
+	return f.Index.Verify(weak, strong, ref)
+}
+
+// BasisDigest returns the basis digest of f.Index.
+func (f FilteredSignature) BasisDigest() (int64, []byte) {
+	return f.Index.BasisDigest()
+}
+
+// Tail returns the tail of f.Index, if f.Keep returns true for it.
+func (f FilteredSignature) Tail() (int, int) {
+	index, length := f.Index.Tail()
+	if length == 0 || !f.Keep(BlockRef{Index: index}) {
+		return 0, 0
+	}
+	return index, length
+}
@@ -0,0 +1,160 @@
+package rsync
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"testing"
+)
+
+func TestSignatureBlockCount(t *testing.T) {
+	data := createFakeData(10*1024 + 1)
+	sig, err := NewSignatureSize(bytes.NewReader(data), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.BlockCount() != 11 {
+		t.Errorf("expected 11 blocks, got %v", sig.BlockCount())
+	}
+
+	// older signatures do not record the length, and decoded with gob do not have the count either
+	sig.Digest = nil
+	if sig.BlockCount() != 11 {
+		t.Errorf("expected 11 blocks without the length, got %v", sig.BlockCount())
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(sig); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Signature
+	if err := gob.NewDecoder(buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BlockCount() != 11 {
+		t.Errorf("expected 11 blocks after gob, got %v", decoded.BlockCount())
+	}
+
+	multiSig, err := NewMultiSignature(sig, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blocks of the second basis are all in the first one
+	if multiSig.BlockCount() != 11 {
+		t.Errorf("expected 11 blocks, got %v", multiSig.BlockCount())
+	}
+}
+
+func TestSignatureLength(t *testing.T) {
+	for _, size := range []int{0, 1000, 4096, 10*1024 + 100} {
+		data := createFakeData(size)
+		sig, err := NewSignatureSize(bytes.NewReader(data), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha1.Sum(data)
+		if sig.Length != int64(size) || !bytes.Equal(sig.Digest, digest[:]) {
+			t.Errorf("expected length %v and digest %x, got %v and %x", size, digest, sig.Length, sig.Digest)
+		}
+		if sig.BlockCount() != int64((size+1023)/1024) {
+			t.Errorf("expected %v blocks, got %v", (size+1023)/1024, sig.BlockCount())
+		}
+
+		expectedIndex, expectedLength := 0, size%1024
+		if expectedLength > 0 {
+			expectedIndex = size / 1024
+		}
+		if index, length := sig.Tail(); index != expectedIndex || length != expectedLength {
+			t.Errorf("expected tail %v of %v bytes, got %v of %v bytes", expectedIndex, expectedLength, index, length)
+		}
+
+		if err := CheckBasis(sig, bytes.NewReader(data)); err != nil {
+			t.Error(err)
+		}
+		if err := CheckBasis(sig, bytes.NewReader(createFakeData(size+1))); err != ErrBasisMismatch {
+			t.Errorf("expected ErrBasisMismatch for a different basis, got %v", err)
+		}
+	}
+}
+
+func TestDeltaTail(t *testing.T) {
+	oldData := createFakeData(10*1024 + 100)
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tail alone, after data that does not match
+	newData := append(createFakeData(500), oldData[10*1024:]...)
+	ops, err := chanToOps(Delta(sig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copies []Op
+	for _, op := range ops {
+		if op.OpCode == COPY {
+			copies = append(copies, op)
+		}
+	}
+	if len(copies) != 1 || copies[0].Offset != 10*1024 || copies[0].Length != 100 {
+		t.Errorf("expected a COPY of the 100 bytes of the tail, got %v", copies)
+	}
+
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	if err := Patch(bytes.NewReader(oldData), opsChan, cerr, patchedData); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), newData) {
+		t.Error("patched data is not equal to the new data")
+	}
+
+	// a tail that differs in its last byte is not matched
+	newData[len(newData)-1]++
+	ops, err = chanToOps(Delta(sig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if op.OpCode == COPY {
+			t.Errorf("expected no COPY, got %v", op)
+		}
+	}
+}
+
+func TestFilteredSignature(t *testing.T) {
+	oldData := createFakeData(64 * 1024)
+	newData := append(append([]byte(nil), oldData[32*1024:]...), oldData[:32*1024]...)
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the first half of the old data can be copied
+	filteredSig := FilteredSignature{
+		Index: sig,
+		Keep:  func(ref BlockRef) bool { return ref.Index < 32 },
+	}
+
+	ops, err := chanToOps(Delta(filteredSig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats DeltaStats
+	for _, op := range ops {
+		stats.Add(op)
+		if op.OpCode == COPY && op.Offset+op.Length > 32*1024 {
+			t.Errorf("%v copies a block filtered out", op)
+		}
+	}
+	if stats.MatchedBytes != 32*1024 {
+		t.Errorf("expected 32768 bytes matched, got %v", stats.MatchedBytes)
+	}
+
+	patchedData := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	if err := Patch(bytes.NewReader(oldData), opsChan, cerr, patchedData); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patchedData.Bytes(), newData) {
+		t.Error("patched data is not equal to the new data")
+	}
+}
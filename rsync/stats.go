@@ -0,0 +1,127 @@
+package rsync
+
+// DeltaStats summarizes the operations of a delta. Add the ops to it one at a time, as they are created or read. The zero value is ready to use.
+type DeltaStats struct {
+	// BlockSize is the block size of the delta, from its BLOCK_SIZE op, or DefaultBlockSize, as Patch does. Blocks are counted in it.
+	BlockSize int
+	// Ops is the number of ops, by opcode.
+	Ops map[string]int
+	// MatchedBlocks is the number of blocks copied from the old data, by BLOCK and COPY ops. A COPY op counts each block it copies bytes of, partial blocks included, as progress meters do. See matchedBlocks.
+	MatchedBlocks int64
+	// MatchedBytes is the number of bytes copied from the old data.
+	MatchedBytes int64
+	// LiteralBytes is the number of bytes sent in RAW_DATA ops.
+	LiteralBytes int64
+	// ZeroBytes is the number of zero bytes of ZERO ops.
+	ZeroBytes int64
+	// ReuseHistogram maps the number of times a block of the old data is copied to the number of blocks copied that many times.
+	ReuseHistogram map[int]int64
+
+	// blockUses is the number of times each block of the old data is copied.
+	blockUses map[BlockRef]int
+}
+
+// Add adds op to the stats.
+func (s *DeltaStats) Add(op Op) {
+	if s.Ops == nil {
+		s.Ops = make(map[string]int)
+		s.ReuseHistogram = make(map[int]int64)
+		s.blockUses = make(map[BlockRef]int)
+	}
+	if s.BlockSize == 0 {
+		s.BlockSize = DefaultBlockSize
+	}
+	s.Ops[opCodeName(op.OpCode)]++
+
+	switch op.OpCode {
+	case BLOCK_SIZE:
+		if op.Index > 0 {
+			s.BlockSize = op.Index
+		}
+	case BLOCK:
+		s.addMatch(op.Basis, int64(op.Index)*int64(s.BlockSize), int64(s.BlockSize))
+	case COPY:
+		s.addMatch(op.Basis, op.Offset, op.Length)
+	case RAW_DATA:
+		s.LiteralBytes += int64(len(op.Data))
+	case ZERO:
+		s.ZeroBytes += op.Length
+	}
+}
+
+// addMatch counts the blocks of length bytes at offset of the old data basis as copied.
+func (s *DeltaStats) addMatch(basis int, offset int64, length int64) {
+	if length <= 0 {
+		return
+	}
+	s.MatchedBytes += length
+
+	first, n := matchedBlocks(offset, length, s.BlockSize)
+	s.MatchedBlocks += n
+	for block := first; block < first+n; block++ {
+		ref := BlockRef{Basis: basis, Index: int(block)}
+		uses := s.blockUses[ref]
+		if uses > 0 {
+			s.ReuseHistogram[uses]--
+			if s.ReuseHistogram[uses] == 0 {
+				delete(s.ReuseHistogram, uses)
+			}
+		}
+		s.blockUses[ref] = uses + 1
+		s.ReuseHistogram[uses+1]++
+	}
+}
+
+// matchedBlocks returns the first block, and the number of blocks, of the old data that length bytes at offset are in, partial blocks included. It is how DeltaStats and progress meters count the blocks matched by BLOCK and COPY ops.
+func matchedBlocks(offset int64, length int64, blockSize int) (first int64, n int64) {
+	if length <= 0 {
+		return 0, 0
+	}
+	size := int64(blockSize)
+	first = offset / size
+	return first, (offset+length+size-1)/size - first
+}
+
+// TotalOps returns the number of ops added.
+func (s DeltaStats) TotalOps() int {
+	total := 0
+	for _, n := range s.Ops {
+		total += n
+	}
+	return total
+}
+
+// NewSize returns the size of the data the delta creates.
+func (s DeltaStats) NewSize() int64 {
+	return s.MatchedBytes + s.LiteralBytes + s.ZeroBytes
+}
+
+// Ratio returns the fraction of the new data that is copied from the old data, between 0 and 1. The closer to 1, the smaller the delta.
+func (s DeltaStats) Ratio() float64 {
+	if s.NewSize() == 0 {
+		return 0
+	}
+	return float64(s.MatchedBytes) / float64(s.NewSize())
+}
+
+// opCodeName returns the name of the opcode, as used by Op.String.
+func opCodeName(opCode int) string {
+	switch opCode {
+	case BLOCK:
+		return "BLOCK"
+	case RAW_DATA:
+		return "RAW_DATA"
+	case EOF:
+		return "EOF"
+	case BLOCK_SIZE:
+		return "BLOCK_SIZE"
+	case COPY:
+		return "COPY"
+	case BASIS_DIGEST:
+		return "BASIS_DIGEST"
+	case ZERO:
+		return "ZERO"
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,115 @@
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"github.com/mateusbraga/saveit/progress"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestDeltaStats(t *testing.T) {
+	ops := []Op{
+		{OpCode: BLOCK_SIZE, Index: 10},
+		{OpCode: COPY, Offset: 0, Length: 30},
+		{OpCode: RAW_DATA, Data: []byte("abcde")},
+		{OpCode: BLOCK, Index: 1},
+		// a partial block at the end of the old data
+		{OpCode: COPY, Offset: 10, Length: 15},
+		{OpCode: EOF, Data: make([]byte, 20)},
+	}
+
+	var stats DeltaStats
+	for _, op := range ops {
+		stats.Add(op)
+	}
+
+	if stats.BlockSize != 10 || stats.MatchedBlocks != 6 || stats.MatchedBytes != 55 || stats.LiteralBytes != 5 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if n := stats.TotalOps(); n != len(ops) {
+		t.Errorf("expected %v ops, got %v", len(ops), n)
+	}
+	expectedOps := map[string]int{"BLOCK_SIZE": 1, "COPY": 2, "RAW_DATA": 1, "BLOCK": 1, "EOF": 1}
+	if !reflect.DeepEqual(stats.Ops, expectedOps) {
+		t.Errorf("expected ops %v, got %v", expectedOps, stats.Ops)
+	}
+	// block 0 once, block 2 twice and block 1 three times
+	expectedHistogram := map[int]int64{1: 1, 2: 1, 3: 1}
+	if !reflect.DeepEqual(stats.ReuseHistogram, expectedHistogram) {
+		t.Errorf("expected histogram %v, got %v", expectedHistogram, stats.ReuseHistogram)
+	}
+	if stats.NewSize() != 60 || stats.Ratio() != 55.0/60.0 {
+		t.Errorf("expected new size 60 and ratio %v, got %v and %v", 55.0/60.0, stats.NewSize(), stats.Ratio())
+	}
+
+	var empty DeltaStats
+	if empty.Ratio() != 0 || empty.TotalOps() != 0 {
+		t.Error("expected zero stats")
+	}
+}
+
+func TestDeltaStatsProgress(t *testing.T) {
+	ops := []Op{
+		{OpCode: BLOCK_SIZE, Index: 10},
+		{OpCode: BLOCK, Index: 3},
+		// copies a part of blocks 0 and 1, a part of block 2 only, and blocks 4 and 5 with a part of block 6
+		{OpCode: COPY, Offset: 5, Length: 10},
+		{OpCode: COPY, Offset: 21, Length: 2},
+		{OpCode: COPY, Offset: 40, Length: 25},
+	}
+
+	var stats DeltaStats
+	meter := progress.NewMeter("patch", 0, func(progress.Progress) {})
+	for _, op := range ops {
+		stats.Add(op)
+		countOp(meter, op, stats.BlockSize)
+	}
+	if stats.MatchedBlocks != 7 {
+		t.Errorf("expected 7 blocks matched, got %v", stats.MatchedBlocks)
+	}
+	if p := meter.Progress(); p.MatchedBlocks != stats.MatchedBlocks || p.MatchedBytes != stats.MatchedBytes {
+		t.Errorf("expected the meter to count %v blocks and %v bytes, got %v and %v", stats.MatchedBlocks, stats.MatchedBytes, p.MatchedBlocks, p.MatchedBytes)
+	}
+}
+
+func TestDeltaProgress(t *testing.T) {
+	oldData := createFakeData(100 * 1024)
+	newData := modify(oldData, 0)
+	sig, err := NewSignatureOptions(bytes.NewReader(oldData), SignatureOptions{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deltaMeter := progress.NewMeter("delta", int64(len(newData)), func(progress.Progress) {})
+	ops, err := chanToOps(DeltaContext(progress.NewContext(context.Background(), deltaMeter), sig, bytes.NewReader(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats DeltaStats
+	for _, op := range ops {
+		stats.Add(op)
+	}
+	p := deltaMeter.Progress()
+	if p.Bytes != int64(len(newData)) || p.MatchedBlocks != stats.MatchedBlocks || p.MatchedBytes != stats.MatchedBytes || p.LiteralBytes != stats.LiteralBytes {
+		t.Errorf("delta progress %+v does not match %v bytes and stats %+v", p, len(newData), stats)
+	}
+
+	patchMeter := progress.NewMeter("patch", 0, func(progress.Progress) {})
+	opsChan, cerr := opsToChan(ops)
+	if err := PatchContext(progress.NewContext(context.Background(), patchMeter), bytes.NewReader(oldData), opsChan, cerr, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if p := patchMeter.Progress(); p.Bytes != int64(len(newData)) || p.MatchedBlocks != stats.MatchedBlocks || p.LiteralBytes != stats.LiteralBytes {
+		t.Errorf("patch progress %+v does not match %v bytes and stats %+v", p, len(newData), stats)
+	}
+
+	sigMeter := progress.NewMeter("signature", int64(len(oldData)), func(progress.Progress) {})
+	if _, err := NewSignatureReaderAt(bytes.NewReader(oldData), int64(len(oldData)), SignatureOptions{BlockSize: 1024, Progress: sigMeter}); err != nil {
+		t.Fatal(err)
+	}
+	if p := sigMeter.Progress(); p.Bytes != int64(len(oldData)) {
+		t.Errorf("expected %v bytes hashed, got %v", len(oldData), p.Bytes)
+	}
+}
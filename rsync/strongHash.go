@@ -0,0 +1,65 @@
+package rsync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+// StrongHash identifies the hash used for the strong checksums of a Signature.
+type StrongHash int
+
+// Strong hashes. MD5 is the zero value, so signatures that do not say otherwise use it.
+const (
+	MD5 StrongHash = iota
+	SHA256
+	// BLAKE2b is BLAKE2b-256.
+	BLAKE2b
+	// MD4 is only meant for librsync signatures. See WriteLibrsyncSignature.
+	MD4
+)
+
+var strongHashNames = map[StrongHash]string{
+	MD5:     "md5",
+	SHA256:  "sha256",
+	BLAKE2b: "blake2b",
+	MD4:     "md4",
+}
+
+// New returns a new hash.Hash computing the strong checksum.
+func (h StrongHash) New() (hash.Hash, error) {
+	switch h {
+	case MD5:
+		return md5.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case BLAKE2b:
+		return blake2b.New256(nil)
+	case MD4:
+		return md4.New(), nil
+	default:
+		return nil, fmt.Errorf("rsync: unknown strong hash %v", h)
+	}
+}
+
+func (h StrongHash) String() string {
+	if name, ok := strongHashNames[h]; ok {
+		return name
+	}
+	return fmt.Sprintf("StrongHash(%d)", int(h))
+}
+
+// ParseStrongHash returns the StrongHash with the given name, as returned by StrongHash.String.
+func ParseStrongHash(name string) (StrongHash, error) {
+	for h, hName := range strongHashNames {
+		if strings.EqualFold(name, hName) {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("rsync: unknown strong hash %q", name)
+}
@@ -0,0 +1,75 @@
+package rsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStrongHash(t *testing.T) {
+	originalData, err := ioutil.ReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modifiedData, err := ioutil.ReadFile(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []SignatureOptions{
+		{StrongHash: MD5},
+		{StrongHash: SHA256},
+		{StrongHash: BLAKE2b},
+		{StrongHash: BLAKE2b, StrongLen: 8},
+		{StrongHash: SHA256, StrongLen: 12, BlockSize: 2048},
+	} {
+		sig, err := NewSignatureOptions(bytes.NewReader(originalData), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.StrongHash != opts.StrongHash {
+			t.Errorf("expected signature strong hash %v, got %v", opts.StrongHash, sig.StrongHash)
+		}
+		for _, strongs := range sig.Blocks {
+			for strong := range strongs {
+				if opts.StrongLen != 0 && len(strong) != opts.StrongLen {
+					t.Fatalf("expected strong checksums of %v bytes, got %v", opts.StrongLen, len(strong))
+				}
+			}
+		}
+
+		opsChan, cerr := Delta(sig, bytes.NewReader(modifiedData))
+
+		patchedData := new(bytes.Buffer)
+		err = Patch(bytes.NewReader(originalData), opsChan, cerr, patchedData)
+		if err != nil {
+			t.Fatalf("Patch failed with %+v: %v", opts, err)
+		}
+		if !bytes.Equal(patchedData.Bytes(), modifiedData) {
+			t.Errorf("patched data does not match modified data with %+v", opts)
+		}
+	}
+}
+
+func TestInvalidStrongLen(t *testing.T) {
+	_, err := NewSignatureWriterOptions(SignatureOptions{StrongHash: MD5, StrongLen: 17})
+	if err == nil {
+		t.Error("expected error for a strong checksum longer than the hash")
+	}
+}
+
+func TestParseStrongHash(t *testing.T) {
+	for _, h := range []StrongHash{MD5, SHA256, BLAKE2b} {
+		parsed, err := ParseStrongHash(h.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != h {
+			t.Errorf("expected %v, got %v", h, parsed)
+		}
+	}
+
+	if _, err := ParseStrongHash("crc32"); err == nil {
+		t.Error("expected error for unknown strong hash")
+	}
+}
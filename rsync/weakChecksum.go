@@ -1,6 +1,124 @@
 package rsync
 
-import ()
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WeakHash identifies the rolling hash used for the weak checksums of a Signature.
+type WeakHash int
+
+// Weak hashes. Adler32 is the zero value, so signatures that do not say otherwise use it.
+const (
+	// Adler32 is the Adler-32 checksum, rolled by weakChecksum. Its sums are small on low-entropy data, like mostly zero blocks, so many blocks share weak checksums there.
+	Adler32 WeakHash = iota
+	// Rollsum is the rolling checksum of librsync, for signatures and deltas librsync can read. It adds 31 to every byte, so it does not interoperate with the checksum of rsync itself.
+	Rollsum
+	// Buzhash is a cyclic polynomial hash, mixing each byte through a table of random values, so that it spreads well on low-entropy data.
+	Buzhash
+	// RabinKarp is the Rabin-Karp polynomial hash modulo 2^32.
+	RabinKarp
+)
+
+var weakHashNames = map[WeakHash]string{
+	Adler32:   "adler32",
+	Rollsum:   "rollsum",
+	Buzhash:   "buzhash",
+	RabinKarp: "rabinkarp",
+}
+
+// New returns a new RollingHash computing the weak checksum over windows of blockSize bytes.
+func (h WeakHash) New(blockSize int) (RollingHash, error) {
+	switch h {
+	case Adler32:
+		return newWeakChecksum(blockSize), nil
+	case Rollsum:
+		return newRollsum(blockSize), nil
+	case Buzhash:
+		return newBuzhash(blockSize), nil
+	case RabinKarp:
+		return newRabinKarp(blockSize), nil
+	default:
+		return nil, fmt.Errorf("rsync: unknown weak hash %v", h)
+	}
+}
+
+func (h WeakHash) String() string {
+	if name, ok := weakHashNames[h]; ok {
+		return name
+	}
+	return fmt.Sprintf("WeakHash(%d)", int(h))
+}
+
+// ParseWeakHash returns the WeakHash with the given name, as returned by WeakHash.String.
+func ParseWeakHash(name string) (WeakHash, error) {
+	for h, hName := range weakHashNames {
+		if strings.EqualFold(name, hName) {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("rsync: unknown weak hash %q", name)
+}
+
+// RollingHash is a checksum over a window of blockSize bytes, as created by WeakHash.New. Writes fill the window and, once it is full, roll it over the bytes written.
+type RollingHash interface {
+	io.Writer
+	// Sum32 returns the checksum of the window.
+	Sum32() uint32
+	// Reset empties the window.
+	Reset()
+	// Roll rolls the full window over len(in) bytes at once: out are the bytes that leave it and in the ones that enter it, in order, and sums receives the checksum after each byte. The window does not keep in, so only Reset and Write to fill the window may follow it.
+	Roll(out []byte, in []byte, sums []uint32)
+}
+
+// windowRollBatch is the number of bytes window.write rolls a hash over at once.
+const windowRollBatch = 256
+
+// window keeps the last len(data) bytes written to a rolling hash, in a ring buffer that starts at firstByteIndex once full.
+type window struct {
+	data           []byte
+	firstByteIndex int
+	n              int
+	sums           []uint32
+}
+
+func (w *window) reset() {
+	w.n = 0
+	w.firstByteIndex = 0
+}
+
+// write fills the window with p, passing the bytes that fill it to add, and rolls the full window over the rest of p with roll, a RollingHash.Roll.
+func (w *window) write(p []byte, add func(p []byte), roll func(out []byte, in []byte, sums []uint32)) {
+	blockSize := len(w.data)
+	canAdd := blockSize - w.n
+	if canAdd > len(p) {
+		canAdd = len(p)
+	}
+	copy(w.data[w.n:w.n+canAdd], p[0:canAdd])
+	w.n += canAdd
+	add(p[0:canAdd])
+
+	// roll the full window over the rest, up to the end of the ring buffer at a time
+	p = p[canAdd:]
+	if len(p) > 0 && w.sums == nil {
+		w.sums = make([]uint32, windowRollBatch)
+	}
+	for len(p) > 0 && blockSize > 0 {
+		count := blockSize - w.firstByteIndex
+		if count > len(p) {
+			count = len(p)
+		}
+		if count > windowRollBatch {
+			count = windowRollBatch
+		}
+		out := w.data[w.firstByteIndex : w.firstByteIndex+count]
+		roll(out, p[:count], w.sums[:count])
+		copy(out, p[:count])
+		w.firstByteIndex = (w.firstByteIndex + count) % blockSize
+		p = p[count:]
+	}
+}
 
 const (
 	// mod is the largest prime that is less than 65536.
@@ -11,24 +129,21 @@ const (
 	nmax = 5552
 )
 
-func newWeakChecksum() *weakChecksum {
-	d := new(weakChecksum)
+func newWeakChecksum(blockSize int) *weakChecksum {
+	d := &weakChecksum{window: window{data: make([]byte, blockSize)}}
 	d.Reset()
 	return d
 }
 
-// weakChecksum is a rolling hash implementation of the adler32.
+// weakChecksum is a rolling hash implementation of the adler32. It rolls over windows of len(data) bytes.
 type weakChecksum struct {
-	digest         uint32
-	data           [BlockSize]byte
-	firstByteIndex int
-	n              int
+	digest uint32
+	window
 }
 
 func (d *weakChecksum) Reset() {
 	d.digest = 1
-	d.n = 0
-	d.firstByteIndex = 0
+	d.reset()
 }
 
 func (d *weakChecksum) Size() int { return 4 }
@@ -36,26 +151,22 @@ func (d *weakChecksum) Size() int { return 4 }
 func (d *weakChecksum) BlockSize() int { return 1 }
 
 func (d *weakChecksum) Write(p []byte) (int, error) {
-	if d.n == BlockSize {
-		// roll one byte
-		d.rollWeakChecksum(d.data[d.firstByteIndex], p[0])
-		d.data[d.firstByteIndex] = p[0]
-		d.firstByteIndex = (d.firstByteIndex + 1) % BlockSize
-		return 1, nil
-	} else {
-		canAdd := BlockSize - d.n
-		if canAdd > len(p) {
-			copy(d.data[d.n:d.n+len(p)], p)
-			d.n += len(p)
-			d.addData(p...)
-			return len(p), nil
-		} else {
-			copy(d.data[d.n:BlockSize], p[0:canAdd])
-			d.n += canAdd
-			d.addData(p...)
-			return canAdd, nil
-		}
+	d.write(p, d.addData, d.Roll)
+	return len(p), nil
+}
+
+func (d *weakChecksum) Roll(out []byte, in []byte, sums []uint32) {
+	s1, s2 := d.digest&0xffff, d.digest>>16
+	blockSize := uint32(len(d.data))
+	for i, x := range in {
+		oldByte := uint32(out[i])
+		s1 += mod + uint32(x) - oldByte
+		s2 += mod + s1 - (blockSize*oldByte)%mod - 1
+		s1 %= mod
+		s2 %= mod
+		sums[i] = s2<<16 | s1
 	}
+	d.digest = s2<<16 | s1
 }
 
 func (d *weakChecksum) Sum32() uint32 { return d.digest }
@@ -67,13 +178,13 @@ func (d *weakChecksum) Sum(in []byte) []byte {
 
 // getWeakChecksum returns the Adler-32 checksum of data.
 func getWeakChecksum(data []byte) uint32 {
-	d := newWeakChecksum()
-	d.addData(data...)
+	d := newWeakChecksum(0)
+	d.addData(data)
 	return d.digest
 }
 
 // addData add p to the running checksum d.
-func (d *weakChecksum) addData(p ...byte) {
+func (d *weakChecksum) addData(p []byte) {
 	s1, s2 := d.digest&0xffff, d.digest>>16
 	for len(p) > 0 {
 		var q []byte
@@ -91,13 +202,3 @@ func (d *weakChecksum) addData(p ...byte) {
 
 	d.digest = (s2<<16 | s1)
 }
-
-func (d *weakChecksum) rollWeakChecksum(oldByte byte, newByte byte) {
-	s1, s2 := d.digest&0xffff, d.digest>>16
-	s1 += mod + uint32(newByte) - uint32(oldByte)
-	s2 += mod + s1 - ((BlockSize)*uint32(oldByte))%mod - 1
-	s1 %= mod
-	s2 %= mod
-
-	d.digest = (s2<<16 | s1)
-}
@@ -1,40 +1,126 @@
 package rsync
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	mathrand "math/rand"
 	"testing"
 )
 
+// weakChecksums maps each WeakHash to the function that computes it over a whole block.
+var weakChecksums = map[WeakHash]func([]byte) uint32{Adler32: getWeakChecksum, Rollsum: getRollsum, Buzhash: getBuzhash, RabinKarp: getRabinKarp}
+
 func TestRollWeakChecksum(t *testing.T) {
 	modifiedFileData, err := ioutil.ReadFile(modified)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(modifiedFileData) < 2*BlockSize+2 {
-		t.Skip("skipped, ", modified, "is too small")
+	for weakHash, checksum := range weakChecksums {
+		for _, blockSize := range []int{MinBlockSize, 1000, DefaultBlockSize} {
+			if len(modifiedFileData) < 2*blockSize+2 {
+				t.Skip("skipped, ", modified, "is too small")
+			}
+
+			d, _ := weakHash.New(blockSize)
+			d.Write(modifiedFileData[:blockSize])
+
+			for i := 0; i < blockSize+1; i++ {
+				d.Write(modifiedFileData[blockSize+i : blockSize+i+1])
+				if d1, digest1 := d.Sum32(), checksum(modifiedFileData[i+1:blockSize+i+1]); d1 != digest1 {
+					t.Fatalf("%v: expected %v, got %v when i=%v and blockSize=%v", weakHash, digest1, d1, i, blockSize)
+				}
+			}
+		}
+	}
+}
+
+// TestWeakHashSpread checks that blocks of repeated bytes, which are common in real files, do not share weak hashes.
+func TestWeakHashSpread(t *testing.T) {
+	// Rollsum sums the bytes of a block like librsync's, so it is left out: constant blocks of a power of two size collide on it
+	for _, weakHash := range []WeakHash{Adler32, Buzhash, RabinKarp} {
+		for _, blockSize := range []int{1024, 4096} {
+			var constant, sparse, periodic [][]byte
+			for v := 0; v < 256; v++ {
+				constant = append(constant, bytes.Repeat([]byte{byte(v)}, blockSize))
+			}
+			for i := 0; i < blockSize; i += blockSize / 512 {
+				for _, v := range []byte{1, 0x55, 0x80, 0xff} {
+					block := make([]byte, blockSize)
+					block[i] = v
+					sparse = append(sparse, block)
+				}
+			}
+			r := mathrand.New(mathrand.NewSource(0))
+			for n := 0; n < 256; n++ {
+				pattern := make([]byte, 32)
+				r.Read(pattern)
+				periodic = append(periodic, bytes.Repeat(pattern, blockSize/len(pattern)))
+			}
+
+			for _, test := range []struct {
+				name   string
+				blocks [][]byte
+			}{
+				{"constant", constant},
+				{"sparse", sparse},
+				{"periodic", periodic},
+			} {
+				hashes := make(map[uint32]bool)
+				for _, block := range test.blocks {
+					d, _ := weakHash.New(blockSize)
+					d.Write(block)
+					hashes[d.Sum32()] = true
+				}
+				if len(hashes) < len(test.blocks)*99/100 {
+					t.Errorf("%v: expected about %v distinct hashes of %v blocks, got %v when blockSize=%v", weakHash, len(test.blocks), test.name, len(hashes), blockSize)
+				}
+			}
+		}
+	}
+}
+
+// TestRollBatch checks that rolling the window over many bytes, in a Write or with roll, gives the checksums of rolling it byte by byte.
+func TestRollBatch(t *testing.T) {
+	modifiedFileData, err := ioutil.ReadFile(modified)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	d := newWeakChecksum()
-	d.Write(modifiedFileData[:BlockSize])
+	for weakHash, checksum := range weakChecksums {
+		for _, blockSize := range []int{MinBlockSize, 1000} {
+			count := blockSize + 1
+			if len(modifiedFileData) < blockSize+count {
+				t.Skip("skipped, ", modified, "is too small")
+			}
 
-	for i := 0; i < BlockSize+1; i++ {
-		d.Write(modifiedFileData[BlockSize+i : BlockSize+i+1])
-		if d1, digest1 := d.Sum32(), getWeakChecksum(modifiedFileData[i+1:BlockSize+i+1]); d1 != digest1 {
-			t.Fatalf("expected (%v, %v), got (%v,%v) when i=%v", digest1>>16, digest1&0xffff, d1>>16, d1&0xffff, i)
+			d, _ := weakHash.New(blockSize)
+			d.Write(modifiedFileData[:blockSize+count])
+			if d1, digest1 := d.Sum32(), checksum(modifiedFileData[count:blockSize+count]); d1 != digest1 {
+				t.Fatalf("%v: expected %v after a Write, got %v when blockSize=%v", weakHash, digest1, d1, blockSize)
+			}
 
+			d.Reset()
+			d.Write(modifiedFileData[:blockSize])
+			sums := make([]uint32, count)
+			d.Roll(modifiedFileData[:count], modifiedFileData[blockSize:blockSize+count], sums)
+			for i, d1 := range sums {
+				if digest1 := checksum(modifiedFileData[i+1 : blockSize+i+1]); d1 != digest1 {
+					t.Fatalf("%v: expected %v, got %v when i=%v and blockSize=%v", weakHash, digest1, d1, i, blockSize)
+				}
+			}
 		}
 	}
 }
 
 func TestOverflow(t *testing.T) {
-    result := uint64(BlockSize) * uint64(math.MaxUint8)
+    result := uint64(MaxBlockSize) * uint64(math.MaxUint8)
     if result > uint64(math.MaxUint32){
-        t.Fatal("BlockSize * MaxUint8 can overflow, weakChecksum behavior will be arbitrary")
+        t.Fatal("MaxBlockSize * MaxUint8 can overflow, weakChecksum behavior will be arbitrary")
     }
 }
 
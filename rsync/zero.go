@@ -0,0 +1,104 @@
+package rsync
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// zeroBuffer is written repeatedly by writeZeros. It must never be modified.
+var zeroBuffer = make([]byte, 32*1024)
+
+// writeZeros writes n zero bytes to w.
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		chunk := zeroBuffer
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// zeroSuffix returns the number of zero bytes at the end of data.
+func zeroSuffix(data []byte) int {
+	n := 0
+	for i := len(data) - 1; i >= 0 && data[i] == 0; i-- {
+		n++
+	}
+	return n
+}
+
+// sparseFile returns w if it is an *os.File of a regular file whose offset is at its end, so that skipping ahead leaves holes that read as zeros. Otherwise, it returns nil.
+func sparseFile(w io.Writer) *os.File {
+	f, ok := w.(*os.File)
+	if !ok {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || pos < fi.Size() {
+		return nil
+	}
+	return f
+}
+
+// skipZeros skips n zero bytes of f, a file returned by sparseFile, by extending it with a hole and seeking past it. The size is set too, so that writes to a file opened with O_APPEND, and a hole at the end of the file, work as well.
+func skipZeros(f *os.File, n int64) error {
+	pos, err := f.Seek(n, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(pos)
+}
+
+// SparseWriter buffers the writes to a file like a bufio.Writer, but is flushed before the zeros of ZERO ops are skipped, so that Patch leaves them as holes in the file when it is a regular file written at its end. Flush must be called once all data is written.
+type SparseWriter struct {
+	w *bufio.Writer
+	// sparse is the file, if the zeros can be skipped in it. See sparseFile.
+	sparse *os.File
+}
+
+// NewSparseWriter returns a new SparseWriter writing to f.
+func NewSparseWriter(f *os.File) *SparseWriter {
+	return &SparseWriter{w: bufio.NewWriter(f), sparse: sparseFile(f)}
+}
+
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Flush writes any buffered data to the file.
+func (w *SparseWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// skipZeros flushes w and skips n zero bytes of its file, leaving a hole. It must only be called if w.sparse is not nil.
+func (w *SparseWriter) skipZeros(n int64) error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return skipZeros(w.sparse, n)
+}
+
+// zeroSkipper returns a function that skips n zero bytes of w, leaving a hole, if w is a SparseWriter or an *os.File that can have holes. Otherwise, it returns nil, and the zeros must be written.
+func zeroSkipper(w io.Writer) func(n int64) error {
+	switch w := w.(type) {
+	case *SparseWriter:
+		if w.sparse != nil {
+			return w.skipZeros
+		}
+	case *os.File:
+		if f := sparseFile(w); f != nil {
+			return func(n int64) error { return skipZeros(f, n) }
+		}
+	}
+	return nil
+}
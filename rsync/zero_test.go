@@ -0,0 +1,159 @@
+package rsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDeltaZero(t *testing.T) {
+	oldData := createFakeData(64 * 1024)
+	// zeros not aligned to blocks, a block of zeros the old data does not have, and zeros at the end
+	newData := append([]byte(nil), oldData[:10*1024+100]...)
+	newData = append(newData, make([]byte, 20*1024)...)
+	newData = append(newData, oldData[10*1024:40*1024]...)
+	newData = append(newData, make([]byte, 5*1024+10)...)
+
+	sig, err := NewSignatureSize(bytes.NewReader(oldData), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inPlace := range []bool{false, true} {
+		delta := Delta
+		if inPlace {
+			delta = DeltaInPlace
+		}
+		ops, err := chanToOps(delta(sig, bytes.NewReader(newData)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats DeltaStats
+		for _, op := range ops {
+			stats.Add(op)
+		}
+		if stats.Ops["ZERO"] != 2 || stats.ZeroBytes < 24*1024 || stats.NewSize() != int64(len(newData)) {
+			t.Errorf("inPlace %v: expected 2 ZERO ops of at least 24KiB, got %v ops of %v bytes in %v bytes", inPlace, stats.Ops["ZERO"], stats.ZeroBytes, stats.NewSize())
+		}
+
+		patchedData := new(bytes.Buffer)
+		opsChan, cerr := opsToChan(ops)
+		if err := Patch(bytes.NewReader(oldData), opsChan, cerr, patchedData); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patchedData.Bytes(), newData) {
+			t.Errorf("inPlace %v: patched data is not equal to the new data", inPlace)
+		}
+
+		f, err := ioutil.TempFile("", "rsync-zero")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if inPlace {
+			if _, err := f.Write(oldData); err != nil {
+				t.Fatal(err)
+			}
+			opsChan, cerr = opsToChan(ops)
+			err = PatchInPlace(f, opsChan, cerr)
+		} else {
+			opsChan, cerr = opsToChan(ops)
+			err = Patch(bytes.NewReader(oldData), opsChan, cerr, f)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		patchedFile, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patchedFile, newData) {
+			t.Errorf("inPlace %v: patched file is not equal to the new data", inPlace)
+		}
+	}
+}
+
+func TestPatchZeroSparse(t *testing.T) {
+	ops := []Op{
+		{OpCode: RAW_DATA, Data: []byte("start")},
+		{OpCode: ZERO, Length: 1 << 20},
+		{OpCode: RAW_DATA, Data: []byte("middle")},
+		// the hole at the end must set the size
+		{OpCode: ZERO, Length: 1 << 20},
+	}
+	expected := append([]byte("start"), make([]byte, 1<<20)...)
+	expected = append(expected, "middle"...)
+	expected = append(expected, make([]byte, 1<<20)...)
+
+	// written directly and through a SparseWriter, which must be flushed before skipping the zeros
+	var f *os.File
+	for _, buffered := range []bool{false, true} {
+		var err error
+		f, err = ioutil.TempFile("", "rsync-sparse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if sparseFile(f) != f {
+			t.Fatal("expected an empty temporary file to be written sparse")
+		}
+
+		opsChan, cerr := opsToChan(ops)
+		if buffered {
+			w := NewSparseWriter(f)
+			err = Patch(bytes.NewReader(nil), opsChan, cerr, w)
+			if err == nil {
+				err = w.Flush()
+			}
+		} else {
+			err = Patch(bytes.NewReader(nil), opsChan, cerr, f)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		patchedFile, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patchedFile, expected) {
+			t.Errorf("buffered %v: expected %v bytes, got %v bytes or different data", buffered, len(expected), len(patchedFile))
+		}
+	}
+
+	// a file with data after the offset is not written sparse, as the data would be left in the holes
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sparseFile(f) != nil {
+		t.Error("expected a file with data after the offset not to be written sparse")
+	}
+
+	if sparseFile(new(bytes.Buffer)) != nil {
+		t.Error("expected a buffer not to be written sparse")
+	}
+}
+
+func TestLibrsyncDeltaZero(t *testing.T) {
+	ops := []Op{
+		{OpCode: COPY, Offset: 0, Length: 4},
+		{OpCode: ZERO, Length: 100 * 1024},
+		{OpCode: COPY, Offset: 4, Length: 6},
+	}
+	oldData := []byte("0123456789")
+	expected := append(append([]byte("0123"), make([]byte, 100*1024)...), "456789"...)
+
+	delta := new(bytes.Buffer)
+	opsChan, cerr := opsToChan(ops)
+	if err := WriteLibrsyncDelta(delta, opsChan, cerr); err != nil {
+		t.Fatal(err)
+	}
+	patched := new(bytes.Buffer)
+	if err := PatchLibrsync(bytes.NewReader(oldData), bytes.NewReader(delta.Bytes()), patched); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patched.Bytes(), expected) {
+		t.Error("patched data does not match the data of the ops")
+	}
+}
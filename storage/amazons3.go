@@ -84,7 +84,17 @@ func (stor AmazonS3Storage) Reader(filename string) (io.ReadCloser, error) {
 
 	bucket := stor.S3.Bucket(parsedUrl.Host)
 
-	return bucket.GetReader(parsedUrl.Path)
+	reader, err := bucket.GetReader(parsedUrl.Path)
+	if isAmazonS3NotFound(err) {
+		return nil, &StorageError{Op: "read", URL: filename, Err: ErrNotExist}
+	}
+	return reader, err
+}
+
+// isAmazonS3NotFound returns whether err is the answer of Amazon S3 to a request for a missing key or bucket.
+func isAmazonS3NotFound(err error) bool {
+	s3Err, ok := err.(*s3.Error)
+	return ok && s3Err.StatusCode == 404
 }
 
 type amazonS3Writer struct {
@@ -23,8 +23,12 @@ func (fs FilesystemStorage) List(dirpath string) ([]FileInfo, error) {
 	return newFileInfos, nil
 }
 
+// Reader opens filename for reading. If it does not exist, the error wraps ErrNotExist.
 func (fs FilesystemStorage) Reader(filename string) (io.ReadCloser, error) {
 	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, &StorageError{Op: "read", URL: filename, Err: ErrNotExist}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -41,8 +45,12 @@ func (fs FilesystemStorage) Writer(filename string) (io.WriteCloser, error) {
 	return file, nil
 }
 
+// Delete removes filename. If it does not exist, the error wraps ErrNotExist.
 func (fs FilesystemStorage) Delete(filename string) error {
 	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return &StorageError{Op: "delete", URL: filename, Err: ErrNotExist}
+	}
 	if err != nil {
 		return err
 	}
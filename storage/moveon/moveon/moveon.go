@@ -1,24 +1,51 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"net/url"
 	"os"
 
+	"github.com/mateusbraga/saveit/progress"
 	"github.com/mateusbraga/saveit/storage"
 )
 
+var progressFormat = flag.String("progress", "", "report progress on stderr: bar or json (default none)")
+
 func main() {
-	if len(os.Args) != 3 {
-		log.Fatalf("Usage: backup src dst\n")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		log.Fatalf("Usage: moveon [-progress bar|json] src dst\n")
 	}
 
-	srcRawUrl := os.Args[1]
-	dstRawUrl := os.Args[2]
+	srcRawUrl := flag.Arg(0)
+	dstRawUrl := flag.Arg(1)
+
+	printer, err := progress.NewPrinter(*progressFormat, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	meter := progress.NewMeter("copy", sourceSize(srcRawUrl), printer)
 
 	//log.Printf("Src: %v\n", srcRawUrl)
 	//log.Printf("Dst: %v\n", dstRawUrl)
-	err := storage.Copy(srcRawUrl, dstRawUrl)
+	err = storage.CopyContext(progress.NewContext(context.Background(), meter), srcRawUrl, dstRawUrl)
+	meter.Done()
 	if err != nil {
 		log.Println(err)
 	}
 }
+
+// sourceSize returns the size of the local file srcRawUrl, or 0 if it is unknown.
+func sourceSize(srcRawUrl string) int64 {
+	srcUrl, err := url.Parse(srcRawUrl)
+	if err != nil || srcUrl.Scheme != "" {
+		return 0
+	}
+	fi, err := os.Stat(srcRawUrl)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"net/url"
 	"os"
 
+	"github.com/mateusbraga/saveit/progress"
 	"launchpad.net/goamz/aws"
 	"launchpad.net/goamz/s3"
 )
@@ -34,32 +36,70 @@ type FileInfo interface {
 	os.FileInfo
 }
 
-// Copy copies a storage/directory/file specified in srcRawUrl to dstRawUrl.
+// ErrNotExist is returned when a file does not exist in a Storage. Storages may return errors wrapping it, check for it with errors.Is.
+var ErrNotExist = errors.New("storage: file does not exist")
+
+// StorageError records an error of the operation Op on the file or storage at URL.
+type StorageError struct {
+	Op  string
+	URL string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return "storage: " + e.Op + " " + e.URL + ": " + e.Err.Error()
+}
+
+// Unwrap returns e.Err, so that errors.Is and errors.As see the underlying error.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError returns err as a *StorageError of op on url, unless it already is one.
+func wrapError(op string, url string, err error) error {
+	var storageErr *StorageError
+	if errors.As(err, &storageErr) {
+		return err
+	}
+	return &StorageError{Op: op, URL: url, Err: err}
+}
+
+// Copy copies a storage/directory/file specified in srcRawUrl to dstRawUrl. Errors are *StorageError, a missing source wraps ErrNotExist.
 func Copy(srcRawUrl string, dstRawUrl string) error {
+	return CopyContext(context.Background(), srcRawUrl, dstRawUrl)
+}
+
+// CopyContext is like Copy, but stops when ctx is done. If ctx carries a progress.Meter, the bytes copied are counted in it.
+func CopyContext(ctx context.Context, srcRawUrl string, dstRawUrl string) error {
 	srcUrl, err := url.Parse(srcRawUrl)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to parse source url: %v\n", err))
+		return &StorageError{Op: "parse", URL: srcRawUrl, Err: err}
 	}
 
 	dstUrl, err := url.Parse(dstRawUrl)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to parse destination url: %v\n", err))
+		return &StorageError{Op: "parse", URL: dstRawUrl, Err: err}
+	}
+	srcStorage, err := GetStorage(srcUrl.Scheme)
+	if err != nil {
+		return &StorageError{Op: "open", URL: srcRawUrl, Err: err}
+	}
+	dstStorage, err := GetStorage(dstUrl.Scheme)
+	if err != nil {
+		return &StorageError{Op: "open", URL: dstRawUrl, Err: err}
 	}
-	srcStorage := GetStorage(srcUrl.Scheme)
-	dstStorage := GetStorage(dstUrl.Scheme)
 
 	exist, err := srcStorage.Exist(srcRawUrl)
 	if err != nil {
-		log.Fatalln(err)
-		return fmt.Errorf("Failed to check if source file '%v' exists: %v\n", srcUrl, err)
+		return wrapError("exist", srcRawUrl, err)
 	}
 	if !exist {
-		return fmt.Errorf("Source file '%v' do not exists: %v\n", srcUrl, err)
+		return &StorageError{Op: "copy", URL: srcRawUrl, Err: ErrNotExist}
 	}
 
 	log.Printf("Copying data from %v to %v\n", srcRawUrl, dstRawUrl)
 
-	err = doCopy(srcRawUrl, srcStorage, dstRawUrl, dstStorage)
+	err = doCopy(ctx, srcRawUrl, srcStorage, dstRawUrl, dstStorage)
 	if err != nil {
 		return err
 	}
@@ -68,62 +108,74 @@ func Copy(srcRawUrl string, dstRawUrl string) error {
 }
 
 // GetStorage returns the Storage with the scheme.
-func GetStorage(scheme string) Storage {
+func GetStorage(scheme string) (Storage, error) {
 	switch scheme {
 	case "":
-		return FilesystemStorage{}
+		return FilesystemStorage{}, nil
 	case "s3+http":
 		amazonS3Storage := AmazonS3Storage{}
 		auth, err := aws.EnvAuth()
 		if err != nil {
-			log.Fatalln("Failed to authenticate with aws:", err)
+			return nil, fmt.Errorf("storage: failed to authenticate with aws: %w", err)
 		}
 		amazonS3Storage.Auth = auth
 		amazonS3Storage.S3 = s3.New(amazonS3Storage.Auth, aws.USEast)
-		return amazonS3Storage
+		return amazonS3Storage, nil
 	}
 
-	log.Fatalln("Failed to find destination storage with scheme %v", scheme)
-	return nil
+	return nil, fmt.Errorf("storage: unknown storage scheme %q", scheme)
 }
 
 // doCopy copies from source to destination, using the Storage abstraction.
 // It allows to change the representation of what will be stored on the other side (i.e. to encrypt, to sign)
-func doCopy(srcpath string, srcStorage Storage, dstpath string, dstStorage Storage) error {
-	err := srcStorage.Status()
+func doCopy(ctx context.Context, srcpath string, srcStorage Storage, dstpath string, dstStorage Storage) (err error) {
+	err = srcStorage.Status()
 	if err != nil {
-		return fmt.Errorf("Source Storage is not operating: %v", err)
+		return wrapError("status", srcpath, err)
 	}
 
 	err = dstStorage.Status()
 	if err != nil {
-		return fmt.Errorf("Destination is not operating: %v", err)
+		return wrapError("status", dstpath, err)
 	}
 
 	srcReader, err := srcStorage.Reader(srcpath)
 	if err != nil {
-		return fmt.Errorf("Failed to get source reader: %v", err)
+		return wrapError("read", srcpath, err)
 	}
-	defer closeIO(srcReader)
+	defer closeIO(srcReader, srcpath, &err)
 
 	dstWriter, err := dstStorage.Writer(dstpath)
 	if err != nil {
-		return fmt.Errorf("Failed to get destination writer: %v", err)
+		return wrapError("write", dstpath, err)
 	}
-	defer closeIO(dstWriter)
+	defer closeIO(dstWriter, dstpath, &err)
 
-	_, err = io.Copy(dstWriter, srcReader)
+	_, err = io.Copy(dstWriter, progress.FromContext(ctx).Reader(contextReader{ctx: ctx, r: srcReader}))
 	if err != nil {
-		return fmt.Errorf("io.Copy: %v", err)
+		return wrapError("copy", dstpath, err)
 	}
 
 	return nil
 }
 
-// closeIO closes the io and exit if any error occurs.
-func closeIO(rw io.Closer) {
-	err := rw.Close()
-	if err != nil {
-		log.Fatalf("Failed to close io: %v", err)
+// contextReader reads from r until ctx is done, and then returns the error of ctx.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(buf []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(buf)
+}
+
+// closeIO closes the io of the file at url and sets *err to the error, unless it is already set. Closing writers may be what stores the data, so their error must not be ignored.
+func closeIO(rw io.Closer, url string, err *error) {
+	cerr := rw.Close()
+	if cerr != nil && *err == nil {
+		*err = &StorageError{Op: "close", URL: url, Err: cerr}
 	}
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
@@ -43,3 +44,36 @@ func TestNewDstFile(t *testing.T) {
 		t.Errorf("Files are not equal after Copy")
 	}
 }
+
+func TestCopyErrors(t *testing.T) {
+	tempDirName, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Could not create tempdir: %v", err)
+	}
+	defer os.RemoveAll(tempDirName)
+
+	srcFilename := path.Join(tempDirName, "missing")
+	err = Copy(srcFilename, path.Join(tempDirName, "test2"))
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected error wrapping ErrNotExist, got %v", err)
+	}
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) || storageErr.URL != srcFilename {
+		t.Errorf("Expected *StorageError of %v, got %v", srcFilename, err)
+	}
+
+	err = Copy("unknown://bucket/file", path.Join(tempDirName, "test2"))
+	if !errors.As(err, &storageErr) || storageErr.URL != "unknown://bucket/file" {
+		t.Errorf("Expected *StorageError for unknown scheme, got %v", err)
+	}
+}
+
+func TestFilesystemNotExist(t *testing.T) {
+	var fs FilesystemStorage
+	if _, err := fs.Reader("/nonexistent/test1"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected error wrapping ErrNotExist, got %v", err)
+	}
+	if err := fs.Delete("/nonexistent/test1"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected error wrapping ErrNotExist, got %v", err)
+	}
+}